@@ -0,0 +1,199 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrNoCredentials 请求中没有这个 Authenticator 认识的凭证，Chain 会继续尝试下一个，单独使用时返回 401
+	ErrNoCredentials = errors.New("auth: no credentials")
+	// ErrInvalidCredentials 凭证无效或者过期，返回 401
+	ErrInvalidCredentials = errors.New("auth: invalid credentials")
+	// ErrForbidden 凭证有效但是不允许连接，返回 403
+	ErrForbidden = errors.New("auth: forbidden")
+)
+
+// Identity 认证后的身份
+type Identity struct {
+	// UserId 用户 id，同一个用户可以有多个连接
+	UserId string
+	// Tenant 租户，可以为空
+	Tenant string
+	// Roles 角色
+	Roles []string
+	// Claims 其他信息，比如 JWT 的 claims
+	Claims map[string]any
+	// ExpiresAt 凭证过期时间，包括验证时允许的时钟误差，为零时不过期，过期前没有在连接内更换 token 的连接会被关闭
+	ExpiresAt time.Time
+}
+
+// HasRole 是否有角色 role
+func (i *Identity) HasRole(role string) bool {
+	for _, r := range i.Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// Metadata 字符串类型的 Claims 和 Tenant，作为客户端元数据，广播时用来过滤
+func (i *Identity) Metadata() map[string]string {
+	metadata := map[string]string{}
+	for key, value := range i.Claims {
+		if str, ok := value.(string); ok {
+			metadata[key] = str
+		}
+	}
+	if i.Tenant != "" {
+		metadata["tenant"] = i.Tenant
+	}
+	return metadata
+}
+
+// Authenticator 在升级为 WebSocket 之前认证请求
+type Authenticator interface {
+	// Authenticate 返回请求的身份，失败时返回的错误包装 ErrNoCredentials、ErrInvalidCredentials 或 ErrForbidden
+	Authenticate(r *http.Request) (*Identity, error)
+}
+
+// TokenAuthenticator 可以在连接建立后验证新的 token，客户端通过 engine.TypeReauth 更换 token 而不用重新连接
+type TokenAuthenticator interface {
+	// AuthenticateToken 验证 token，错误和 Authenticate 一致
+	AuthenticateToken(token string) (*Identity, error)
+}
+
+// Runner 需要后台任务的 Authenticator，比如定期重新加载公钥的 JWT，由 Hub.Run 启动，Hub 关闭时 ctx 结束
+type Runner interface {
+	Run(ctx context.Context)
+}
+
+// AuthenticatorFunc 函数形式的 Authenticator
+type AuthenticatorFunc func(r *http.Request) (*Identity, error)
+
+func (f AuthenticatorFunc) Authenticate(r *http.Request) (*Identity, error) {
+	return f(r)
+}
+
+// StatusCode 认证错误对应的 HTTP 状态码，ErrForbidden 为 403，其他为 401
+func StatusCode(err error) int {
+	if errors.Is(err, ErrForbidden) {
+		return http.StatusForbidden
+	}
+	return http.StatusUnauthorized
+}
+
+// Chain 依次尝试 authenticators，跳过返回 ErrNoCredentials 的，使用第一个成功或者失败的结果
+// 返回值实现了 TokenAuthenticator，只尝试其中实现了 TokenAuthenticator 的
+func Chain(authenticators ...Authenticator) Authenticator {
+	return chain(authenticators)
+}
+
+type chain []Authenticator
+
+func (c chain) Authenticate(r *http.Request) (*Identity, error) {
+	for _, authenticator := range c {
+		identity, err := authenticator.Authenticate(r)
+		if errors.Is(err, ErrNoCredentials) {
+			continue
+		}
+		return identity, err
+	}
+	return nil, ErrNoCredentials
+}
+
+func (c chain) AuthenticateToken(token string) (*Identity, error) {
+	for _, authenticator := range c {
+		tokenAuthenticator, ok := authenticator.(TokenAuthenticator)
+		if !ok {
+			continue
+		}
+		identity, err := tokenAuthenticator.AuthenticateToken(token)
+		if errors.Is(err, ErrNoCredentials) {
+			continue
+		}
+		return identity, err
+	}
+	return nil, ErrNoCredentials
+}
+
+// Run 启动其中实现了 Runner 的后台任务，全部退出后返回
+func (c chain) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, authenticator := range c {
+		if runner, ok := authenticator.(Runner); ok {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				runner.Run(ctx)
+			}()
+		}
+	}
+	wg.Wait()
+}
+
+// RequireRoles 认证通过后还需要有 roles 中的一个角色，否则返回 ErrForbidden
+func RequireRoles(authenticator Authenticator, roles ...string) Authenticator {
+	return &requireRoles{authenticator: authenticator, roles: roles}
+}
+
+type requireRoles struct {
+	authenticator Authenticator
+	roles         []string
+}
+
+func (a *requireRoles) Authenticate(r *http.Request) (*Identity, error) {
+	return a.check(a.authenticator.Authenticate(r))
+}
+
+func (a *requireRoles) AuthenticateToken(token string) (*Identity, error) {
+	tokenAuthenticator, ok := a.authenticator.(TokenAuthenticator)
+	if !ok {
+		return nil, ErrNoCredentials
+	}
+	return a.check(tokenAuthenticator.AuthenticateToken(token))
+}
+
+func (a *requireRoles) Run(ctx context.Context) {
+	if runner, ok := a.authenticator.(Runner); ok {
+		runner.Run(ctx)
+	}
+}
+
+func (a *requireRoles) check(identity *Identity, err error) (*Identity, error) {
+	if err != nil {
+		return nil, err
+	}
+	for _, role := range a.roles {
+		if identity.HasRole(role) {
+			return identity, nil
+		}
+	}
+	return nil, ErrForbidden
+}
+
+// Query 直接使用查询参数 client_id 作为用户 id，不做任何校验，只用于开发和内网
+func Query() Authenticator {
+	return AuthenticatorFunc(func(r *http.Request) (*Identity, error) {
+		userId := r.URL.Query().Get("client_id")
+		if userId == "" {
+			return nil, ErrNoCredentials
+		}
+		return &Identity{UserId: userId}, nil
+	})
+}
+
+// bearerToken 从 Authorization 头或者查询参数 token 中取出 token，浏览器建立 WebSocket 时不能设置请求头
+func bearerToken(r *http.Request) string {
+	if header := r.Header.Get("Authorization"); header != "" {
+		if token, ok := strings.CutPrefix(header, "Bearer "); ok {
+			return token
+		}
+	}
+	return strings.TrimPrefix(r.URL.Query().Get("token"), "Bearer ")
+}
@@ -0,0 +1,136 @@
+package auth
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/WangSiangCun/go-ws/config"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func sign(t *testing.T, method jwt.SigningMethod, key any, claims jwt.MapClaims) string {
+	token, err := jwt.NewWithClaims(method, claims).SignedString(key)
+	assert.NoError(t, err)
+	return token
+}
+
+func TestJWT(t *testing.T) {
+	authenticator := NewJWT("secret")
+	token := sign(t, jwt.SigningMethodHS256, []byte("secret"), jwt.MapClaims{
+		"client_id": "u1", "tenant": "t1", "roles": []string{"admin", "user"}, "region": "cn",
+		"exp": time.Now().Add(time.Hour).Unix(),
+	})
+
+	r := httptest.NewRequest(http.MethodGet, "/ws", nil)
+	r.Header.Set("Authorization", "Bearer "+token)
+	identity, err := authenticator.Authenticate(r)
+	assert.NoError(t, err)
+	assert.Equal(t, "u1", identity.UserId)
+	assert.Equal(t, "t1", identity.Tenant)
+	assert.Equal(t, []string{"admin", "user"}, identity.Roles)
+	assert.Equal(t, map[string]string{"client_id": "u1", "tenant": "t1", "region": "cn"}, identity.Metadata())
+
+	// 浏览器只能放在查询参数中
+	identity, err = authenticator.Authenticate(httptest.NewRequest(http.MethodGet, "/ws?token="+token, nil))
+	assert.NoError(t, err)
+	assert.Equal(t, "u1", identity.UserId)
+
+	_, err = authenticator.Authenticate(httptest.NewRequest(http.MethodGet, "/ws", nil))
+	assert.ErrorIs(t, err, ErrNoCredentials)
+
+	for name, token := range map[string]string{
+		"wrong secret": sign(t, jwt.SigningMethodHS256, []byte("other"), jwt.MapClaims{"client_id": "u1"}),
+		"expired":      sign(t, jwt.SigningMethodHS256, []byte("secret"), jwt.MapClaims{"client_id": "u1", "exp": time.Now().Add(-time.Hour).Unix()}),
+		"none":         sign(t, jwt.SigningMethodNone, jwt.UnsafeAllowNoneSignatureType, jwt.MapClaims{"client_id": "u1"}),
+		"no user":      sign(t, jwt.SigningMethodHS256, []byte("secret"), jwt.MapClaims{"tenant": "t1"}),
+		"malformed":    "not-a-token",
+	} {
+		_, err := authenticator.Authenticate(httptest.NewRequest(http.MethodGet, "/ws?token="+token, nil))
+		assert.ErrorIs(t, err, ErrInvalidCredentials, name)
+		assert.Equal(t, http.StatusUnauthorized, StatusCode(err), name)
+	}
+
+	// 没有 client_id 时使用 sub，roles 可以是空格分隔的字符串
+	token = sign(t, jwt.SigningMethodHS256, []byte("secret"), jwt.MapClaims{"sub": "u2", "roles": "a b"})
+	identity, err = authenticator.Authenticate(httptest.NewRequest(http.MethodGet, "/ws?token="+token, nil))
+	assert.NoError(t, err)
+	assert.Equal(t, "u2", identity.UserId)
+	assert.Equal(t, []string{"a", "b"}, identity.Roles)
+}
+
+func TestNewJWTFromConfig(t *testing.T) {
+	_, err := NewJWTFromConfig(config.JWT{})
+	assert.Error(t, err)
+	_, err = NewJWTFromConfig(config.JWT{JWKS: "missing.json"})
+	assert.Error(t, err)
+
+	authenticator, err := NewJWTFromConfig(config.JWT{AccessSecret: "secret", Issuer: "ws", Leeway: 60})
+	assert.NoError(t, err)
+	// 过期 10 秒，在允许的误差内，连接在误差结束时才过期
+	exp := time.Now().Add(-10 * time.Second).Truncate(time.Second)
+	token := sign(t, jwt.SigningMethodHS256, []byte("secret"), jwt.MapClaims{"client_id": "u1", "iss": "ws", "exp": exp.Unix()})
+	identity, err := authenticator.Authenticate(httptest.NewRequest(http.MethodGet, "/ws?token="+token, nil))
+	assert.NoError(t, err)
+	assert.Equal(t, exp.Add(time.Minute), identity.ExpiresAt)
+	token = sign(t, jwt.SigningMethodHS256, []byte("secret"), jwt.MapClaims{"client_id": "u1", "iss": "other"})
+	_, err = authenticator.Authenticate(httptest.NewRequest(http.MethodGet, "/ws?token="+token, nil))
+	assert.ErrorIs(t, err, ErrInvalidCredentials)
+}
+
+func TestAPIKeys(t *testing.T) {
+	authenticator := NewAPIKeys(APIKey{Key: "k1", UserId: "service", Roles: []string{"internal"}})
+
+	r := httptest.NewRequest(http.MethodGet, "/ws", nil)
+	r.Header.Set("X-API-Key", "k1")
+	identity, err := authenticator.Authenticate(r)
+	assert.NoError(t, err)
+	assert.Equal(t, &Identity{UserId: "service", Roles: []string{"internal"}}, identity)
+
+	_, err = authenticator.Authenticate(httptest.NewRequest(http.MethodGet, "/ws?api_key=k2", nil))
+	assert.ErrorIs(t, err, ErrInvalidCredentials)
+	_, err = authenticator.Authenticate(httptest.NewRequest(http.MethodGet, "/ws", nil))
+	assert.ErrorIs(t, err, ErrNoCredentials)
+}
+
+func TestChain(t *testing.T) {
+	authenticator := Chain(NewJWT("secret"), NewAPIKeys(APIKey{Key: "k1", UserId: "service", Roles: []string{"internal"}}))
+
+	identity, err := authenticator.Authenticate(httptest.NewRequest(http.MethodGet, "/ws?api_key=k1", nil))
+	assert.NoError(t, err)
+	assert.Equal(t, "service", identity.UserId)
+
+	// 第一个认识凭证的失败时不再尝试后面的
+	_, err = authenticator.Authenticate(httptest.NewRequest(http.MethodGet, "/ws?token=bad&api_key=k1", nil))
+	assert.ErrorIs(t, err, ErrInvalidCredentials)
+
+	_, err = authenticator.Authenticate(httptest.NewRequest(http.MethodGet, "/ws?client_id=u1", nil))
+	assert.ErrorIs(t, err, ErrNoCredentials)
+	assert.Equal(t, http.StatusUnauthorized, StatusCode(err))
+
+	admin := RequireRoles(authenticator, "admin")
+	_, err = admin.Authenticate(httptest.NewRequest(http.MethodGet, "/ws?api_key=k1", nil))
+	assert.ErrorIs(t, err, ErrForbidden)
+	assert.Equal(t, http.StatusForbidden, StatusCode(err))
+	_, err = RequireRoles(authenticator, "admin", "internal").Authenticate(httptest.NewRequest(http.MethodGet, "/ws?api_key=k1", nil))
+	assert.NoError(t, err)
+
+	// 连接内更换 token 只尝试支持 token 的 Authenticator
+	expiresAt := time.Now().Add(time.Hour).Truncate(time.Second)
+	token := sign(t, jwt.SigningMethodHS256, []byte("secret"), jwt.MapClaims{"client_id": "u1", "roles": "admin", "exp": expiresAt.Unix()})
+	identity, err = authenticator.(TokenAuthenticator).AuthenticateToken(token)
+	assert.NoError(t, err)
+	assert.Equal(t, expiresAt, identity.ExpiresAt)
+	_, err = authenticator.(TokenAuthenticator).AuthenticateToken("k1")
+	assert.ErrorIs(t, err, ErrInvalidCredentials)
+	_, err = admin.(TokenAuthenticator).AuthenticateToken(token)
+	assert.NoError(t, err)
+	_, err = RequireRoles(NewAPIKeys(), "admin").(TokenAuthenticator).AuthenticateToken(token)
+	assert.ErrorIs(t, err, ErrNoCredentials)
+
+	// HMAC 密钥没有后台任务，Run 直接返回
+	admin.(Runner).Run(context.Background())
+}
@@ -0,0 +1,112 @@
+package auth
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/WangSiangCun/go-ws/config"
+	"github.com/WangSiangCun/go-ws/core/jwtHelper"
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// JWT 的 claims 和 Identity 的对应关系
+const (
+	// ClaimUserId 用户 id，没有时使用 sub
+	ClaimUserId = "client_id"
+	// ClaimTenant 租户
+	ClaimTenant = "tenant"
+	// ClaimRoles 角色，字符串数组或者空格分隔的字符串
+	ClaimRoles = "roles"
+)
+
+// JWT 认证 JWT，token 放在 Authorization: Bearer 头或者查询参数 token 中
+type JWT struct {
+	verify func(token string) (jwt.MapClaims, error)
+	// verifier 公钥验证时定期重新加载公钥，见 Run
+	verifier *jwtHelper.Verifier
+	// leeway 验证 exp 时允许的时钟误差，Identity.ExpiresAt 包括这部分
+	leeway time.Duration
+}
+
+// NewJWT 验证 HMAC 签名的 JWT
+func NewJWT(secret string) *JWT {
+	return &JWT{verify: func(token string) (jwt.MapClaims, error) {
+		return jwtHelper.Parse(secret, token)
+	}}
+}
+
+// NewJWTVerifier 使用 verifier 验证，支持 RS256、ES256、EdDSA 等公钥签名
+func NewJWTVerifier(verifier *jwtHelper.Verifier) *JWT {
+	return &JWT{verify: verifier.Verify, verifier: verifier, leeway: verifier.Leeway()}
+}
+
+// NewJWTFromConfig 按配置创建，公钥文件或者 JWKS 加载失败时返回错误
+func NewJWTFromConfig(c config.JWT) (*JWT, error) {
+	verifier, err := jwtHelper.NewVerifier(jwtHelper.Options{
+		Secret:          c.AccessSecret,
+		PublicKeys:      c.PublicKeys,
+		JWKS:            c.JWKS,
+		RefreshInterval: time.Duration(c.RefreshInterval) * time.Second,
+		Issuer:          c.Issuer,
+		Audience:        c.Audience,
+		Leeway:          time.Duration(c.Leeway) * time.Second,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return NewJWTVerifier(verifier), nil
+}
+
+// Run 在后台定期重新加载公钥，见 jwtHelper.Verifier.Run，HMAC 密钥时直接返回
+func (j *JWT) Run(ctx context.Context) {
+	if j.verifier != nil {
+		j.verifier.Run(ctx)
+	}
+}
+
+func (j *JWT) Authenticate(r *http.Request) (*Identity, error) {
+	return j.AuthenticateToken(bearerToken(r))
+}
+
+func (j *JWT) AuthenticateToken(token string) (*Identity, error) {
+	token = strings.TrimPrefix(token, "Bearer ")
+	if token == "" {
+		return nil, ErrNoCredentials
+	}
+	claims, err := j.verify(token)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidCredentials, err)
+	}
+	return identityFromClaims(claims, j.leeway)
+}
+
+// identityFromClaims 按 ClaimUserId、ClaimTenant、ClaimRoles 取出身份，其他 claims 放在 Identity.Claims 中
+// ExpiresAt 为 exp 加上 leeway，和验证时一致，否则在误差范围内的 token 连接后会立即被关闭
+func identityFromClaims(claims map[string]any, leeway time.Duration) (*Identity, error) {
+	userId, _ := claims[ClaimUserId].(string)
+	if userId == "" {
+		userId, _ = claims["sub"].(string)
+	}
+	if userId == "" {
+		return nil, fmt.Errorf("%w: token has no %s or sub", ErrInvalidCredentials, ClaimUserId)
+	}
+	identity := &Identity{UserId: userId, Claims: claims}
+	identity.Tenant, _ = claims[ClaimTenant].(string)
+	if exp, ok := claims["exp"].(float64); ok {
+		identity.ExpiresAt = time.Unix(int64(exp), 0).Add(leeway)
+	}
+	switch roles := claims[ClaimRoles].(type) {
+	case string:
+		identity.Roles = strings.Fields(roles)
+	case []any:
+		for _, role := range roles {
+			if str, ok := role.(string); ok {
+				identity.Roles = append(identity.Roles, str)
+			}
+		}
+	}
+	return identity, nil
+}
@@ -0,0 +1,162 @@
+package broker
+
+import (
+	"sync"
+
+	"github.com/streadway/amqp"
+)
+
+// AMQPBroker 基于 RabbitMQ 工作模式的 Broker，每个节点一个持久化队列
+type AMQPBroker struct {
+	conn *amqp.Connection
+
+	mu        sync.Mutex
+	channel   *amqp.Channel
+	declared  map[string]bool
+	consumers []*amqp.Channel
+	closed    bool
+}
+
+// NewAMQPBroker 使用已建立的 RabbitMQ 连接创建 Broker
+func NewAMQPBroker(conn *amqp.Connection) *AMQPBroker {
+	return &AMQPBroker{
+		conn:     conn,
+		declared: make(map[string]bool),
+	}
+}
+
+// Publish 发送持久化消息到 node 队列
+func (b *AMQPBroker) Publish(node string, body []byte) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return ErrClosed
+	}
+
+	channel, err := b.publishChannel()
+	if err != nil {
+		return err
+	}
+	if !b.declared[node] {
+		if _, err = declareQueue(channel, node); err != nil {
+			b.resetChannel()
+			return err
+		}
+		b.declared[node] = true
+	}
+
+	err = channel.Publish(
+		"",    // exchange
+		node,  // routing key
+		false, // mandatory
+		false, // immediate
+		amqp.Publishing{
+			DeliveryMode: amqp.Persistent,
+			ContentType:  "text/plain",
+			Body:         body,
+		})
+	if err != nil {
+		// 出错后通道不可用，下次重新打开
+		b.resetChannel()
+	}
+	return err
+}
+
+// Subscribe 订阅 node 队列，prefetch 为 1，需要手动应答
+func (b *AMQPBroker) Subscribe(node string) (<-chan *Delivery, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return nil, ErrClosed
+	}
+
+	channel, err := b.conn.Channel()
+	if err != nil {
+		return nil, err
+	}
+	q, err := declareQueue(channel, node)
+	if err != nil {
+		channel.Close()
+		return nil, err
+	}
+	if err = channel.Qos(1, 0, false); err != nil {
+		channel.Close()
+		return nil, err
+	}
+	messages, err := channel.Consume(
+		q.Name, // queue
+		"",     // consumer
+		false,  // auto-ack
+		false,  // exclusive
+		false,  // no-local
+		false,  // no-wait
+		nil,    // args
+	)
+	if err != nil {
+		channel.Close()
+		return nil, err
+	}
+	b.consumers = append(b.consumers, channel)
+
+	deliveries := make(chan *Delivery)
+	go func() {
+		defer close(deliveries)
+		for m := range messages {
+			m := m
+			deliveries <- NewDelivery(m.Body, m.Redelivered, func() error {
+				return m.Ack(false)
+			}, func(requeue bool) error {
+				return m.Nack(false, requeue)
+			})
+		}
+	}()
+	return deliveries, nil
+}
+
+// Close 关闭所有通道和连接
+func (b *AMQPBroker) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return nil
+	}
+	b.closed = true
+
+	for _, channel := range b.consumers {
+		channel.Close()
+	}
+	b.consumers = nil
+	b.resetChannel()
+	return b.conn.Close()
+}
+
+func (b *AMQPBroker) publishChannel() (*amqp.Channel, error) {
+	if b.channel != nil {
+		return b.channel, nil
+	}
+	channel, err := b.conn.Channel()
+	if err != nil {
+		return nil, err
+	}
+	b.channel = channel
+	return channel, nil
+}
+
+func (b *AMQPBroker) resetChannel() {
+	if b.channel != nil {
+		b.channel.Close()
+		b.channel = nil
+	}
+	b.declared = make(map[string]bool)
+}
+
+func declareQueue(channel *amqp.Channel, name string) (amqp.Queue, error) {
+	return channel.QueueDeclare(
+		name,  // name
+		true,  // durable
+		false, // delete when unused
+		false, // exclusive
+		false, // no-wait
+		nil,   // arguments
+	)
+}
@@ -0,0 +1,52 @@
+package broker
+
+import "errors"
+
+// ErrClosed Broker 已关闭
+var ErrClosed = errors.New("broker: closed")
+
+// Broker 节点间的消息传输，每个节点（Host+WSPort）对应一个队列
+type Broker interface {
+	// Publish 发送消息到 node 对应的队列
+	Publish(node string, body []byte) error
+	// Subscribe 订阅 node 对应的队列，同一个队列的多个订阅者竞争消费
+	Subscribe(node string) (<-chan *Delivery, error)
+	// Close 关闭 Broker，所有订阅通道都会被关闭
+	Close() error
+}
+
+// Delivery 从 Broker 收到的一条消息，处理完后必须 Ack 或 Nack
+type Delivery struct {
+	Body []byte
+	// Redelivered 是否是被 Nack 之后重新投递的消息
+	Redelivered bool
+
+	ack  func() error
+	nack func(requeue bool) error
+}
+
+// NewDelivery 创建 Delivery，ack 和 nack 可以为 nil
+func NewDelivery(body []byte, redelivered bool, ack func() error, nack func(requeue bool) error) *Delivery {
+	return &Delivery{
+		Body:        body,
+		Redelivered: redelivered,
+		ack:         ack,
+		nack:        nack,
+	}
+}
+
+// Ack 确认消息已被处理
+func (d *Delivery) Ack() error {
+	if d.ack == nil {
+		return nil
+	}
+	return d.ack()
+}
+
+// Nack 拒绝消息，requeue 为 true 时消息会重新入队
+func (d *Delivery) Nack(requeue bool) error {
+	if d.nack == nil {
+		return nil
+	}
+	return d.nack(requeue)
+}
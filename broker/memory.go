@@ -0,0 +1,143 @@
+package broker
+
+import "sync"
+
+// MemoryBroker 进程内的 Broker，用于单机部署和测试
+type MemoryBroker struct {
+	mu     sync.Mutex
+	queues map[string]*memoryQueue
+	done   chan struct{}
+	closed bool
+}
+
+type memoryItem struct {
+	body        []byte
+	redelivered bool
+}
+
+type memoryQueue struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	items  []*memoryItem
+	closed bool
+}
+
+// NewMemoryBroker 创建进程内 Broker
+func NewMemoryBroker() *MemoryBroker {
+	return &MemoryBroker{
+		queues: make(map[string]*memoryQueue),
+		done:   make(chan struct{}),
+	}
+}
+
+// Publish 发送消息到 node 队列，不会阻塞
+func (b *MemoryBroker) Publish(node string, body []byte) error {
+	q, err := b.queue(node)
+	if err != nil {
+		return err
+	}
+	q.push(&memoryItem{body: body}, false)
+	return nil
+}
+
+// Subscribe 订阅 node 队列
+func (b *MemoryBroker) Subscribe(node string) (<-chan *Delivery, error) {
+	q, err := b.queue(node)
+	if err != nil {
+		return nil, err
+	}
+
+	deliveries := make(chan *Delivery)
+	go func() {
+		defer close(deliveries)
+		for {
+			item, ok := q.pop()
+			if !ok {
+				return
+			}
+			var once sync.Once
+			delivery := NewDelivery(item.body, item.redelivered, nil, func(requeue bool) error {
+				once.Do(func() {
+					if requeue {
+						q.push(&memoryItem{body: item.body, redelivered: true}, true)
+					}
+				})
+				return nil
+			})
+			select {
+			case deliveries <- delivery:
+			case <-b.done:
+				return
+			}
+		}
+	}()
+	return deliveries, nil
+}
+
+// Close 关闭 Broker，未消费的消息会被丢弃
+func (b *MemoryBroker) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return nil
+	}
+	b.closed = true
+	close(b.done)
+	for _, q := range b.queues {
+		q.close()
+	}
+	return nil
+}
+
+func (b *MemoryBroker) queue(node string) (*memoryQueue, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return nil, ErrClosed
+	}
+	q, ok := b.queues[node]
+	if !ok {
+		q = &memoryQueue{}
+		q.cond = sync.NewCond(&q.mu)
+		b.queues[node] = q
+	}
+	return q, nil
+}
+
+func (q *memoryQueue) push(item *memoryItem, front bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return
+	}
+	if front {
+		q.items = append([]*memoryItem{item}, q.items...)
+	} else {
+		q.items = append(q.items, item)
+	}
+	q.cond.Signal()
+}
+
+// pop 阻塞直到有消息或者队列关闭
+func (q *memoryQueue) pop() (*memoryItem, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for len(q.items) == 0 && !q.closed {
+		q.cond.Wait()
+	}
+	if q.closed {
+		return nil, false
+	}
+	item := q.items[0]
+	q.items[0] = nil
+	q.items = q.items[1:]
+	return item, true
+}
+
+func (q *memoryQueue) close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.closed = true
+	q.items = nil
+	q.cond.Broadcast()
+}
@@ -0,0 +1,76 @@
+package broker
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func receive(t *testing.T, deliveries <-chan *Delivery) *Delivery {
+	select {
+	case d, ok := <-deliveries:
+		assert.True(t, ok)
+		return d
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for delivery")
+		return nil
+	}
+}
+
+func TestMemoryBroker_PublishSubscribe(t *testing.T) {
+	b := NewMemoryBroker()
+	defer b.Close()
+
+	assert.NoError(t, b.Publish("node-a", []byte("1")))
+	assert.NoError(t, b.Publish("node-b", []byte("other")))
+	assert.NoError(t, b.Publish("node-a", []byte("2")))
+
+	deliveries, err := b.Subscribe("node-a")
+	assert.NoError(t, err)
+	for _, want := range []string{"1", "2"} {
+		d := receive(t, deliveries)
+		assert.Equal(t, want, string(d.Body))
+		assert.False(t, d.Redelivered)
+		assert.NoError(t, d.Ack())
+	}
+}
+
+func TestMemoryBroker_NackRequeue(t *testing.T) {
+	b := NewMemoryBroker()
+	defer b.Close()
+
+	deliveries, err := b.Subscribe("node")
+	assert.NoError(t, err)
+	assert.NoError(t, b.Publish("node", []byte("msg")))
+
+	d := receive(t, deliveries)
+	assert.NoError(t, d.Nack(true))
+	d = receive(t, deliveries)
+	assert.Equal(t, "msg", string(d.Body))
+	assert.True(t, d.Redelivered)
+	assert.NoError(t, d.Nack(false))
+
+	select {
+	case d := <-deliveries:
+		t.Fatalf("unexpected delivery %q", d.Body)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestMemoryBroker_Close(t *testing.T) {
+	b := NewMemoryBroker()
+	deliveries, err := b.Subscribe("node")
+	assert.NoError(t, err)
+	assert.NoError(t, b.Close())
+
+	select {
+	case _, ok := <-deliveries:
+		assert.False(t, ok)
+	case <-time.After(time.Second):
+		t.Fatal("subscription not closed")
+	}
+	assert.ErrorIs(t, b.Publish("node", []byte("x")), ErrClosed)
+	_, err = b.Subscribe("node")
+	assert.ErrorIs(t, err, ErrClosed)
+}
@@ -0,0 +1,72 @@
+package codec
+
+import (
+	"sync"
+
+	"github.com/WangSiangCun/go-ws/engine"
+)
+
+// 内置编码的名称，也是客户端在 Sec-WebSocket-Protocol 中使用的子协议名
+const (
+	NameJSON     = "json"
+	NameMsgPack  = "msgpack"
+	NameProtobuf = "protobuf"
+)
+
+// Codec 消息的编码方式，客户端连接时通过子协议选择，节点间转发也使用它
+type Codec interface {
+	// Name 子协议名
+	Name() string
+	// Binary 是否使用二进制帧，否则使用文本帧
+	Binary() bool
+	Marshal(message *engine.Message) ([]byte, error)
+	Unmarshal(data []byte, message *engine.Message) error
+}
+
+var (
+	mu     sync.RWMutex
+	codecs = map[string]Codec{}
+	// names 注册顺序，Names 按这个顺序返回
+	names []string
+)
+
+func init() {
+	Register(JSON)
+	Register(MsgPack)
+	Register(Protobuf)
+}
+
+// Register 注册编码，同名的会被替换
+func Register(c Codec) {
+	mu.Lock()
+	defer mu.Unlock()
+	if _, ok := codecs[c.Name()]; !ok {
+		names = append(names, c.Name())
+	}
+	codecs[c.Name()] = c
+}
+
+// Get 按名称查找编码
+func Get(name string) (Codec, bool) {
+	mu.RLock()
+	defer mu.RUnlock()
+	c, ok := codecs[name]
+	return c, ok
+}
+
+// Names 所有已注册的编码名称
+func Names() []string {
+	mu.RLock()
+	defer mu.RUnlock()
+	return append([]string(nil), names...)
+}
+
+// Negotiate 按客户端给出的顺序选择第一个支持的编码，都不支持时使用 JSON，ok 为 false
+func Negotiate(offered []string) (c Codec, ok bool) {
+	for _, name := range offered {
+		if c, ok = Get(name); ok {
+			return c, true
+		}
+	}
+	return JSON, false
+}
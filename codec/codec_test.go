@@ -0,0 +1,168 @@
+package codec
+
+import (
+	"bytes"
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	"github.com/WangSiangCun/go-ws/engine"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+func fullMessage() *engine.Message {
+	return &engine.Message{
+		Version:     engine.Version2,
+		Id:          "m1",
+		Message:     "hello",
+		TargetIds:   []string{"u2", "u3"},
+		SourceId:    "u1",
+		Type:        -4,
+		Room:        "lobby",
+		Broadcast:   true,
+		Filters:     []engine.Filter{{Key: "region", Op: engine.FilterIn, Values: []string{"cn", "us"}}, {Key: "vip", Op: engine.FilterExists}},
+		ConnIds:     []string{"c1"},
+		Seq:         1 << 40,
+		RequestId:   "r1",
+		Method:      "match.join",
+		Error:       engine.NewRPCError(engine.RPCTimeout, "timeout"),
+		Timestamp:   1700000000000,
+		Headers:     map[string]string{"trace": "abc", "empty": ""},
+		ContentType: "application/octet-stream",
+		Data:        []byte{0, 1, 2, 0xff},
+	}
+}
+
+func TestCodecs_RoundTrip(t *testing.T) {
+	long := make([]byte, 70000)
+	for i := range long {
+		long[i] = byte(i)
+	}
+	messages := []*engine.Message{
+		fullMessage(),
+		{Message: "minimal"},
+		{Message: strings.Repeat("消息", 100), Data: long, TargetIds: []string{}, Type: 1 << 33},
+	}
+	for _, name := range Names() {
+		c, ok := Get(name)
+		assert.True(t, ok)
+		for _, message := range messages {
+			data, err := c.Marshal(message)
+			assert.NoError(t, err, name)
+			decoded := &engine.Message{}
+			assert.NoError(t, c.Unmarshal(data, decoded), name)
+			if len(message.TargetIds) == 0 {
+				// 空列表和 nil 各编码的处理不一致，都当作没有目标
+				assert.Empty(t, decoded.TargetIds, name)
+				decoded.TargetIds = message.TargetIds
+			}
+			assert.Equal(t, message, decoded, name)
+		}
+	}
+}
+
+func TestCodecs_Binary(t *testing.T) {
+	assert.False(t, JSON.Binary())
+	assert.True(t, MsgPack.Binary())
+	assert.True(t, Protobuf.Binary())
+}
+
+func TestNegotiate(t *testing.T) {
+	c, ok := Negotiate([]string{"unknown", NameMsgPack, NameJSON})
+	assert.True(t, ok)
+	assert.Equal(t, NameMsgPack, c.Name())
+
+	c, ok = Negotiate(nil)
+	assert.False(t, ok)
+	assert.Equal(t, NameJSON, c.Name())
+}
+
+func TestMsgPack_UnknownFields(t *testing.T) {
+	w := &msgpackWriter{}
+	w.mapHeader(4)
+	w.str("extra")
+	w.mapHeader(1)
+	w.str("nested")
+	w.arrayHeader(2)
+	w.int(-100000)
+	w.bin([]byte("x"))
+	w.str("message")
+	w.str("hi")
+	w.str("type")
+	w.uint(3)
+	w.str("target_ids")
+	w.buf = append(w.buf, 0xc0)
+
+	message := &engine.Message{}
+	assert.NoError(t, MsgPack.Unmarshal(w.buf, message))
+	assert.Equal(t, &engine.Message{Message: "hi", Type: 3}, message)
+
+	// 伪造的长度
+	assert.Error(t, MsgPack.Unmarshal([]byte{0xdf, 0xff, 0xff, 0xff, 0xff}, message))
+	assert.Error(t, MsgPack.Unmarshal(w.buf[:len(w.buf)-3], message))
+}
+
+func TestMsgPack_Reference(t *testing.T) {
+	// 其他实现常用、本包编码时不会输出的形式：
+	// 定长的 int64/uint64（vmihailenco/msgpack 默认）、raw16 字符串（旧版规范）、array16、map16、bin8
+	data, err := hex.DecodeString("89" +
+		"a26964" + "a26d31" +
+		"a76d657373616765" + "da00026869" +
+		"aa7461726765745f696473" + "dc0001a27532" +
+		"a9736f757263655f6964" + "a27531" +
+		"a474797065" + "d3fffffffffffffffc" +
+		"a3736571" + "cf0000000000000007" +
+		"a962726f616463617374" + "c3" +
+		"a464617461" + "c4020102" +
+		"a768656164657273" + "de0001a16ba176")
+	assert.NoError(t, err)
+
+	message := &engine.Message{}
+	assert.NoError(t, MsgPack.Unmarshal(data, message))
+	assert.Equal(t, &engine.Message{
+		Id:        "m1",
+		Message:   "hi",
+		TargetIds: []string{"u2"},
+		SourceId:  "u1",
+		Type:      -4,
+		Seq:       7,
+		Broadcast: true,
+		Data:      []byte{1, 2},
+		Headers:   map[string]string{"k": "v"},
+	}, message)
+}
+
+func TestMsgPack_Depth(t *testing.T) {
+	nested := func(depth int) []byte {
+		// {"extra": [[[...]]], "message": "hi"}
+		data := append([]byte{0x82, 0xa5}, "extra"...)
+		data = append(data, bytes.Repeat([]byte{0x91}, depth)...)
+		data = append(data, 0xc0, 0xa7)
+		data = append(data, "message"...)
+		return append(data, 0xa2, 'h', 'i')
+	}
+
+	message := &engine.Message{}
+	assert.NoError(t, MsgPack.Unmarshal(nested(maxDepth), message))
+	assert.Equal(t, "hi", message.Message)
+	assert.ErrorIs(t, MsgPack.Unmarshal(nested(maxDepth+1), message), errTooDeep)
+	assert.ErrorIs(t, MsgPack.Unmarshal(nested(1<<20), message), errTooDeep)
+}
+
+func TestProtobuf_UnknownFields(t *testing.T) {
+	var b []byte
+	b = protowire.AppendTag(b, 100, protowire.Fixed64Type)
+	b = protowire.AppendFixed64(b, 1)
+	b = protowire.AppendTag(b, fieldMessage, protowire.BytesType)
+	b = protowire.AppendString(b, "hi")
+	// 类型不匹配的字段忽略
+	b = protowire.AppendTag(b, fieldType, protowire.BytesType)
+	b = protowire.AppendString(b, "3")
+
+	message := &engine.Message{}
+	assert.NoError(t, Protobuf.Unmarshal(b, message))
+	assert.Equal(t, &engine.Message{Message: "hi"}, message)
+
+	assert.Error(t, Protobuf.Unmarshal(b[:len(b)-1], message))
+}
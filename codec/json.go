@@ -0,0 +1,24 @@
+package codec
+
+import (
+	"encoding/json"
+
+	"github.com/WangSiangCun/go-ws/engine"
+)
+
+// JSON 默认编码，使用文本帧，Data 编码为 base64
+var JSON Codec = jsonCodec{}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Name() string { return NameJSON }
+
+func (jsonCodec) Binary() bool { return false }
+
+func (jsonCodec) Marshal(message *engine.Message) ([]byte, error) {
+	return json.Marshal(message)
+}
+
+func (jsonCodec) Unmarshal(data []byte, message *engine.Message) error {
+	return json.Unmarshal(data, message)
+}
@@ -0,0 +1,658 @@
+package codec
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+
+	"github.com/WangSiangCun/go-ws/engine"
+)
+
+// MsgPack MessagePack 编码，使用二进制帧，消息是一个 map，键和 JSON 的字段名一致
+var MsgPack Codec = msgpackCodec{}
+
+var errShortBuffer = errors.New("msgpack: unexpected end of data")
+
+var errTooDeep = errors.New("msgpack: nesting too deep")
+
+// maxDepth 跳过未知字段时最多嵌套的层数，避免伪造的深层嵌套耗尽栈
+const maxDepth = 32
+
+type msgpackCodec struct{}
+
+func (msgpackCodec) Name() string { return NameMsgPack }
+
+func (msgpackCodec) Binary() bool { return true }
+
+func (msgpackCodec) Marshal(m *engine.Message) ([]byte, error) {
+	body := &msgpackWriter{}
+	n := 0
+	field := func(key string) {
+		body.str(key)
+		n++
+	}
+	if m.Version != 0 {
+		field("version")
+		body.int(int64(m.Version))
+	}
+	if m.Id != "" {
+		field("id")
+		body.str(m.Id)
+	}
+	// 和 JSON 一致，这几个字段总是存在
+	field("message")
+	body.str(m.Message)
+	field("target_ids")
+	body.strs(m.TargetIds)
+	field("source_id")
+	body.str(m.SourceId)
+	field("type")
+	body.int(m.Type)
+	if m.Room != "" {
+		field("room")
+		body.str(m.Room)
+	}
+	if m.Broadcast {
+		field("broadcast")
+		body.bool(true)
+	}
+	if len(m.Filters) > 0 {
+		field("filters")
+		body.arrayHeader(len(m.Filters))
+		for _, filter := range m.Filters {
+			size := 2
+			if len(filter.Values) > 0 {
+				size++
+			}
+			body.mapHeader(size)
+			body.str("key")
+			body.str(filter.Key)
+			body.str("op")
+			body.str(filter.Op)
+			if len(filter.Values) > 0 {
+				body.str("values")
+				body.strs(filter.Values)
+			}
+		}
+	}
+	if len(m.ConnIds) > 0 {
+		field("conn_ids")
+		body.strs(m.ConnIds)
+	}
+	if m.Seq != 0 {
+		field("seq")
+		body.uint(m.Seq)
+	}
+	if m.RequestId != "" {
+		field("request_id")
+		body.str(m.RequestId)
+	}
+	if m.Method != "" {
+		field("method")
+		body.str(m.Method)
+	}
+	if m.Error != nil {
+		field("error")
+		body.mapHeader(2)
+		body.str("code")
+		body.int(int64(m.Error.Code))
+		body.str("message")
+		body.str(m.Error.Message)
+	}
+	if m.Timestamp != 0 {
+		field("timestamp")
+		body.int(m.Timestamp)
+	}
+	if len(m.Headers) > 0 {
+		field("headers")
+		body.mapHeader(len(m.Headers))
+		for key, value := range m.Headers {
+			body.str(key)
+			body.str(value)
+		}
+	}
+	if m.ContentType != "" {
+		field("content_type")
+		body.str(m.ContentType)
+	}
+	if len(m.Data) > 0 {
+		field("data")
+		body.bin(m.Data)
+	}
+
+	w := &msgpackWriter{buf: make([]byte, 0, len(body.buf)+5)}
+	w.mapHeader(n)
+	return append(w.buf, body.buf...), nil
+}
+
+func (msgpackCodec) Unmarshal(data []byte, m *engine.Message) error {
+	r := &msgpackReader{data: data}
+	n, err := r.mapHeader()
+	if err != nil {
+		return err
+	}
+	for i := 0; i < n; i++ {
+		key, err := r.string()
+		if err != nil {
+			return err
+		}
+		if err = r.field(key, m); err != nil {
+			return fmt.Errorf("msgpack: %s: %w", key, err)
+		}
+	}
+	return nil
+}
+
+// field 按键名解码一个字段，未知的键跳过
+func (r *msgpackReader) field(key string, m *engine.Message) (err error) {
+	var v uint64
+	switch key {
+	case "version":
+		v, err = r.integer()
+		m.Version = int(int64(v))
+	case "id":
+		m.Id, err = r.string()
+	case "message":
+		m.Message, err = r.string()
+	case "target_ids":
+		m.TargetIds, err = r.strings()
+	case "source_id":
+		m.SourceId, err = r.string()
+	case "type":
+		v, err = r.integer()
+		m.Type = int64(v)
+	case "room":
+		m.Room, err = r.string()
+	case "broadcast":
+		m.Broadcast, err = r.bool()
+	case "filters":
+		m.Filters, err = r.filters()
+	case "conn_ids":
+		m.ConnIds, err = r.strings()
+	case "seq":
+		m.Seq, err = r.integer()
+	case "request_id":
+		m.RequestId, err = r.string()
+	case "method":
+		m.Method, err = r.string()
+	case "error":
+		m.Error, err = r.rpcError()
+	case "timestamp":
+		v, err = r.integer()
+		m.Timestamp = int64(v)
+	case "headers":
+		m.Headers, err = r.stringMap()
+	case "content_type":
+		m.ContentType, err = r.string()
+	case "data":
+		m.Data, err = r.bytes()
+	default:
+		err = r.skip()
+	}
+	return err
+}
+
+func (r *msgpackReader) filters() ([]engine.Filter, error) {
+	n, err := r.arrayHeader()
+	if err != nil || n == 0 {
+		return nil, err
+	}
+	filters := make([]engine.Filter, n)
+	for i := range filters {
+		size, err := r.mapHeader()
+		if err != nil {
+			return nil, err
+		}
+		for j := 0; j < size; j++ {
+			key, err := r.string()
+			if err != nil {
+				return nil, err
+			}
+			switch key {
+			case "key":
+				filters[i].Key, err = r.string()
+			case "op":
+				filters[i].Op, err = r.string()
+			case "values":
+				filters[i].Values, err = r.strings()
+			default:
+				err = r.skip()
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return filters, nil
+}
+
+func (r *msgpackReader) rpcError() (*engine.RPCError, error) {
+	if r.nil() {
+		return nil, nil
+	}
+	size, err := r.mapHeader()
+	if err != nil {
+		return nil, err
+	}
+	rpcError := &engine.RPCError{}
+	for i := 0; i < size; i++ {
+		key, err := r.string()
+		if err != nil {
+			return nil, err
+		}
+		switch key {
+		case "code":
+			var code uint64
+			code, err = r.integer()
+			rpcError.Code = int(int64(code))
+		case "message":
+			rpcError.Message, err = r.string()
+		default:
+			err = r.skip()
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return rpcError, nil
+}
+
+func (r *msgpackReader) stringMap() (map[string]string, error) {
+	n, err := r.mapHeader()
+	if err != nil || n == 0 {
+		return nil, err
+	}
+	values := make(map[string]string, n)
+	for i := 0; i < n; i++ {
+		key, err := r.string()
+		if err != nil {
+			return nil, err
+		}
+		if values[key], err = r.string(); err != nil {
+			return nil, err
+		}
+	}
+	return values, nil
+}
+
+func (r *msgpackReader) strings() ([]string, error) {
+	n, err := r.arrayHeader()
+	if err != nil || n == 0 {
+		return nil, err
+	}
+	values := make([]string, n)
+	for i := range values {
+		if values[i], err = r.string(); err != nil {
+			return nil, err
+		}
+	}
+	return values, nil
+}
+
+// msgpackWriter 只实现消息用到的类型
+type msgpackWriter struct {
+	buf []byte
+}
+
+func (w *msgpackWriter) header(fix byte, fixMax int, code8, code16, code32 byte, n int) {
+	switch {
+	case n <= fixMax:
+		w.buf = append(w.buf, fix|byte(n))
+	case code8 != 0 && n <= math.MaxUint8:
+		w.buf = append(w.buf, code8, byte(n))
+	case n <= math.MaxUint16:
+		w.buf = binary.BigEndian.AppendUint16(append(w.buf, code16), uint16(n))
+	default:
+		w.buf = binary.BigEndian.AppendUint32(append(w.buf, code32), uint32(n))
+	}
+}
+
+func (w *msgpackWriter) mapHeader(n int) { w.header(0x80, 15, 0, 0xde, 0xdf, n) }
+
+func (w *msgpackWriter) arrayHeader(n int) { w.header(0x90, 15, 0, 0xdc, 0xdd, n) }
+
+func (w *msgpackWriter) str(s string) {
+	w.header(0xa0, 31, 0xd9, 0xda, 0xdb, len(s))
+	w.buf = append(w.buf, s...)
+}
+
+func (w *msgpackWriter) strs(values []string) {
+	if values == nil {
+		w.buf = append(w.buf, 0xc0)
+		return
+	}
+	w.arrayHeader(len(values))
+	for _, value := range values {
+		w.str(value)
+	}
+}
+
+func (w *msgpackWriter) bin(b []byte) {
+	// bin 没有 fix 格式，fixMax 为 -1
+	w.header(0, -1, 0xc4, 0xc5, 0xc6, len(b))
+	w.buf = append(w.buf, b...)
+}
+
+func (w *msgpackWriter) bool(v bool) {
+	if v {
+		w.buf = append(w.buf, 0xc3)
+	} else {
+		w.buf = append(w.buf, 0xc2)
+	}
+}
+
+func (w *msgpackWriter) int(v int64) {
+	switch {
+	case v >= 0:
+		w.uint(uint64(v))
+	case v >= -32:
+		w.buf = append(w.buf, byte(v))
+	case v >= math.MinInt8:
+		w.buf = append(w.buf, 0xd0, byte(v))
+	case v >= math.MinInt16:
+		w.buf = binary.BigEndian.AppendUint16(append(w.buf, 0xd1), uint16(v))
+	case v >= math.MinInt32:
+		w.buf = binary.BigEndian.AppendUint32(append(w.buf, 0xd2), uint32(v))
+	default:
+		w.buf = binary.BigEndian.AppendUint64(append(w.buf, 0xd3), uint64(v))
+	}
+}
+
+func (w *msgpackWriter) uint(v uint64) {
+	switch {
+	case v <= 0x7f:
+		w.buf = append(w.buf, byte(v))
+	case v <= math.MaxUint8:
+		w.buf = append(w.buf, 0xcc, byte(v))
+	case v <= math.MaxUint16:
+		w.buf = binary.BigEndian.AppendUint16(append(w.buf, 0xcd), uint16(v))
+	case v <= math.MaxUint32:
+		w.buf = binary.BigEndian.AppendUint32(append(w.buf, 0xce), uint32(v))
+	default:
+		w.buf = binary.BigEndian.AppendUint64(append(w.buf, 0xcf), v)
+	}
+}
+
+// integerSizes uint8~uint64 和 int8~int64 的字节数
+var integerSizes = map[byte]int{0xcc: 1, 0xcd: 2, 0xce: 4, 0xcf: 8, 0xd0: 1, 0xd1: 2, 0xd2: 4, 0xd3: 8}
+
+// msgpackReader 读取消息，nil 当作对应类型的零值
+type msgpackReader struct {
+	data []byte
+	pos  int
+}
+
+func (r *msgpackReader) next(n int) ([]byte, error) {
+	if n < 0 || len(r.data)-r.pos < n {
+		return nil, errShortBuffer
+	}
+	b := r.data[r.pos : r.pos+n]
+	r.pos += n
+	return b, nil
+}
+
+func (r *msgpackReader) byte() (byte, error) {
+	b, err := r.next(1)
+	if err != nil {
+		return 0, err
+	}
+	return b[0], nil
+}
+
+// nil 下一个值是 nil 时读取并返回 true
+func (r *msgpackReader) nil() bool {
+	if r.pos < len(r.data) && r.data[r.pos] == 0xc0 {
+		r.pos++
+		return true
+	}
+	return false
+}
+
+// length 读取 1、2、4 字节的大端长度
+func (r *msgpackReader) length(size int) (int, error) {
+	b, err := r.next(size)
+	if err != nil {
+		return 0, err
+	}
+	switch size {
+	case 1:
+		return int(b[0]), nil
+	case 2:
+		return int(binary.BigEndian.Uint16(b)), nil
+	default:
+		return int(binary.BigEndian.Uint32(b)), nil
+	}
+}
+
+// count 读取 map 或数组的元素个数，每个元素至少占一个字节，超过剩余长度时报错，避免按伪造的长度分配内存
+func (r *msgpackReader) count(size int) (int, error) {
+	n, err := r.length(size)
+	if err == nil && n > len(r.data)-r.pos {
+		return 0, errShortBuffer
+	}
+	return n, err
+}
+
+func (r *msgpackReader) mapHeader() (int, error) {
+	if r.nil() {
+		return 0, nil
+	}
+	code, err := r.byte()
+	if err != nil {
+		return 0, err
+	}
+	switch {
+	case code&0xf0 == 0x80:
+		return int(code & 0x0f), nil
+	case code == 0xde:
+		return r.count(2)
+	case code == 0xdf:
+		return r.count(4)
+	}
+	return 0, fmt.Errorf("msgpack: expected map, got 0x%02x", code)
+}
+
+func (r *msgpackReader) arrayHeader() (int, error) {
+	if r.nil() {
+		return 0, nil
+	}
+	code, err := r.byte()
+	if err != nil {
+		return 0, err
+	}
+	switch {
+	case code&0xf0 == 0x90:
+		return int(code & 0x0f), nil
+	case code == 0xdc:
+		return r.count(2)
+	case code == 0xdd:
+		return r.count(4)
+	}
+	return 0, fmt.Errorf("msgpack: expected array, got 0x%02x", code)
+}
+
+// bytes 读取 bin 或 str
+func (r *msgpackReader) bytes() ([]byte, error) {
+	if r.nil() {
+		return nil, nil
+	}
+	code, err := r.byte()
+	if err != nil {
+		return nil, err
+	}
+	var n int
+	switch {
+	case code&0xe0 == 0xa0:
+		n = int(code & 0x1f)
+	case code == 0xd9 || code == 0xc4:
+		n, err = r.length(1)
+	case code == 0xda || code == 0xc5:
+		n, err = r.length(2)
+	case code == 0xdb || code == 0xc6:
+		n, err = r.length(4)
+	default:
+		return nil, fmt.Errorf("msgpack: expected str or bin, got 0x%02x", code)
+	}
+	if err != nil {
+		return nil, err
+	}
+	b, err := r.next(n)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(nil), b...), nil
+}
+
+func (r *msgpackReader) string() (string, error) {
+	b, err := r.bytes()
+	return string(b), err
+}
+
+func (r *msgpackReader) bool() (bool, error) {
+	if r.nil() {
+		return false, nil
+	}
+	code, err := r.byte()
+	if err != nil {
+		return false, err
+	}
+	switch code {
+	case 0xc2:
+		return false, nil
+	case 0xc3:
+		return true, nil
+	}
+	return false, fmt.Errorf("msgpack: expected bool, got 0x%02x", code)
+}
+
+// integer 读取任意整数格式，负数按补码返回
+func (r *msgpackReader) integer() (uint64, error) {
+	if r.nil() {
+		return 0, nil
+	}
+	code, err := r.byte()
+	if err != nil {
+		return 0, err
+	}
+	switch {
+	case code <= 0x7f:
+		return uint64(code), nil
+	case code >= 0xe0:
+		return uint64(int64(int8(code))), nil
+	}
+	size, ok := integerSizes[code]
+	if !ok {
+		return 0, fmt.Errorf("msgpack: expected integer, got 0x%02x", code)
+	}
+	b, err := r.next(size)
+	if err != nil {
+		return 0, err
+	}
+	signed := code >= 0xd0
+	switch size {
+	case 1:
+		if signed {
+			return uint64(int64(int8(b[0]))), nil
+		}
+		return uint64(b[0]), nil
+	case 2:
+		if signed {
+			return uint64(int64(int16(binary.BigEndian.Uint16(b)))), nil
+		}
+		return uint64(binary.BigEndian.Uint16(b)), nil
+	case 4:
+		if signed {
+			return uint64(int64(int32(binary.BigEndian.Uint32(b)))), nil
+		}
+		return uint64(binary.BigEndian.Uint32(b)), nil
+	default:
+		return binary.BigEndian.Uint64(b), nil
+	}
+}
+
+// skip 跳过一个任意类型的值
+func (r *msgpackReader) skip() error {
+	return r.skipDepth(0)
+}
+
+func (r *msgpackReader) skipDepth(depth int) error {
+	if depth > maxDepth {
+		return errTooDeep
+	}
+	code, err := r.byte()
+	if err != nil {
+		return err
+	}
+	// 定长类型直接跳过的字节数
+	var n int
+	// 之后还有 items 个值要跳过
+	var items int
+	switch {
+	case code <= 0x7f, code >= 0xe0, code == 0xc0, code == 0xc2, code == 0xc3:
+	case code&0xf0 == 0x80:
+		items = 2 * int(code&0x0f)
+	case code&0xf0 == 0x90:
+		items = int(code & 0x0f)
+	case code&0xe0 == 0xa0:
+		n = int(code & 0x1f)
+	case code == 0xcc, code == 0xd0:
+		n = 1
+	case code == 0xcd, code == 0xd1:
+		n = 2
+	case code == 0xce, code == 0xd2, code == 0xca:
+		n = 4
+	case code == 0xcf, code == 0xd3, code == 0xcb:
+		n = 8
+	case code == 0xd4:
+		n = 2
+	case code == 0xd5:
+		n = 3
+	case code == 0xd6:
+		n = 5
+	case code == 0xd7:
+		n = 9
+	case code == 0xd8:
+		n = 17
+	case code == 0xc4, code == 0xd9:
+		n, err = r.length(1)
+	case code == 0xc5, code == 0xda:
+		n, err = r.length(2)
+	case code == 0xc6, code == 0xdb:
+		n, err = r.length(4)
+	case code == 0xc7:
+		// ext 8/16/32 多一个字节的类型
+		n, err = r.length(1)
+		n++
+	case code == 0xc8:
+		n, err = r.length(2)
+		n++
+	case code == 0xc9:
+		n, err = r.length(4)
+		n++
+	case code == 0xdc:
+		items, err = r.length(2)
+	case code == 0xdd:
+		items, err = r.length(4)
+	case code == 0xde:
+		items, err = r.length(2)
+		items *= 2
+	case code == 0xdf:
+		items, err = r.length(4)
+		items *= 2
+	default:
+		return fmt.Errorf("msgpack: unknown type 0x%02x", code)
+	}
+	if err != nil {
+		return err
+	}
+	if _, err = r.next(n); err != nil {
+		return err
+	}
+	for i := 0; i < items; i++ {
+		if err = r.skipDepth(depth + 1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
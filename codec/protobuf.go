@@ -0,0 +1,252 @@
+package codec
+
+import (
+	"fmt"
+
+	"github.com/WangSiangCun/go-ws/engine"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// Protobuf Protocol Buffers 编码，使用二进制帧，客户端按 message.proto 生成代码
+var Protobuf Codec = protobufCodec{}
+
+// message.proto 中 Message 的字段编号
+const (
+	fieldVersion     protowire.Number = 1
+	fieldId          protowire.Number = 2
+	fieldMessage     protowire.Number = 3
+	fieldTargetIds   protowire.Number = 4
+	fieldSourceId    protowire.Number = 5
+	fieldType        protowire.Number = 6
+	fieldRoom        protowire.Number = 7
+	fieldBroadcast   protowire.Number = 8
+	fieldFilters     protowire.Number = 9
+	fieldConnIds     protowire.Number = 10
+	fieldSeq         protowire.Number = 11
+	fieldRequestId   protowire.Number = 12
+	fieldMethod      protowire.Number = 13
+	fieldError       protowire.Number = 14
+	fieldTimestamp   protowire.Number = 15
+	fieldHeaders     protowire.Number = 16
+	fieldContentType protowire.Number = 17
+	fieldData        protowire.Number = 18
+)
+
+type protobufCodec struct{}
+
+func (protobufCodec) Name() string { return NameProtobuf }
+
+func (protobufCodec) Binary() bool { return true }
+
+func (protobufCodec) Marshal(m *engine.Message) ([]byte, error) {
+	var b []byte
+	b = appendVarint(b, fieldVersion, uint64(int64(m.Version)))
+	b = appendString(b, fieldId, m.Id)
+	b = appendString(b, fieldMessage, m.Message)
+	for _, targetId := range m.TargetIds {
+		b = appendBytes(b, fieldTargetIds, []byte(targetId))
+	}
+	b = appendString(b, fieldSourceId, m.SourceId)
+	b = appendVarint(b, fieldType, uint64(m.Type))
+	b = appendString(b, fieldRoom, m.Room)
+	b = appendVarint(b, fieldBroadcast, protowire.EncodeBool(m.Broadcast))
+	for _, filter := range m.Filters {
+		var f []byte
+		f = appendString(f, 1, filter.Key)
+		f = appendString(f, 2, filter.Op)
+		for _, value := range filter.Values {
+			f = appendBytes(f, 3, []byte(value))
+		}
+		b = appendBytes(b, fieldFilters, f)
+	}
+	for _, connId := range m.ConnIds {
+		b = appendBytes(b, fieldConnIds, []byte(connId))
+	}
+	b = appendVarint(b, fieldSeq, m.Seq)
+	b = appendString(b, fieldRequestId, m.RequestId)
+	b = appendString(b, fieldMethod, m.Method)
+	if m.Error != nil {
+		var e []byte
+		e = appendVarint(e, 1, uint64(int64(m.Error.Code)))
+		e = appendString(e, 2, m.Error.Message)
+		b = appendBytes(b, fieldError, e)
+	}
+	b = appendVarint(b, fieldTimestamp, uint64(m.Timestamp))
+	for key, value := range m.Headers {
+		// map<string, string> 的每一项是一个 key = 1、value = 2 的消息
+		var entry []byte
+		entry = appendString(entry, 1, key)
+		entry = appendString(entry, 2, value)
+		b = appendBytes(b, fieldHeaders, entry)
+	}
+	b = appendString(b, fieldContentType, m.ContentType)
+	if len(m.Data) > 0 {
+		b = appendBytes(b, fieldData, m.Data)
+	}
+	return b, nil
+}
+
+func (protobufCodec) Unmarshal(data []byte, m *engine.Message) error {
+	return consumeFields(data, func(num protowire.Number, typ protowire.Type, value []byte, v uint64) error {
+		switch {
+		case num == fieldVersion && typ == protowire.VarintType:
+			m.Version = int(int64(v))
+		case num == fieldId && typ == protowire.BytesType:
+			m.Id = string(value)
+		case num == fieldMessage && typ == protowire.BytesType:
+			m.Message = string(value)
+		case num == fieldTargetIds && typ == protowire.BytesType:
+			m.TargetIds = append(m.TargetIds, string(value))
+		case num == fieldSourceId && typ == protowire.BytesType:
+			m.SourceId = string(value)
+		case num == fieldType && typ == protowire.VarintType:
+			m.Type = int64(v)
+		case num == fieldRoom && typ == protowire.BytesType:
+			m.Room = string(value)
+		case num == fieldBroadcast && typ == protowire.VarintType:
+			m.Broadcast = protowire.DecodeBool(v)
+		case num == fieldFilters && typ == protowire.BytesType:
+			filter, err := unmarshalFilter(value)
+			if err != nil {
+				return err
+			}
+			m.Filters = append(m.Filters, filter)
+		case num == fieldConnIds && typ == protowire.BytesType:
+			m.ConnIds = append(m.ConnIds, string(value))
+		case num == fieldSeq && typ == protowire.VarintType:
+			m.Seq = v
+		case num == fieldRequestId && typ == protowire.BytesType:
+			m.RequestId = string(value)
+		case num == fieldMethod && typ == protowire.BytesType:
+			m.Method = string(value)
+		case num == fieldError && typ == protowire.BytesType:
+			rpcError, err := unmarshalRPCError(value)
+			if err != nil {
+				return err
+			}
+			m.Error = rpcError
+		case num == fieldTimestamp && typ == protowire.VarintType:
+			m.Timestamp = int64(v)
+		case num == fieldHeaders && typ == protowire.BytesType:
+			if m.Headers == nil {
+				m.Headers = map[string]string{}
+			}
+			return unmarshalHeader(value, m.Headers)
+		case num == fieldContentType && typ == protowire.BytesType:
+			m.ContentType = string(value)
+		case num == fieldData && typ == protowire.BytesType:
+			m.Data = append([]byte(nil), value...)
+		}
+		// 未知字段和类型不匹配的字段忽略，和 proto3 一致
+		return nil
+	})
+}
+
+func unmarshalFilter(data []byte) (engine.Filter, error) {
+	filter := engine.Filter{}
+	err := consumeFields(data, func(num protowire.Number, typ protowire.Type, value []byte, _ uint64) error {
+		if typ != protowire.BytesType {
+			return nil
+		}
+		switch num {
+		case 1:
+			filter.Key = string(value)
+		case 2:
+			filter.Op = string(value)
+		case 3:
+			filter.Values = append(filter.Values, string(value))
+		}
+		return nil
+	})
+	return filter, err
+}
+
+func unmarshalRPCError(data []byte) (*engine.RPCError, error) {
+	rpcError := &engine.RPCError{}
+	err := consumeFields(data, func(num protowire.Number, typ protowire.Type, value []byte, v uint64) error {
+		switch {
+		case num == 1 && typ == protowire.VarintType:
+			rpcError.Code = int(int64(v))
+		case num == 2 && typ == protowire.BytesType:
+			rpcError.Message = string(value)
+		}
+		return nil
+	})
+	return rpcError, err
+}
+
+func unmarshalHeader(data []byte, headers map[string]string) error {
+	var key, value string
+	err := consumeFields(data, func(num protowire.Number, typ protowire.Type, b []byte, _ uint64) error {
+		if typ != protowire.BytesType {
+			return nil
+		}
+		switch num {
+		case 1:
+			key = string(b)
+		case 2:
+			value = string(b)
+		}
+		return nil
+	})
+	if err == nil {
+		headers[key] = value
+	}
+	return err
+}
+
+// consumeFields 依次读取 data 中的字段，varint 字段的值为 v，bytes 字段的值为 value，其他类型跳过
+func consumeFields(data []byte, fn func(num protowire.Number, typ protowire.Type, value []byte, v uint64) error) error {
+	for len(data) > 0 {
+		num, typ, n := protowire.ConsumeTag(data)
+		if n < 0 {
+			return fmt.Errorf("protobuf: %w", protowire.ParseError(n))
+		}
+		data = data[n:]
+		var value []byte
+		var v uint64
+		switch typ {
+		case protowire.VarintType:
+			v, n = protowire.ConsumeVarint(data)
+		case protowire.BytesType:
+			value, n = protowire.ConsumeBytes(data)
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, data)
+		}
+		if n < 0 {
+			return fmt.Errorf("protobuf: field %d: %w", num, protowire.ParseError(n))
+		}
+		data = data[n:]
+		if typ != protowire.VarintType && typ != protowire.BytesType {
+			continue
+		}
+		if err := fn(num, typ, value, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// appendVarint 零值不写，和 proto3 一致
+func appendVarint(b []byte, num protowire.Number, v uint64) []byte {
+	if v == 0 {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.VarintType)
+	return protowire.AppendVarint(b, v)
+}
+
+// appendString 空字符串不写，和 proto3 一致
+func appendString(b []byte, num protowire.Number, s string) []byte {
+	if s == "" {
+		return b
+	}
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendString(b, s)
+}
+
+// appendBytes 用于 repeated 和嵌套消息，空值也要写
+func appendBytes(b []byte, num protowire.Number, value []byte) []byte {
+	b = protowire.AppendTag(b, num, protowire.BytesType)
+	return protowire.AppendBytes(b, value)
+}
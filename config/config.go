@@ -1,26 +1,198 @@
 package config
 
+import "fmt"
+
+const (
+	// ModeCluster 集群模式，使用 etcd 记录在线状态，RabbitMQ 在节点间转发消息
+	ModeCluster = "cluster"
+	// ModeStandalone 单机模式，不依赖 etcd 和 RabbitMQ，消息只在本进程内路由
+	ModeStandalone = "standalone"
+)
+
+// 同一个用户多个设备在线时的投递策略
+const (
+	// DevicePolicyAll 投递给用户的所有设备
+	DevicePolicyAll = "all"
+	// DevicePolicyLatest 只投递给用户最近连接的设备
+	DevicePolicyLatest = "latest"
+	// DevicePolicyKickOld 新设备连接时踢掉用户的其他设备
+	DevicePolicyKickOld = "kick-old"
+)
+
+// 离线消息保存方式
+const (
+	// OfflineNone 不保存离线消息
+	OfflineNone = "none"
+	// OfflineMemory 保存在进程内，重启后丢失
+	OfflineMemory = "memory"
+	// OfflineFile 保存在 Offline.Dir 目录
+	OfflineFile = "file"
+)
+
+// 写给客户端的方式，二进制编码的连接总是每条消息一帧
+const (
+	// WriteFrame 每条消息单独一帧
+	WriteFrame = "frame"
+	// WriteArray 多条消息合并成一个 JSON 数组，只有一条时也是数组
+	WriteArray = "array"
+	// WriteNewline 多条消息用换行拼在一帧里，旧版本的行为
+	WriteNewline = "newline"
+)
+
+// JWT 连接时的 token 验证，AccessSecret、PublicKeys、JWKS 至少设置一个
 type JWT struct {
-	AccessSecret string
-	AccessExpire int64
+	// AccessSecret HMAC（HS256/HS384/HS512）密钥
+	AccessSecret string `json:",optional"`
+	AccessExpire int64  `json:",optional"`
+	// PublicKeys PEM 格式的 RSA、EC 或者 Ed25519 公钥文件，文件名去掉扩展名作为 kid
+	PublicKeys []string `json:",optional"`
+	// JWKS JWKS 文件路径或者 http(s) 地址
+	JWKS string `json:",optional"`
+	// RefreshInterval 后台重新加载 PublicKeys 和 JWKS 的间隔，秒，为 0 时只在遇到不认识的 kid 时加载
+	RefreshInterval int64 `json:",default=300,range=[0:]"`
+	// Issuer 不为空时 iss 必须一致
+	Issuer string `json:",optional"`
+	// Audience 不为空时 aud 必须包含
+	Audience string `json:",optional"`
+	// Leeway 检查 exp、nbf、iat 时允许的时钟误差，秒
+	Leeway int64 `json:",default=0,range=[0:]"`
 }
 type Etcd struct {
 	Hosts []string
 }
 type RabbitMQ struct {
-	Hosts    []string
+	Hosts    []string `json:",optional"`
 	MQUrl    string
-	Exchange string
+	Exchange string `json:",optional"`
+}
+
+// Offline 用户不在线时保存消息，重新上线后投递
+type Offline struct {
+	Store string `json:",default=memory,options=none|memory|file"`
+	Dir   string `json:",default=data/offline"`
+	// TTL 保存时间，秒
+	TTL int64 `json:",default=604800"`
+	// MaxMessages 每个用户最多保存的条数
+	MaxMessages int `json:",default=1000"`
+	// MaxBytes 每个用户最多保存的字节数
+	MaxBytes int `json:",default=1048576"`
+}
+
+// DefaultOffline 默认的离线消息配置，和配置文件中不写 Offline 时一致
+func DefaultOffline() Offline {
+	return Offline{
+		Store:       OfflineMemory,
+		Dir:         "data/offline",
+		TTL:         7 * 24 * 3600,
+		MaxMessages: 1000,
+		MaxBytes:    1 << 20,
+	}
+}
+
+// Sequence 为每个用户收到的消息分配递增序号，断线重连后按序号补发
+type Sequence struct {
+	Enabled bool `json:",default=false"`
+	// History 每个用户保存的历史消息条数，重连时只能补发这个范围内的消息
+	History int `json:",default=1000"`
+}
+
+// Write 写给客户端的方式，array 和 newline 会把队列中的多条消息合并成一帧
+type Write struct {
+	Strategy string `json:",default=frame,options=frame|array|newline"`
+	// FlushInterval 合并时等待后续消息的时间，毫秒，0 表示只合并已经在队列中的消息
+	FlushInterval int64 `json:",default=0"`
+	// MaxBatch 一帧最多合并的消息数
+	MaxBatch int `json:",default=64"`
 }
+
+// DefaultWrite 默认每条消息单独一帧
+func DefaultWrite() Write {
+	return Write{Strategy: WriteFrame, MaxBatch: 64}
+}
+
+// Compression permessage-deflate 压缩，客户端支持时才会对这个连接启用
+type Compression struct {
+	Enabled bool `json:",default=false"`
+	// Level 压缩级别，1 最快，9 压缩率最高，见 compress/flate
+	Level int `json:",default=1,range=[-2:9]"`
+	// Threshold 小于这个字节数的帧不压缩
+	Threshold int `json:",default=512"`
+}
+
+// DefaultCompression 默认不压缩
+func DefaultCompression() Compression {
+	return Compression{Level: 1, Threshold: 512}
+}
+
 type Config struct {
-	Etcd     Etcd
-	RabbitMQ RabbitMQ
+	Mode     string   `json:",default=cluster,options=cluster|standalone"`
+	Etcd     Etcd     `json:",optional"`
+	RabbitMQ RabbitMQ `json:",optional"`
 	Host     string
 	WSPort   string
+	// PongTime 在线状态的租约时间，秒
 	PongTime int64
-	JWT      JWT
+	JWT      JWT `json:",optional"`
+	// DevicePolicy 多设备投递策略
+	DevicePolicy string `json:",default=all,options=all|latest|kick-old"`
+	// ClientBroadcast 是否允许客户端发送广播消息，默认只有服务端可以通过 Hub.Broadcast 广播
+	ClientBroadcast bool `json:",default=false"`
+	// Offline 离线消息
+	Offline Offline
+	// Sequence 消息序号和断线续传
+	Sequence Sequence
+	// Write 写给客户端的方式
+	Write Write
+	// Compression 写给客户端的消息压缩
+	Compression Compression
+	// Connection 客户端连接的参数
+	Connection Connection
+	// BrokerCodec 节点间转发消息的编码，所有节点必须一致，为空时使用 json
+	BrokerCodec string `json:",default=json,options=json|msgpack|protobuf"`
 }
 
 func NewConfig(etcdHost []string, mqUrl string, host string, post string, pongTime int64) *Config {
-	return &Config{Etcd{Hosts: etcdHost}, RabbitMQ{MQUrl: mqUrl}, host, post, pongTime, JWT{}}
+	return &Config{
+		Mode:         ModeCluster,
+		Etcd:         Etcd{Hosts: etcdHost},
+		RabbitMQ:     RabbitMQ{MQUrl: mqUrl},
+		Host:         host,
+		WSPort:       post,
+		PongTime:     pongTime,
+		DevicePolicy: DevicePolicyAll,
+		Offline:      DefaultOffline(),
+		Sequence:     Sequence{History: 1000},
+		Write:        DefaultWrite(),
+		Compression:  DefaultCompression(),
+		Connection:   DefaultConnection(),
+	}
+}
+
+// NewStandaloneConfig 单机模式配置
+func NewStandaloneConfig(host string, post string, pongTime int64) *Config {
+	return &Config{
+		Mode:         ModeStandalone,
+		Host:         host,
+		WSPort:       post,
+		PongTime:     pongTime,
+		DevicePolicy: DevicePolicyAll,
+		Offline:      DefaultOffline(),
+		Sequence:     Sequence{History: 1000},
+		Write:        DefaultWrite(),
+		Compression:  DefaultCompression(),
+		Connection:   DefaultConnection(),
+	}
+}
+
+// Validate 加载配置后由 conf 调用，检查标签无法表达的约束
+func (c Config) Validate() error {
+	if err := c.Connection.Validate(); err != nil {
+		return fmt.Errorf("Connection: %w", err)
+	}
+	return nil
+}
+
+// IsStandalone 是否单机模式
+func (c *Config) IsStandalone() bool {
+	return c.Mode == ModeStandalone
 }
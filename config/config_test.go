@@ -0,0 +1,73 @@
+package config
+
+import (
+	"testing"
+
+	"github.com/WangSiangCun/go-ws/core/conf"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConfig_Defaults(t *testing.T) {
+	var c Config
+	assert.NoError(t, conf.LoadFromYamlBytes([]byte("Host: 0.0.0.0\nWSPort: :4444\nPongTime: 10\n"), &c))
+	assert.Equal(t, DefaultConnection(), c.Connection)
+	assert.Equal(t, DefaultOffline(), c.Offline)
+	assert.Equal(t, DefaultWrite(), c.Write)
+	assert.Equal(t, DefaultCompression(), c.Compression)
+	assert.Equal(t, c.Connection, NewStandaloneConfig("0.0.0.0", ":4444", 10).Connection)
+}
+
+func TestConnection_ForRoute(t *testing.T) {
+	var c Config
+	yaml := `
+Host: 0.0.0.0
+WSPort: :4444
+PongTime: 10
+Connection:
+  MaxMessageSize: 1048576
+  Routes:
+    /ws/mobile:
+      PongWait: 300
+      PingPeriod: 240
+      Overflow: drop-oldest
+`
+	assert.NoError(t, conf.LoadFromYamlBytes([]byte(yaml), &c))
+
+	web := c.Connection.ForRoute("/ws")
+	assert.Equal(t, int64(60), web.PongWait)
+	assert.Equal(t, int64(1<<20), web.MaxMessageSize)
+	assert.Nil(t, web.Routes)
+
+	mobile := c.Connection.ForRoute("/ws/mobile")
+	assert.Equal(t, int64(300), mobile.PongWait)
+	assert.Equal(t, int64(240), mobile.PingPeriod)
+	// 没有覆盖的字段沿用 Connection
+	assert.Equal(t, int64(1<<20), mobile.MaxMessageSize)
+	assert.Equal(t, int64(10), mobile.WriteWait)
+	assert.Equal(t, OverflowDropOldest, mobile.Overflow)
+	assert.Equal(t, OverflowBlock, web.Overflow)
+}
+
+func TestConnection_Validate(t *testing.T) {
+	var c Config
+	yaml := `
+Host: 0.0.0.0
+WSPort: :4444
+PongTime: 10
+Connection:
+  Routes:
+    /ws/mobile:
+      PingPeriod: 120
+`
+	err := conf.LoadFromYamlBytes([]byte(yaml), &c)
+	assert.ErrorContains(t, err, "route /ws/mobile: PingPeriod 120 must be less than PongWait 60")
+
+	err = conf.LoadFromYamlBytes([]byte("Host: a\nWSPort: b\nPongTime: 1\nConnection:\n  MaxMessageSize: 0\n"), &c)
+	assert.Error(t, err)
+
+	assert.NoError(t, DefaultConnection().Validate())
+	assert.Error(t, Connection{}.Validate())
+	unknown := DefaultConnection()
+	unknown.Routes = map[string]ConnectionOverride{"/ws": {Overflow: "drop"}}
+	assert.ErrorContains(t, unknown.Validate(), `route /ws: unknown Overflow "drop"`)
+}
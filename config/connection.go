@@ -0,0 +1,150 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// 消息队列满时的处理方式
+const (
+	// OverflowBlock 等待 OverflowTimeout，还是满的就断开
+	OverflowBlock = "block"
+	// OverflowDropOldest 丢弃队列中最早的消息
+	OverflowDropOldest = "drop-oldest"
+	// OverflowDropNewest 丢弃新消息
+	OverflowDropNewest = "drop-newest"
+	// OverflowDisconnect 以 1008 断开连接
+	OverflowDisconnect = "disconnect"
+)
+
+// Connection 客户端连接的参数，时间单位为秒
+type Connection struct {
+	// WriteWait 写一帧的超时时间
+	WriteWait int64 `json:",default=10,range=[1:]"`
+	// PongWait 超过这个时间没有收到 pong 就断开
+	PongWait int64 `json:",default=60,range=[1:]"`
+	// PingPeriod 发送 ping 的间隔，必须小于 PongWait，为 0 时取 PongWait 的 9/10
+	PingPeriod int64 `json:",default=0,range=[0:]"`
+	// MaxMessageSize 客户端发来的一条消息最大字节数
+	MaxMessageSize int64 `json:",default=65536,range=[1:]"`
+	// SendBuffer 每个连接待发送和待处理的消息队列长度
+	SendBuffer int `json:",default=2048,range=[1:]"`
+	// ReadBufferSize WebSocket 读缓冲区字节数
+	ReadBufferSize int `json:",default=1024,range=[1:]"`
+	// WriteBufferSize WebSocket 写缓冲区字节数
+	WriteBufferSize int `json:",default=1024,range=[1:]"`
+	// Overflow SendBuffer 满时的处理方式
+	Overflow string `json:",default=block,options=block|drop-oldest|drop-newest|disconnect"`
+	// OverflowTimeout Overflow 为 block 时最多等待的时间
+	OverflowTimeout int64 `json:",default=5,range=[1:]"`
+	// ExpiryWarning 认证的凭证过期前多久发送 engine.TypeTokenExpiring
+	ExpiryWarning int64 `json:",default=60,range=[0:]"`
+	// Routes 按 URL 路径覆盖上面的参数，比如心跳间隔更长的移动端
+	Routes map[string]ConnectionOverride `json:",optional"`
+}
+
+// ConnectionOverride 覆盖 Connection 的参数，为 0 或空的字段沿用 Connection
+type ConnectionOverride struct {
+	WriteWait       int64  `json:",optional,range=[0:]"`
+	PongWait        int64  `json:",optional,range=[0:]"`
+	PingPeriod      int64  `json:",optional,range=[0:]"`
+	MaxMessageSize  int64  `json:",optional,range=[0:]"`
+	SendBuffer      int    `json:",optional,range=[0:]"`
+	ReadBufferSize  int    `json:",optional,range=[0:]"`
+	WriteBufferSize int    `json:",optional,range=[0:]"`
+	Overflow        string `json:",optional"`
+	OverflowTimeout int64  `json:",optional,range=[0:]"`
+	ExpiryWarning   int64  `json:",optional,range=[0:]"`
+}
+
+// DefaultConnection 默认的连接参数，和配置文件中不写 Connection 时一致
+func DefaultConnection() Connection {
+	return Connection{
+		WriteWait:       10,
+		PongWait:        60,
+		MaxMessageSize:  64 << 10,
+		SendBuffer:      2048,
+		ReadBufferSize:  1024,
+		WriteBufferSize: 1024,
+		Overflow:        OverflowBlock,
+		OverflowTimeout: 5,
+		ExpiryWarning:   60,
+	}
+}
+
+// ForRoute 返回 path 使用的参数，没有覆盖时和 c 一致，返回值的 Routes 为空
+func (c Connection) ForRoute(path string) Connection {
+	resolved := c
+	resolved.Routes = nil
+	override, ok := c.Routes[path]
+	if !ok {
+		return resolved
+	}
+	overrideInt64(&resolved.WriteWait, override.WriteWait)
+	overrideInt64(&resolved.PongWait, override.PongWait)
+	overrideInt64(&resolved.PingPeriod, override.PingPeriod)
+	overrideInt64(&resolved.MaxMessageSize, override.MaxMessageSize)
+	overrideInt(&resolved.SendBuffer, override.SendBuffer)
+	overrideInt(&resolved.ReadBufferSize, override.ReadBufferSize)
+	overrideInt(&resolved.WriteBufferSize, override.WriteBufferSize)
+	if override.Overflow != "" {
+		resolved.Overflow = override.Overflow
+	}
+	overrideInt64(&resolved.OverflowTimeout, override.OverflowTimeout)
+	overrideInt64(&resolved.ExpiryWarning, override.ExpiryWarning)
+	return resolved
+}
+
+func overrideInt64(value *int64, override int64) {
+	if override > 0 {
+		*value = override
+	}
+}
+
+func overrideInt(value *int, override int) {
+	if override > 0 {
+		*value = override
+	}
+}
+
+// Validate 检查 c 和每个路由覆盖后的参数
+func (c Connection) Validate() error {
+	if err := c.validate(); err != nil {
+		return err
+	}
+	paths := make([]string, 0, len(c.Routes))
+	for path := range c.Routes {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		if err := c.ForRoute(path).validate(); err != nil {
+			return fmt.Errorf("route %s: %w", path, err)
+		}
+	}
+	return nil
+}
+
+func (c Connection) validate() error {
+	switch {
+	case c.WriteWait <= 0:
+		return errors.New("WriteWait must be positive")
+	case c.PongWait <= 0:
+		return errors.New("PongWait must be positive")
+	case c.PingPeriod < 0 || c.PingPeriod >= c.PongWait:
+		return fmt.Errorf("PingPeriod %d must be less than PongWait %d", c.PingPeriod, c.PongWait)
+	case c.MaxMessageSize <= 0:
+		return errors.New("MaxMessageSize must be positive")
+	case c.SendBuffer <= 0 || c.ReadBufferSize <= 0 || c.WriteBufferSize <= 0:
+		return errors.New("SendBuffer, ReadBufferSize and WriteBufferSize must be positive")
+	case c.Overflow != OverflowBlock && c.Overflow != OverflowDropOldest &&
+		c.Overflow != OverflowDropNewest && c.Overflow != OverflowDisconnect:
+		return fmt.Errorf("unknown Overflow %q", c.Overflow)
+	case c.OverflowTimeout <= 0:
+		return errors.New("OverflowTimeout must be positive")
+	case c.ExpiryWarning < 0:
+		return errors.New("ExpiryWarning must not be negative")
+	}
+	return nil
+}
@@ -1,26 +1,27 @@
 package jwtHelper
 
 import (
+	"errors"
 	"github.com/golang-jwt/jwt/v4"
-	"strings"
 )
 
+// ErrEmptyToken 没有 token
+var ErrEmptyToken = errors.New("jwt: empty token")
+
 // IsValid 验证是否有效token
 func IsValid(secret string, tokenStr string) (bool, *jwt.MapClaims) {
-	prefix := "Bearer "
-	tokenStr = strings.TrimPrefix(tokenStr, prefix)
-	//validate token format
-	if tokenStr == "" {
+	claims, err := Parse(secret, tokenStr)
+	if err != nil {
 		return false, nil
 	}
-	claims := &jwt.MapClaims{}
-	token, _ := jwt.ParseWithClaims(tokenStr, claims, func(token *jwt.Token) (i interface{}, err error) {
-		return []byte(secret), nil
-	})
+	return true, &claims
+}
 
-	if !token.Valid {
-		return false, nil
-	} else {
-		return true, claims
+// Parse 验证 HMAC（HS256/HS384/HS512）签名和过期时间，返回 claims，tokenStr 可以带 Bearer 前缀
+func Parse(secret string, tokenStr string) (jwt.MapClaims, error) {
+	verifier, err := NewVerifier(Options{Secret: secret})
+	if err != nil {
+		return nil, err
 	}
+	return verifier.Verify(tokenStr)
 }
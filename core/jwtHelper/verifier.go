@@ -0,0 +1,229 @@
+package jwtHelper
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// minRefreshInterval 遇到不认识的 kid 时重新加载公钥的最小间隔，防止伪造的 kid 把请求都打到 JWKS 地址
+const minRefreshInterval = 10 * time.Second
+
+// unknownKeyTimeout 遇到不认识的 kid 时等待重新加载的最长时间，JWKS 地址很慢时不会卡住建立连接
+const unknownKeyTimeout = 3 * time.Second
+
+// ErrUnknownKey 没有可以验证这个 token 的公钥
+var ErrUnknownKey = errors.New("jwt: unknown signing key")
+
+var (
+	hmacMethods       = []string{"HS256", "HS384", "HS512"}
+	publicKeyMethods  = []string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512", "EdDSA"}
+	defaultHTTPClient = &http.Client{Timeout: jwksTimeout}
+)
+
+// Options 验证 token 的参数，Secret、PublicKeys、JWKS 至少设置一个
+type Options struct {
+	// Secret HMAC（HS256/HS384/HS512）密钥
+	Secret string
+	// PublicKeys PEM 格式的 RSA、EC 或者 Ed25519 公钥文件，文件名去掉扩展名作为 kid
+	PublicKeys []string
+	// JWKS JWKS 文件路径或者 http(s) 地址
+	JWKS string
+	// RefreshInterval Run 在后台重新加载 PublicKeys 和 JWKS 的间隔，为 0 时只在遇到不认识的 kid 时加载
+	RefreshInterval time.Duration
+	// Issuer 不为空时 iss 必须一致
+	Issuer string
+	// Audience 不为空时 aud 必须包含
+	Audience string
+	// Leeway 检查 exp、nbf、iat 时允许的时钟误差
+	Leeway time.Duration
+	// Client 下载 JWKS 使用的 http.Client，为 nil 时使用 10 秒超时的默认客户端
+	Client *http.Client
+}
+
+// Verifier 按 Options 验证 token，公钥按 kid 选择，可以在多个协程中并发使用
+type Verifier struct {
+	opts   Options
+	parser *jwt.Parser
+
+	mu   sync.RWMutex
+	keys []publicKey
+
+	// refreshMu 同一时间只有一个协程加载，lastLoad 为上次尝试加载的时间
+	refreshMu sync.Mutex
+	lastLoad  time.Time
+
+	now            func() time.Time
+	refreshTimeout time.Duration
+}
+
+func NewVerifier(opts Options) (*Verifier, error) {
+	var methods []string
+	if opts.Secret != "" {
+		methods = append(methods, hmacMethods...)
+	}
+	if len(opts.PublicKeys) > 0 || opts.JWKS != "" {
+		methods = append(methods, publicKeyMethods...)
+	}
+	if len(methods) == 0 {
+		return nil, errors.New("jwt: one of Secret, PublicKeys or JWKS is required")
+	}
+	if opts.Client == nil {
+		opts.Client = defaultHTTPClient
+	}
+	v := &Verifier{
+		opts: opts,
+		// 只接受配置了密钥的算法，防止用 none 或者把公钥当 HMAC 密钥伪造；时间在 validate 中按 Leeway 检查
+		parser:         jwt.NewParser(jwt.WithValidMethods(methods), jwt.WithoutClaimsValidation()),
+		now:            time.Now,
+		refreshTimeout: unknownKeyTimeout,
+	}
+	keys, err := v.load(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	v.keys = keys
+	v.lastLoad = v.now()
+	return v, nil
+}
+
+// Run 每隔 RefreshInterval 重新加载 PublicKeys 和 JWKS，直到 ctx 结束，验证 token 时不会等待定期加载
+// RefreshInterval 为 0 或者只配置了 Secret 时直接返回
+func (v *Verifier) Run(ctx context.Context) {
+	if v.opts.RefreshInterval <= 0 || (len(v.opts.PublicKeys) == 0 && v.opts.JWKS == "") {
+		return
+	}
+	ticker := time.NewTicker(v.opts.RefreshInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			v.refresh(ctx, 0)
+		}
+	}
+}
+
+// Verify 验证签名和 claims，返回 claims，tokenStr 可以带 Bearer 前缀
+func (v *Verifier) Verify(tokenStr string) (jwt.MapClaims, error) {
+	tokenStr = strings.TrimPrefix(tokenStr, "Bearer ")
+	if tokenStr == "" {
+		return nil, ErrEmptyToken
+	}
+	claims := jwt.MapClaims{}
+	if _, err := v.parser.ParseWithClaims(tokenStr, claims, v.key); err != nil {
+		return nil, err
+	}
+	if err := v.validate(claims); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+// Leeway 检查 exp、nbf、iat 时允许的时钟误差，token 在 exp+Leeway 之前都可以通过验证
+func (v *Verifier) Leeway() time.Duration {
+	return v.opts.Leeway
+}
+
+// key 选择验证 token 的密钥
+func (v *Verifier) key(token *jwt.Token) (interface{}, error) {
+	if _, ok := token.Method.(*jwt.SigningMethodHMAC); ok {
+		return []byte(v.opts.Secret), nil
+	}
+	kid, _ := token.Header["kid"].(string)
+	key, err := v.find(kid, token.Method)
+	if errors.Is(err, ErrUnknownKey) && kid != "" {
+		// 可能是刚轮换的新 key，最多等待 refreshTimeout，超时时返回 ErrUnknownKey
+		ctx, cancel := context.WithTimeout(context.Background(), v.refreshTimeout)
+		defer cancel()
+		if v.refresh(ctx, minRefreshInterval) {
+			key, err = v.find(kid, token.Method)
+		}
+	}
+	return key, err
+}
+
+// find 按 kid 查找，token 没有 kid 时只能有一个可用的公钥
+func (v *Verifier) find(kid string, method jwt.SigningMethod) (any, error) {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	var found []any
+	for _, key := range v.keys {
+		if (kid == "" || key.kid == kid) && key.accepts(method) {
+			found = append(found, key.key)
+		}
+	}
+	switch {
+	case len(found) == 0:
+		return nil, fmt.Errorf("%w: kid %q alg %s", ErrUnknownKey, kid, method.Alg())
+	case len(found) > 1 && kid == "":
+		return nil, fmt.Errorf("jwt: token has no kid and %d keys accept %s", len(found), method.Alg())
+	}
+	return found[0], nil
+}
+
+// refresh 距离上次加载超过 interval 时重新加载，返回是否加载成功，失败时继续使用之前的公钥
+func (v *Verifier) refresh(ctx context.Context, interval time.Duration) bool {
+	v.refreshMu.Lock()
+	defer v.refreshMu.Unlock()
+	now := v.now()
+	if now.Sub(v.lastLoad) < interval {
+		return false
+	}
+	v.lastLoad = now
+	keys, err := v.load(ctx)
+	if err != nil {
+		log.Printf("reload jwt keys: %v", err)
+		return false
+	}
+	v.mu.Lock()
+	v.keys = keys
+	v.mu.Unlock()
+	return true
+}
+
+func (v *Verifier) load(ctx context.Context) ([]publicKey, error) {
+	var keys []publicKey
+	for _, path := range v.opts.PublicKeys {
+		key, err := loadPEM(path)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	if v.opts.JWKS != "" {
+		jwks, err := loadJWKS(ctx, v.opts.Client, v.opts.JWKS)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, jwks...)
+	}
+	return keys, nil
+}
+
+// validate 检查 exp、nbf、iat、iss、aud
+func (v *Verifier) validate(claims jwt.MapClaims) error {
+	now := v.now()
+	leeway := v.opts.Leeway
+	switch {
+	case !claims.VerifyExpiresAt(now.Add(-leeway).Unix(), false):
+		return jwt.ErrTokenExpired
+	case !claims.VerifyNotBefore(now.Add(leeway).Unix(), false):
+		return jwt.ErrTokenNotValidYet
+	case !claims.VerifyIssuedAt(now.Add(leeway).Unix(), false):
+		return jwt.ErrTokenUsedBeforeIssued
+	case v.opts.Issuer != "" && !claims.VerifyIssuer(v.opts.Issuer, true):
+		return jwt.ErrTokenInvalidIssuer
+	case v.opts.Audience != "" && !claims.VerifyAudience(v.opts.Audience, true):
+		return jwt.ErrTokenInvalidAudience
+	}
+	return nil
+}
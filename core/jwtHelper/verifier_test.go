@@ -0,0 +1,222 @@
+package jwtHelper
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func sign(t *testing.T, method jwt.SigningMethod, kid string, key any, claims jwt.MapClaims) string {
+	token := jwt.NewWithClaims(method, claims)
+	if kid != "" {
+		token.Header["kid"] = kid
+	}
+	signed, err := token.SignedString(key)
+	assert.NoError(t, err)
+	return signed
+}
+
+func b64(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func rsaJWK(kid string, key *rsa.PublicKey) map[string]string {
+	return map[string]string{"kty": "RSA", "kid": kid, "alg": "RS256", "use": "sig", "n": b64(key.N.Bytes()), "e": b64(big.NewInt(int64(key.E)).Bytes())}
+}
+
+func ecJWK(kid string, key *ecdsa.PublicKey) map[string]string {
+	return map[string]string{"kty": "EC", "kid": kid, "crv": "P-256", "x": b64(key.X.FillBytes(make([]byte, 32))), "y": b64(key.Y.FillBytes(make([]byte, 32)))}
+}
+
+func edJWK(kid string, key ed25519.PublicKey) map[string]string {
+	return map[string]string{"kty": "OKP", "kid": kid, "crv": "Ed25519", "x": b64(key)}
+}
+
+func jwks(keys ...map[string]string) []byte {
+	data, _ := json.Marshal(map[string]any{"keys": keys})
+	return data
+}
+
+func TestVerifier_JWKS(t *testing.T) {
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	edPublic, edKey, _ := ed25519.GenerateKey(rand.Reader)
+
+	var document atomic.Value
+	document.Store(jwks(rsaJWK("rsa-1", &rsaKey.PublicKey), ecJWK("ec-1", &ecKey.PublicKey), edJWK("ed-1", edPublic)))
+	var requests atomic.Int32
+	// 代替身份服务的 JWKS 地址
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.Write(document.Load().([]byte))
+	}))
+	t.Cleanup(server.Close)
+
+	v, err := NewVerifier(Options{JWKS: server.URL, Issuer: "https://issuer", Audience: "ws"})
+	assert.NoError(t, err)
+	now := time.Now()
+	v.now = func() time.Time { return now }
+	claims := jwt.MapClaims{"client_id": "u1", "iss": "https://issuer", "aud": "ws", "exp": now.Add(time.Hour).Unix()}
+
+	for name, token := range map[string]string{
+		"RS256": sign(t, jwt.SigningMethodRS256, "rsa-1", rsaKey, claims),
+		"ES256": sign(t, jwt.SigningMethodES256, "ec-1", ecKey, claims),
+		"EdDSA": sign(t, jwt.SigningMethodEdDSA, "ed-1", edKey, claims),
+	} {
+		verified, err := v.Verify("Bearer " + token)
+		assert.NoError(t, err, name)
+		assert.Equal(t, "u1", verified["client_id"], name)
+	}
+
+	for name, token := range map[string]string{
+		// kid 和算法对不上
+		"wrong kid": sign(t, jwt.SigningMethodES256, "rsa-1", ecKey, claims),
+		// 没有配置 Secret 时不接受 HMAC，防止把公钥当密钥
+		"hmac":       sign(t, jwt.SigningMethodHS256, "", []byte("secret"), claims),
+		"wrong iss":  sign(t, jwt.SigningMethodRS256, "rsa-1", rsaKey, jwt.MapClaims{"iss": "other", "aud": "ws"}),
+		"wrong aud":  sign(t, jwt.SigningMethodRS256, "rsa-1", rsaKey, jwt.MapClaims{"iss": "https://issuer", "aud": "other"}),
+		"no aud":     sign(t, jwt.SigningMethodRS256, "rsa-1", rsaKey, jwt.MapClaims{"iss": "https://issuer"}),
+		"expired":    sign(t, jwt.SigningMethodRS256, "rsa-1", rsaKey, jwt.MapClaims{"iss": "https://issuer", "aud": "ws", "exp": now.Add(-time.Second).Unix()}),
+		"not before": sign(t, jwt.SigningMethodRS256, "rsa-1", rsaKey, jwt.MapClaims{"iss": "https://issuer", "aud": "ws", "nbf": now.Add(time.Minute).Unix()}),
+	} {
+		_, err := v.Verify(token)
+		assert.Error(t, err, name)
+	}
+
+	// 轮换：新 kid 第一次出现时重新加载
+	rotated, _ := rsa.GenerateKey(rand.Reader, 2048)
+	document.Store(jwks(rsaJWK("rsa-2", &rotated.PublicKey)))
+	token := sign(t, jwt.SigningMethodRS256, "rsa-2", rotated, claims)
+	_, err = v.Verify(token)
+	assert.ErrorIs(t, err, ErrUnknownKey, "reloads at most every minRefreshInterval")
+	now = now.Add(minRefreshInterval)
+	_, err = v.Verify(token)
+	assert.NoError(t, err)
+	// 旧 key 已经从 JWKS 中删除
+	_, err = v.Verify(sign(t, jwt.SigningMethodRS256, "rsa-1", rsaKey, claims))
+	assert.ErrorIs(t, err, ErrUnknownKey)
+	assert.Equal(t, int32(2), requests.Load())
+
+	// 伪造的 kid 不会每次都请求 JWKS
+	for i := 0; i < 10; i++ {
+		v.Verify(sign(t, jwt.SigningMethodRS256, "forged", rotated, claims))
+	}
+	assert.Equal(t, int32(2), requests.Load())
+}
+
+func TestVerifier_SlowJWKS(t *testing.T) {
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	var slow atomic.Bool
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if slow.Load() {
+			select {
+			case <-release:
+			case <-r.Context().Done():
+			}
+		}
+		w.Write(jwks(rsaJWK("rsa-1", &rsaKey.PublicKey)))
+	}))
+	t.Cleanup(server.Close)
+	t.Cleanup(func() { close(release) })
+
+	v, err := NewVerifier(Options{JWKS: server.URL})
+	assert.NoError(t, err)
+	v.refreshTimeout = 50 * time.Millisecond
+	now := time.Now().Add(minRefreshInterval)
+	v.now = func() time.Time { return now }
+
+	// JWKS 地址没有响应时，不认识的 kid 等到 refreshTimeout 就失败，不会一直卡住
+	slow.Store(true)
+	start := time.Now()
+	_, err = v.Verify(sign(t, jwt.SigningMethodRS256, "rsa-2", rsaKey, jwt.MapClaims{"exp": now.Add(time.Hour).Unix()}))
+	assert.ErrorIs(t, err, ErrUnknownKey)
+	assert.Less(t, time.Since(start), time.Second)
+}
+
+func TestVerifier_PEM(t *testing.T) {
+	dir := t.TempDir()
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	der, _ := x509.MarshalPKIXPublicKey(&ecKey.PublicKey)
+	path := filepath.Join(dir, "ec-1.pem")
+	assert.NoError(t, os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0o600))
+	jwksPath := filepath.Join(dir, "jwks.json")
+	edPublic, edKey, _ := ed25519.GenerateKey(rand.Reader)
+	assert.NoError(t, os.WriteFile(jwksPath, jwks(edJWK("ed-1", edPublic)), 0o600))
+
+	v, err := NewVerifier(Options{Secret: "secret", PublicKeys: []string{path}, JWKS: jwksPath, RefreshInterval: 20 * time.Millisecond, Leeway: 30 * time.Second})
+	assert.NoError(t, err)
+	now := time.Now()
+	v.now = func() time.Time { return now }
+	// 过期 10 秒，在允许的误差内
+	claims := jwt.MapClaims{"sub": "u1", "exp": now.Add(-10 * time.Second).Unix()}
+
+	// 文件名作为 kid，只有一个可用的公钥时可以没有 kid
+	for _, token := range []string{
+		sign(t, jwt.SigningMethodES256, "ec-1", ecKey, claims),
+		sign(t, jwt.SigningMethodES256, "", ecKey, claims),
+		sign(t, jwt.SigningMethodEdDSA, "ed-1", edKey, claims),
+		sign(t, jwt.SigningMethodHS256, "", []byte("secret"), claims),
+	} {
+		_, err := v.Verify(token)
+		assert.NoError(t, err)
+	}
+	_, err = v.Verify(sign(t, jwt.SigningMethodHS256, "", []byte("secret"), jwt.MapClaims{"exp": now.Add(-time.Minute).Unix()}))
+	assert.ErrorIs(t, err, jwt.ErrTokenExpired)
+
+	// Run 在后台定期重新加载，文件替换后使用新公钥，验证时不加载
+	rotated, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	der, _ = x509.MarshalPKIXPublicKey(&rotated.PublicKey)
+	assert.NoError(t, os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0o600))
+	token := sign(t, jwt.SigningMethodES256, "ec-1", rotated, jwt.MapClaims{"sub": "u1"})
+	time.Sleep(40 * time.Millisecond)
+	_, err = v.Verify(token)
+	assert.Error(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		v.Run(ctx)
+		close(stopped)
+	}()
+	assert.Eventually(t, func() bool {
+		_, err := v.Verify(token)
+		return err == nil
+	}, time.Second, 10*time.Millisecond)
+	cancel()
+	<-stopped
+
+	_, err = NewVerifier(Options{PublicKeys: []string{filepath.Join(dir, "missing.pem")}})
+	assert.Error(t, err)
+	_, err = NewVerifier(Options{})
+	assert.Error(t, err)
+}
+
+func TestIsValid(t *testing.T) {
+	ok, claims := IsValid("secret", "Bearer "+sign(t, jwt.SigningMethodHS256, "", []byte("secret"), jwt.MapClaims{"client_id": "u1"}))
+	assert.True(t, ok)
+	assert.Equal(t, "u1", (*claims)["client_id"])
+
+	for _, token := range []string{"", "garbage", sign(t, jwt.SigningMethodHS256, "", []byte("other"), jwt.MapClaims{})} {
+		ok, claims = IsValid("secret", token)
+		assert.False(t, ok)
+		assert.Nil(t, claims)
+	}
+}
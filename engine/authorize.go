@@ -0,0 +1,166 @@
+package engine
+
+import (
+	"context"
+	"fmt"
+	"slices"
+
+	"github.com/WangSiangCun/go-ws/auth"
+)
+
+// Authorizer 决定 sender 能否发送 c.Message，在所有发送中间件之前执行，只检查客户端发来的消息
+// 客户端加入和退出房间时也会检查，此时 c.Message 为 TypeJoinRoom 或 TypeLeaveRoom 控制消息
+// 返回 *RPCError 时原样回复给发送方，其他错误回复 RPCInternal
+type Authorizer interface {
+	Authorize(c *Context, sender *auth.Identity) error
+}
+
+// AuthorizerFunc 函数形式的 Authorizer
+type AuthorizerFunc func(c *Context, sender *auth.Identity) error
+
+func (f AuthorizerFunc) Authorize(c *Context, sender *auth.Identity) error {
+	return f(c, sender)
+}
+
+// Forbidden 拒绝发送的错误
+func Forbidden(format string, args ...any) *RPCError {
+	return NewRPCError(RPCForbidden, fmt.Sprintf(format, args...))
+}
+
+// Authorizers 依次执行，全部通过才允许发送
+func Authorizers(authorizers ...Authorizer) Authorizer {
+	return AuthorizerFunc(func(c *Context, sender *auth.Identity) error {
+		for _, authorizer := range authorizers {
+			if err := authorizer.Authorize(c, sender); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// AllowAll 所有用户都可以发送，AllowList 中使用
+const AllowAll = "*"
+
+// AllowList 只能发给 allowed[发送方用户 id] 中的用户，包含 AllowAll 时可以发给任何人和广播
+// 不在 allowed 中的用户不能发送，房间消息由 RoomMembership 检查
+func AllowList(allowed map[string][]string) Authorizer {
+	return AuthorizerFunc(func(c *Context, sender *auth.Identity) error {
+		targets := allowed[sender.UserId]
+		if slices.Contains(targets, AllowAll) || c.Message.Room != "" {
+			return nil
+		}
+		if c.Message.Broadcast {
+			return Forbidden("%s may not broadcast", sender.UserId)
+		}
+		for _, targetId := range c.Message.TargetIds {
+			if !slices.Contains(targets, targetId) {
+				return Forbidden("%s may not message %s", sender.UserId, targetId)
+			}
+		}
+		return nil
+	})
+}
+
+// TenantBoundary 只能发给同一个租户的用户，tenantOf 查询用户的租户
+// 广播只发给同一个租户的客户端（按元数据 tenant 过滤）；房间内已经有其他租户的用户时不能加入，房间消息由 RoomMembership 检查
+// 空房间可以被任何租户的用户加入，房间名和租户有固定关系时用 RoomAccess 检查
+func TenantBoundary(tenantOf func(ctx context.Context, userId string) (string, error)) Authorizer {
+	return AuthorizerFunc(func(c *Context, sender *auth.Identity) error {
+		if c.Message.Type == TypeJoinRoom {
+			return sameTenantRoom(c, sender, tenantOf)
+		}
+		if c.Message.Room != "" {
+			return nil
+		}
+		if c.Message.Broadcast {
+			c.Message.Filters = append(c.Message.Filters, Filter{Key: "tenant", Op: FilterEq, Values: []string{sender.Tenant}})
+			return nil
+		}
+		for _, targetId := range c.Message.TargetIds {
+			tenant, err := tenantOf(c, targetId)
+			if err != nil {
+				return fmt.Errorf("tenant of %s: %w", targetId, err)
+			}
+			if tenant != sender.Tenant {
+				return Forbidden("%s is in another tenant", targetId)
+			}
+		}
+		return nil
+	})
+}
+
+// sameTenantRoom 房间内的其他用户都和 sender 是同一个租户
+func sameTenantRoom(c *Context, sender *auth.Identity, tenantOf func(ctx context.Context, userId string) (string, error)) error {
+	members, err := c.WS.Registry.RoomMembers(c, c.Message.Room)
+	if err != nil {
+		return fmt.Errorf("room %s members: %w", c.Message.Room, err)
+	}
+	checked := map[string]bool{sender.UserId: true}
+	for _, member := range members {
+		if checked[member.UserId] {
+			continue
+		}
+		checked[member.UserId] = true
+		tenant, err := tenantOf(c, member.UserId)
+		if err != nil {
+			return fmt.Errorf("tenant of %s: %w", member.UserId, err)
+		}
+		if tenant != sender.Tenant {
+			return Forbidden("room %s is in another tenant", c.Message.Room)
+		}
+	}
+	return nil
+}
+
+// BlockList 目标用户屏蔽了发送方时拒绝，blocked 返回 userId 是否屏蔽了 senderId
+func BlockList(blocked func(ctx context.Context, userId, senderId string) (bool, error)) Authorizer {
+	return AuthorizerFunc(func(c *Context, sender *auth.Identity) error {
+		for _, targetId := range c.Message.TargetIds {
+			isBlocked, err := blocked(c, targetId, sender.UserId)
+			if err != nil {
+				return fmt.Errorf("block list of %s: %w", targetId, err)
+			}
+			if isBlocked {
+				return Forbidden("%s has blocked %s", targetId, sender.UserId)
+			}
+		}
+		return nil
+	})
+}
+
+// RoomMembership 只有房间内的在线用户可以发送房间消息，加入和退出房间不检查
+func RoomMembership() Authorizer {
+	return AuthorizerFunc(func(c *Context, sender *auth.Identity) error {
+		if c.Message.Room == "" || c.Message.Type == TypeJoinRoom || c.Message.Type == TypeLeaveRoom {
+			return nil
+		}
+		members, err := c.WS.Registry.RoomMembers(c, c.Message.Room)
+		if err != nil {
+			return fmt.Errorf("room %s members: %w", c.Message.Room, err)
+		}
+		for _, member := range members {
+			if member.UserId == sender.UserId {
+				return nil
+			}
+		}
+		return Forbidden("%s is not in room %s", sender.UserId, c.Message.Room)
+	})
+}
+
+// RoomAccess 加入房间时由 allowed 决定 sender 能否加入 room，比如按房间名中的租户或者业务数据判断，退出房间不检查
+func RoomAccess(allowed func(ctx context.Context, sender *auth.Identity, room string) (bool, error)) Authorizer {
+	return AuthorizerFunc(func(c *Context, sender *auth.Identity) error {
+		if c.Message.Type != TypeJoinRoom {
+			return nil
+		}
+		ok, err := allowed(c, sender, c.Message.Room)
+		if err != nil {
+			return fmt.Errorf("access to room %s: %w", c.Message.Room, err)
+		}
+		if !ok {
+			return Forbidden("%s may not join room %s", sender.UserId, c.Message.Room)
+		}
+		return nil
+	})
+}
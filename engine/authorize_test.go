@@ -0,0 +1,119 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/WangSiangCun/go-ws/auth"
+	"github.com/WangSiangCun/go-ws/config"
+	"github.com/WangSiangCun/go-ws/registry"
+	"github.com/WangSiangCun/go-ws/wsContext"
+	"github.com/stretchr/testify/assert"
+)
+
+func authorize(authorizer Authorizer, sender *auth.Identity, message *Message) error {
+	ws := wsContext.NewContext(context.Background(), config.NewStandaloneConfig("127.0.0.1", ":0", 10))
+	return authorizer.Authorize(NewContext(nil, ws, message), sender)
+}
+
+func assertForbidden(t *testing.T, err error) {
+	var rpcErr *RPCError
+	if assert.ErrorAs(t, err, &rpcErr) {
+		assert.Equal(t, RPCForbidden, rpcErr.Code)
+	}
+}
+
+func TestAllowList(t *testing.T) {
+	authorizer := AllowList(map[string][]string{"u1": {"u2", "u3"}, "admin": {AllowAll}})
+	u1 := &auth.Identity{UserId: "u1"}
+
+	assert.NoError(t, authorize(authorizer, u1, &Message{TargetIds: []string{"u2", "u3"}}))
+	assertForbidden(t, authorize(authorizer, u1, &Message{TargetIds: []string{"u2", "u4"}}))
+	assertForbidden(t, authorize(authorizer, u1, &Message{Broadcast: true}))
+	assertForbidden(t, authorize(authorizer, &auth.Identity{UserId: "u9"}, &Message{TargetIds: []string{"u2"}}))
+	assert.NoError(t, authorize(authorizer, &auth.Identity{UserId: "admin"}, &Message{Broadcast: true}))
+	// 房间消息由 RoomMembership 检查
+	assert.NoError(t, authorize(authorizer, u1, &Message{Room: "r1"}))
+}
+
+func TestTenantBoundary(t *testing.T) {
+	tenants := map[string]string{"u1": "t1", "u2": "t1", "u3": "t2"}
+	authorizer := TenantBoundary(func(ctx context.Context, userId string) (string, error) {
+		tenant, ok := tenants[userId]
+		if !ok {
+			return "", errors.New("unknown user")
+		}
+		return tenant, nil
+	})
+	sender := &auth.Identity{UserId: "u1", Tenant: "t1"}
+
+	assert.NoError(t, authorize(authorizer, sender, &Message{TargetIds: []string{"u2"}}))
+	assertForbidden(t, authorize(authorizer, sender, &Message{TargetIds: []string{"u2", "u3"}}))
+	// 查询失败不是 RPCError，不会把内部错误发给客户端
+	err := authorize(authorizer, sender, &Message{TargetIds: []string{"u4"}})
+	var rpcErr *RPCError
+	assert.Error(t, err)
+	assert.False(t, errors.As(err, &rpcErr))
+
+	// 广播限制在同一个租户
+	broadcast := &Message{Broadcast: true}
+	assert.NoError(t, authorize(authorizer, sender, broadcast))
+	assert.True(t, MatchFilters(broadcast.Filters, map[string]string{"tenant": "t1"}))
+	assert.False(t, MatchFilters(broadcast.Filters, map[string]string{"tenant": "t2"}))
+
+	// 房间内已经有其他租户的用户时不能加入
+	ws := wsContext.WSContext{Context: context.Background(), Registry: registry.NewMemoryRegistry()}
+	assert.NoError(t, ws.Registry.Register(ws.Context, registry.Session{UserId: "u3", ConnId: "c3", Node: "n1"}, 10))
+	assert.NoError(t, ws.Registry.JoinRoom(ws.Context, "r1", "u3", "c3"))
+	join := func(room string) error {
+		return authorizer.Authorize(NewContext(nil, ws, &Message{Type: TypeJoinRoom, Room: room}), sender)
+	}
+	assertForbidden(t, join("r1"))
+	assert.NoError(t, join("r2"))
+	assert.NoError(t, authorizer.Authorize(NewContext(nil, ws, &Message{Type: TypeLeaveRoom, Room: "r1"}), sender))
+}
+
+func TestBlockList(t *testing.T) {
+	authorizer := BlockList(func(ctx context.Context, userId, senderId string) (bool, error) {
+		return userId == "u3" && senderId == "u1", nil
+	})
+	assert.NoError(t, authorize(authorizer, &auth.Identity{UserId: "u1"}, &Message{TargetIds: []string{"u2"}}))
+	assertForbidden(t, authorize(authorizer, &auth.Identity{UserId: "u1"}, &Message{TargetIds: []string{"u2", "u3"}}))
+	assert.NoError(t, authorize(authorizer, &auth.Identity{UserId: "u2"}, &Message{TargetIds: []string{"u3"}}))
+}
+
+func TestRoomMembership(t *testing.T) {
+	ws := wsContext.WSContext{Context: context.Background(), Registry: registry.NewMemoryRegistry()}
+	ctx := context.Background()
+	assert.NoError(t, ws.Registry.Register(ctx, registry.Session{UserId: "u1", ConnId: "c1", Node: "n1"}, 10))
+	assert.NoError(t, ws.Registry.JoinRoom(ctx, "r1", "u1", "c1"))
+
+	authorizer := Authorizers(RoomMembership(), AllowList(map[string][]string{"u1": {"u2"}}))
+	check := func(userId string, message *Message) error {
+		return authorizer.Authorize(NewContext(nil, ws, message), &auth.Identity{UserId: userId})
+	}
+	assert.NoError(t, check("u1", &Message{Room: "r1"}))
+	assertForbidden(t, check("u2", &Message{Room: "r1"}))
+	assertForbidden(t, check("u1", &Message{Room: "r2"}))
+	// 加入和退出房间不要求已经是成员
+	assert.NoError(t, check("u2", &Message{Type: TypeJoinRoom, Room: "r1"}))
+	assert.NoError(t, check("u2", &Message{Type: TypeLeaveRoom, Room: "r1"}))
+	// 不是房间消息时由后面的 AllowList 检查
+	assert.NoError(t, check("u1", &Message{TargetIds: []string{"u2"}}))
+	assertForbidden(t, check("u1", &Message{TargetIds: []string{"u3"}}))
+}
+
+func TestRoomAccess(t *testing.T) {
+	// 房间名以租户开头
+	authorizer := RoomAccess(func(ctx context.Context, sender *auth.Identity, room string) (bool, error) {
+		return strings.HasPrefix(room, sender.Tenant+"-"), nil
+	})
+	sender := &auth.Identity{UserId: "u1", Tenant: "t1"}
+	assert.NoError(t, authorize(authorizer, sender, &Message{Type: TypeJoinRoom, Room: "t1-lobby"}))
+	assertForbidden(t, authorize(authorizer, sender, &Message{Type: TypeJoinRoom, Room: "t2-lobby"}))
+	// 只检查加入
+	assert.NoError(t, authorize(authorizer, sender, &Message{Type: TypeLeaveRoom, Room: "t2-lobby"}))
+	assert.NoError(t, authorize(authorizer, sender, &Message{Room: "t2-lobby"}))
+}
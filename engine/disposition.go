@@ -0,0 +1,45 @@
+package engine
+
+// Disposition 单条消息经过发送中间件之后的去向，只对这一条消息有效
+type Disposition int
+
+const (
+	// DispositionForward 默认，按 TargetIds、Room 或 Broadcast 转发
+	DispositionForward Disposition = iota
+	// DispositionDrop 丢弃，不转发也不回复
+	DispositionDrop
+	// DispositionHandled 已由服务端处理，不再转发
+	DispositionHandled
+	// DispositionReply 不转发，把 Context.Reply 回复给发送这条消息的连接
+	DispositionReply
+)
+
+func (d Disposition) String() string {
+	switch d {
+	case DispositionForward:
+		return "forward"
+	case DispositionDrop:
+		return "drop"
+	case DispositionHandled:
+		return "handled"
+	case DispositionReply:
+		return "reply"
+	}
+	return "unknown"
+}
+
+// Drop 丢弃这条消息
+func (c *Context) Drop() {
+	c.Disposition = DispositionDrop
+}
+
+// Handled 标记这条消息已由服务端处理
+func (c *Context) Handled() {
+	c.Disposition = DispositionHandled
+}
+
+// ReplyWith 不转发，把 reply 回复给发送方连接
+func (c *Context) ReplyWith(reply *Message) {
+	c.Disposition = DispositionReply
+	c.Reply = reply
+}
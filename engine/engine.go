@@ -1,33 +1,125 @@
 package engine
 
 import (
+	"github.com/WangSiangCun/go-ws/auth"
 	"github.com/WangSiangCun/go-ws/config"
 	"github.com/WangSiangCun/go-ws/wsContext"
-	"reflect"
+	"time"
 )
 
 type Message struct {
+	// Version 消息格式版本，服务端按连接协商的版本填写，v1 连接不带这个字段
+	Version int `json:"version,omitempty"`
+	// Id 服务端分配的消息 id，客户端用它发送 TypeAck 确认和去重
+	Id        string   `json:"id,omitempty"`
 	Message   string   `json:"message"`
 	TargetIds []string `json:"target_ids"`
 	SourceId  string   `json:"source_id"`
 	Type      int64    `json:"type"`
+	// Room 房间消息由服务端展开成房间内的所有成员，此时忽略 TargetIds
+	Room string `json:"room,omitempty"`
+	// Broadcast 广播消息，发送给所有在线节点上符合 Filters 的客户端，此时忽略 TargetIds 和 Room
+	Broadcast bool `json:"broadcast,omitempty"`
+	// Filters 广播时按客户端元数据过滤，全部满足才会收到
+	Filters []Filter `json:"filters,omitempty"`
+	// ConnIds 节点间转发时指定投递的连接，为空时投递给 TargetIds 在本节点的所有连接，不会发给客户端
+	ConnIds []string `json:"conn_ids,omitempty"`
+	// Seq 开启 Sequence 时接收方用户的消息序号，从 1 开始递增，客户端重连时带上收到的最大序号
+	Seq uint64 `json:"seq,omitempty"`
+	// RequestId TypeRPC 请求的编号，回复时原样带回，客户端用来对应请求和回复
+	RequestId string `json:"request_id,omitempty"`
+	// Method TypeRPC 请求调用的方法
+	Method string `json:"method,omitempty"`
+	// Error TypeRPC 调用失败时的错误，成功时为空
+	Error *RPCError `json:"error,omitempty"`
+	// Timestamp v2 服务端收到消息的时间，Unix 毫秒
+	Timestamp int64 `json:"timestamp,omitempty"`
+	// Headers v2 自定义的消息头，原样转发
+	Headers map[string]string `json:"headers,omitempty"`
+	// ContentType v2 Message 的内容类型，比如 application/json，原样转发
+	ContentType string `json:"content_type,omitempty"`
+	// Data 二进制内容，JSON 编码时为 base64，MessagePack 和 Protobuf 编码时原样传输
+	Data []byte `json:"data,omitempty"`
+	// SourceConnId 发送这条消息的连接，只在本节点内使用，服务端产生的消息为空，中间件中使用 Context.SenderConnId
+	SourceConnId string `json:"-"`
 }
+
+// 保留的控制消息类型，由服务端处理，不会被转发
+const (
+	// TypeJoinRoom 加入 Message.Room
+	TypeJoinRoom int64 = -1 - iota
+	// TypeLeaveRoom 退出 Message.Room
+	TypeLeaveRoom
+	// TypeKick 节点间使用，关闭 Message.ConnIds 对应的连接
+	TypeKick
+	// TypeRPC 调用 Engine.HandleRPC 注册的方法，回复只发给调用的连接
+	TypeRPC
+	// TypeAck 客户端确认收到 Message.Id
+	TypeAck
+	// TypeResync 服务端通知客户端，重连时带上的序号之后的消息已经不在历史记录中，需要全量同步
+	TypeResync
+	// TypeTokenExpiring 服务端通知客户端 token 即将过期，Message 为过期时间（Unix 秒），客户端需要发送 TypeReauth
+	TypeTokenExpiring
+	// TypeReauth 客户端在连接内更换 token，Message 为新 token，带上 RequestId 时服务端回复结果，失败时带 Error
+	TypeReauth
+	// TypeError 服务端拒绝了客户端发送的消息，RequestId 为原消息的 request_id，Error 为原因
+	TypeError
+)
+
 type Engine struct {
-	Config               *config.Config
-	IsOpenJWT            bool
-	SendHandlers         []HandlersFunc
-	SendParameters       [][]any
-	ReceiveHandlers      []HandlersFunc
-	ReceiveParameters    [][]any
-	IsServerHandlerModel bool
+	Config            *config.Config
+	IsOpenJWT         bool
+	SendHandlers      []HandlersFunc
+	SendParameters    [][]any
+	ReceiveHandlers   []HandlersFunc
+	ReceiveParameters [][]any
+	// SendMiddlewares 发送前的中间件，在 SendHandlers 之前执行
+	SendMiddlewares []Middleware
+	// ReceiveMiddlewares 接收后的中间件，在 ReceiveHandlers 之前执行
+	ReceiveMiddlewares []Middleware
+	// Router 按消息类型注册的发送处理函数，在 SendHandlers 之后执行
+	Router *Router
+	// RPCTimeout RPC 方法的超时时间，超时后回复 RPCTimeout 错误
+	RPCTimeout time.Duration
+	// Authenticator 升级前认证请求，为 nil 时使用 auth.Query，OpenJWT 设置为 auth.JWT
+	Authenticator auth.Authenticator
+	// Authorizer 路由前检查客户端能否发送这条消息，为 nil 时不检查
+	Authorizer Authorizer
+
+	rpcHandlers map[string]RPCHandler
 }
+
+// HandlersFunc 旧版插件，返回非 nil 的消息会替换原消息，通过 Adapt 转成中间件执行
 type HandlersFunc func(e *Engine, wsCtx wsContext.WSContext, message *Message, opts ...any) (res *Message)
 
 func NewEngine(config *config.Config) *Engine {
-	return &Engine{Config: config}
+	return &Engine{
+		Config:      config,
+		Router:      NewRouter(),
+		RPCTimeout:  defaultRPCTimeout,
+		rpcHandlers: make(map[string]RPCHandler),
+	}
 }
-func (e *Engine) OpenJWT(jwt config.JWT) {
+
+// OpenJWT 连接时验证 JWT，见 auth.NewJWTFromConfig，公钥文件或者 JWKS 加载失败时返回错误
+func (e *Engine) OpenJWT(jwt config.JWT) error {
+	authenticator, err := auth.NewJWTFromConfig(jwt)
+	if err != nil {
+		return err
+	}
 	e.IsOpenJWT = true
+	e.Authenticator = authenticator
+	return nil
+}
+
+// SetAuthorizer 设置路由前的授权检查，比如 engine.Authorizers(engine.RoomMembership(), engine.BlockList(blocked))
+func (e *Engine) SetAuthorizer(authorizer Authorizer) {
+	e.Authorizer = authorizer
+}
+
+// SetAuthenticator 设置升级前的认证方式，比如 auth.Chain(auth.NewJWT(secret), auth.NewAPIKeys(keys...))
+func (e *Engine) SetAuthenticator(authenticator auth.Authenticator) {
+	e.Authenticator = authenticator
 }
 func (e *Engine) SetSendHandlers(SendHandlers []HandlersFunc) {
 	e.SendHandlers = SendHandlers
@@ -43,43 +135,44 @@ func (e *Engine) SetReceiverParameters(opts [][]any) {
 	e.ReceiveParameters = opts
 }
 
-// RunHandlers 执行插件
-func (e *Engine) runHandlers(wsCtx wsContext.WSContext, handlers []HandlersFunc, parametersPointer *[][]any, message *Message) {
-	parameters := *parametersPointer
-	if len(handlers) != len(parameters) {
-		panic("handlers and parameters length not equal")
-	}
-	args := []reflect.Value{reflect.ValueOf(e), reflect.ValueOf(wsCtx), reflect.ValueOf(message)}
-
-	for i, handler := range handlers {
-		// Get the number of optional parameters from the handler function type
-		handlerType := reflect.TypeOf(handler)
-		numOptParams := handlerType.NumIn() - 3 // Subtract 3 for e, wsCtx, message params
-
-		// Add optional parameters
-		for j := 0; j < numOptParams; j++ {
-			// 如果args容量不够就扩大
-			if len(args)-3 <= j {
-				args = append(args, reflect.ValueOf(parameters[i][j]))
-			} else {
-				args[j+3] = reflect.ValueOf(parameters[i][j])
-			}
-		}
-
-		// Call the handler with the prepared arguments
-		result := reflect.ValueOf(handler).Call(args)
-
-		// If the handler returns a message, use it for the next handler
-		if len(result) > 0 && !result[0].IsNil() {
-			message = result[0].Interface().(*Message)
-		}
+// UseSend 添加发送前的中间件
+func (e *Engine) UseSend(middlewares ...Middleware) {
+	e.SendMiddlewares = append(e.SendMiddlewares, middlewares...)
+}
+
+// UseReceive 添加接收后的中间件
+func (e *Engine) UseReceive(middlewares ...Middleware) {
+	e.ReceiveMiddlewares = append(e.ReceiveMiddlewares, middlewares...)
+}
+
+// runHandlers 依次执行中间件、旧版插件和 tail，最后执行 final，任何一环不调用 next 即截断
+func (e *Engine) runHandlers(wsCtx wsContext.WSContext, middlewares []Middleware, handlers []HandlersFunc,
+	parameters [][]any, message *Message, final Handler, tail ...Middleware) error {
+	if final == nil {
+		final = noop
 	}
+	chain := make([]Middleware, 0, len(middlewares)+len(handlers)+len(tail))
+	chain = append(chain, middlewares...)
+	chain = append(chain, adaptAll(handlers, parameters)...)
+	chain = append(chain, tail...)
+	return Chain(chain...)(final)(NewContext(e, wsCtx, message))
 }
 
-// RunSendHandlers 执行插件
-func (e *Engine) RunSendHandlers(wsCtx wsContext.WSContext, message *Message) {
-	e.runHandlers(wsCtx, e.SendHandlers, &e.SendParameters, message)
+// RunSendHandlers 执行发送前的插件、Router 和 RPC，final 为真正的转发逻辑，first 在所有发送中间件之前执行
+func (e *Engine) RunSendHandlers(wsCtx wsContext.WSContext, message *Message, final Handler, first ...Middleware) error {
+	var tail []Middleware
+	if e.Router != nil {
+		tail = append(tail, e.Router.Middleware())
+	}
+	tail = append(tail, e.rpcMiddleware())
+	middlewares := e.SendMiddlewares
+	if len(first) > 0 {
+		middlewares = append(first[:len(first):len(first)], e.SendMiddlewares...)
+	}
+	return e.runHandlers(wsCtx, middlewares, e.SendHandlers, e.SendParameters, message, final, tail...)
 }
-func (e *Engine) RunReceiverHandlers(wsCtx wsContext.WSContext, message *Message) {
-	e.runHandlers(wsCtx, e.ReceiveHandlers, &e.ReceiveParameters, message)
+
+// RunReceiverHandlers 执行接收后的插件，final 为真正的投递逻辑
+func (e *Engine) RunReceiverHandlers(wsCtx wsContext.WSContext, message *Message, final Handler) error {
+	return e.runHandlers(wsCtx, e.ReceiveMiddlewares, e.ReceiveHandlers, e.ReceiveParameters, message, final)
 }
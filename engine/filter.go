@@ -0,0 +1,49 @@
+package engine
+
+import "slices"
+
+// 广播过滤操作
+const (
+	// FilterEq 元数据等于 Values[0]
+	FilterEq = "eq"
+	// FilterNe 元数据不等于 Values[0]，没有该元数据也算不等于
+	FilterNe = "ne"
+	// FilterIn 元数据是 Values 之一
+	FilterIn = "in"
+	// FilterExists 存在该元数据
+	FilterExists = "exists"
+)
+
+// Filter 按客户端元数据过滤，例如 {"key":"platform","op":"in","values":["ios","android"]}
+type Filter struct {
+	Key    string   `json:"key"`
+	Op     string   `json:"op"`
+	Values []string `json:"values,omitempty"`
+}
+
+// Match 元数据是否满足过滤条件，未知的操作视为不满足
+func (f Filter) Match(metadata map[string]string) bool {
+	value, ok := metadata[f.Key]
+	switch f.Op {
+	case FilterEq:
+		return ok && len(f.Values) > 0 && value == f.Values[0]
+	case FilterNe:
+		return !ok || len(f.Values) == 0 || value != f.Values[0]
+	case FilterIn:
+		return ok && slices.Contains(f.Values, value)
+	case FilterExists:
+		return ok
+	default:
+		return false
+	}
+}
+
+// MatchFilters 元数据是否满足所有过滤条件
+func MatchFilters(filters []Filter, metadata map[string]string) bool {
+	for _, f := range filters {
+		if !f.Match(metadata) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,38 @@
+package engine
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMatchFilters(t *testing.T) {
+	metadata := map[string]string{"platform": "ios", "tenant": "t1"}
+	tests := []struct {
+		name    string
+		filters []Filter
+		match   bool
+	}{
+		{name: "no filters", match: true},
+		{name: "eq", filters: []Filter{{Key: "platform", Op: FilterEq, Values: []string{"ios"}}}, match: true},
+		{name: "eq mismatch", filters: []Filter{{Key: "platform", Op: FilterEq, Values: []string{"web"}}}},
+		{name: "ne", filters: []Filter{{Key: "platform", Op: FilterNe, Values: []string{"web"}}}, match: true},
+		{name: "ne missing", filters: []Filter{{Key: "region", Op: FilterNe, Values: []string{"cn"}}}, match: true},
+		{name: "in", filters: []Filter{{Key: "platform", Op: FilterIn, Values: []string{"android", "ios"}}}, match: true},
+		{name: "exists missing", filters: []Filter{{Key: "region", Op: FilterExists}}},
+		{name: "unknown op", filters: []Filter{{Key: "platform", Op: "gt"}}},
+		{
+			name: "all must match",
+			filters: []Filter{
+				{Key: "platform", Op: FilterEq, Values: []string{"ios"}},
+				{Key: "tenant", Op: FilterEq, Values: []string{"t2"}},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, test.match, MatchFilters(test.filters, metadata))
+		})
+	}
+}
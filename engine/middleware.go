@@ -0,0 +1,119 @@
+package engine
+
+import (
+	"context"
+	"fmt"
+	"runtime/debug"
+
+	"github.com/WangSiangCun/go-ws/wsContext"
+)
+
+// Context 单条消息的上下文，在中间件之间传递
+type Context struct {
+	context.Context
+	Engine *Engine
+	WS     wsContext.WSContext
+	// Message 当前消息，中间件可以替换
+	Message *Message
+	// Disposition 消息的去向，默认转发
+	Disposition Disposition
+	// Reply Disposition 为 DispositionReply 时回复给发送方的消息
+	Reply *Message
+	// SenderId、SenderConnId 发送这条消息的用户和本节点上的连接，创建时从 Message 中取出，中间件替换 Message 后不变
+	// 服务端产生的消息和其他节点转发来的消息为空
+	SenderId     string
+	SenderConnId string
+
+	values map[string]any
+}
+
+// NewContext 创建消息上下文
+func NewContext(e *Engine, wsCtx wsContext.WSContext, message *Message) *Context {
+	ctx := wsCtx.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	c := &Context{
+		Context: ctx,
+		Engine:  e,
+		WS:      wsCtx,
+		Message: message,
+	}
+	if message != nil && message.SourceConnId != "" {
+		c.SenderId, c.SenderConnId = message.SourceId, message.SourceConnId
+	}
+	return c
+}
+
+// Set 保存只在这条消息内有效的值
+func (c *Context) Set(key string, value any) {
+	if c.values == nil {
+		c.values = make(map[string]any)
+	}
+	c.values[key] = value
+}
+
+// Get 读取 Set 保存的值
+func (c *Context) Get(key string) (any, bool) {
+	value, ok := c.values[key]
+	return value, ok
+}
+
+// Handler 处理一条消息
+type Handler func(c *Context) error
+
+// Middleware 包装下游的 Handler，可以在调用 next 前后做处理，不调用 next 即截断
+type Middleware func(next Handler) Handler
+
+// Chain 把多个中间件组合成一个，第一个在最外层
+func Chain(middlewares ...Middleware) Middleware {
+	return func(next Handler) Handler {
+		for i := len(middlewares) - 1; i >= 0; i-- {
+			next = middlewares[i](next)
+		}
+		return next
+	}
+}
+
+// Adapt 把旧的 HandlersFunc 适配成中间件，handler 返回非 nil 的消息会替换 c.Message
+func Adapt(handler HandlersFunc, opts ...any) Middleware {
+	return func(next Handler) Handler {
+		return func(c *Context) error {
+			if res := handler(c.Engine, c.WS, c.Message, opts...); res != nil {
+				c.Message = res
+			}
+			return next(c)
+		}
+	}
+}
+
+// Recover 把下游的 panic 转成 error
+func Recover() Middleware {
+	return func(next Handler) Handler {
+		return func(c *Context) (err error) {
+			defer func() {
+				if p := recover(); p != nil {
+					err = fmt.Errorf("handler panic: %v\n%s", p, debug.Stack())
+				}
+			}()
+			return next(c)
+		}
+	}
+}
+
+// adaptAll 适配 SetSendHandlers 设置的旧插件，parameters 不够时不传参数
+func adaptAll(handlers []HandlersFunc, parameters [][]any) []Middleware {
+	middlewares := make([]Middleware, 0, len(handlers))
+	for i, handler := range handlers {
+		var opts []any
+		if i < len(parameters) {
+			opts = parameters[i]
+		}
+		middlewares = append(middlewares, Adapt(handler, opts...))
+	}
+	return middlewares
+}
+
+func noop(*Context) error {
+	return nil
+}
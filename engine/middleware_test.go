@@ -0,0 +1,93 @@
+package engine
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/WangSiangCun/go-ws/config"
+	"github.com/WangSiangCun/go-ws/wsContext"
+	"github.com/stretchr/testify/assert"
+)
+
+func record(order *[]string, name string) Middleware {
+	return func(next Handler) Handler {
+		return func(c *Context) error {
+			*order = append(*order, name+" before")
+			err := next(c)
+			*order = append(*order, name+" after")
+			return err
+		}
+	}
+}
+
+func TestRunSendHandlers_Order(t *testing.T) {
+	e := NewEngine(config.NewStandaloneConfig("127.0.0.1", ":0", 60))
+	var order []string
+	e.UseSend(record(&order, "a"), record(&order, "b"))
+	e.SetSendHandlers([]HandlersFunc{func(e *Engine, wsCtx wsContext.WSContext, message *Message, opts ...any) *Message {
+		order = append(order, "legacy")
+		return &Message{Message: "replaced"}
+	}})
+
+	var got *Context
+	err := e.RunSendHandlers(wsContext.WSContext{}, &Message{Message: "hi", SourceId: "u1", SourceConnId: "c1"}, func(c *Context) error {
+		order = append(order, "final")
+		got = c
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a before", "b before", "legacy", "final", "b after", "a after"}, order)
+	assert.Equal(t, "replaced", got.Message.Message)
+	// 替换消息后发送方不变
+	assert.Equal(t, "u1", got.SenderId)
+	assert.Equal(t, "c1", got.SenderConnId)
+}
+
+func TestRunSendHandlers_ShortCircuit(t *testing.T) {
+	e := NewEngine(config.NewStandaloneConfig("127.0.0.1", ":0", 60))
+	wantErr := errors.New("rejected")
+	e.UseSend(func(next Handler) Handler {
+		return func(c *Context) error {
+			return wantErr
+		}
+	})
+	called := false
+	err := e.RunSendHandlers(wsContext.WSContext{}, &Message{}, func(c *Context) error {
+		called = true
+		return nil
+	})
+	assert.ErrorIs(t, err, wantErr)
+	assert.False(t, called)
+}
+
+func TestRunReceiverHandlers_MissingParameters(t *testing.T) {
+	e := NewEngine(config.NewStandaloneConfig("127.0.0.1", ":0", 60))
+	var opts [][]any
+	handler := func(e *Engine, wsCtx wsContext.WSContext, message *Message, o ...any) *Message {
+		opts = append(opts, o)
+		return nil
+	}
+	e.SetReceiverHandlers([]HandlersFunc{handler, handler})
+	e.SetReceiverParameters([][]any{{1}})
+
+	assert.NoError(t, e.RunReceiverHandlers(wsContext.WSContext{}, &Message{}, nil))
+	assert.Equal(t, [][]any{{1}, nil}, opts)
+}
+
+func TestRecover(t *testing.T) {
+	h := Chain(Recover())(func(c *Context) error {
+		panic("boom")
+	})
+	err := h(NewContext(nil, wsContext.WSContext{}, &Message{}))
+	assert.ErrorContains(t, err, "boom")
+}
+
+func TestContext_Values(t *testing.T) {
+	c := NewContext(nil, wsContext.WSContext{}, &Message{})
+	_, ok := c.Get("user")
+	assert.False(t, ok)
+	c.Set("user", "u1")
+	value, ok := c.Get("user")
+	assert.True(t, ok)
+	assert.Equal(t, "u1", value)
+}
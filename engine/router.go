@@ -0,0 +1,172 @@
+package engine
+
+import (
+	"fmt"
+	"reflect"
+	"runtime"
+	"sort"
+)
+
+// Router 按 Message.Type 把发送的消息分给注册的 Handler，作为最后一个发送中间件执行
+// 路由需要在 Hub.Run 之前注册好，运行中不能再修改
+type Router struct {
+	exact    map[int64]*route
+	ranges   []*route
+	fallback *route
+}
+
+type route struct {
+	min, max int64
+	// handler 套上路由中间件之后的处理函数，raw 为注册的处理函数
+	handler Handler
+	raw     Handler
+	chain   Middleware
+	info    RouteInfo
+}
+
+// RouteInfo 已注册的路由，用于排查问题
+type RouteInfo struct {
+	// Min Max 匹配的类型区间，单个类型时相等
+	Min, Max int64
+	// Default 是否是兜底路由，此时忽略 Min Max
+	Default bool
+	// Middlewares 路由自己的中间件个数
+	Middlewares int
+	// Handler 处理函数名
+	Handler string
+}
+
+func (info RouteInfo) String() string {
+	var match string
+	switch {
+	case info.Default:
+		match = "default"
+	case info.Min == info.Max:
+		match = fmt.Sprintf("type %d", info.Min)
+	default:
+		match = fmt.Sprintf("type %d..%d", info.Min, info.Max)
+	}
+	return fmt.Sprintf("%s -> %s (%d middlewares)", match, info.Handler, info.Middlewares)
+}
+
+// NewRouter 创建空路由，没有匹配的消息原样转发
+func NewRouter() *Router {
+	return &Router{exact: make(map[int64]*route)}
+}
+
+// Handle 注册 typ 类型消息的处理函数，middlewares 只对这个路由生效，重复注册会 panic
+func (r *Router) Handle(typ int64, handler Handler, middlewares ...Middleware) {
+	if _, ok := r.exact[typ]; ok {
+		panic(fmt.Sprintf("engine: multiple handlers for type %d", typ))
+	}
+	r.exact[typ] = newRoute(typ, typ, handler, middlewares)
+}
+
+// HandleRange 注册 [min, max] 区间内类型的处理函数，Handle 注册的单个类型优先，区间重叠时先注册的优先
+func (r *Router) HandleRange(min, max int64, handler Handler, middlewares ...Middleware) {
+	if min > max {
+		panic(fmt.Sprintf("engine: invalid type range %d..%d", min, max))
+	}
+	r.ranges = append(r.ranges, newRoute(min, max, handler, middlewares))
+}
+
+// Default 注册没有匹配路由时的兜底处理函数，不处理小于 0 的保留类型
+func (r *Router) Default(handler Handler, middlewares ...Middleware) {
+	r.fallback = newRoute(0, 0, handler, middlewares)
+}
+
+// Routes 已注册的路由，按类型排序，兜底路由在最后
+func (r *Router) Routes() []RouteInfo {
+	routes := make([]RouteInfo, 0, len(r.exact)+len(r.ranges)+1)
+	for _, rt := range r.exact {
+		routes = append(routes, rt.info)
+	}
+	for _, rt := range r.ranges {
+		routes = append(routes, rt.info)
+	}
+	sort.SliceStable(routes, func(i, j int) bool {
+		if routes[i].Min != routes[j].Min {
+			return routes[i].Min < routes[j].Min
+		}
+		return routes[i].Max < routes[j].Max
+	})
+	if r.fallback != nil {
+		info := r.fallback.info
+		info.Default = true
+		routes = append(routes, info)
+	}
+	return routes
+}
+
+// Match 找到 typ 对应的路由，没有时返回 nil
+func (r *Router) Match(typ int64) Handler {
+	if rt := r.match(typ); rt != nil {
+		return rt.handler
+	}
+	return nil
+}
+
+// Middleware 把路由当成中间件，匹配到的 Handler 执行成功后继续执行 next，由 Disposition 决定是否转发
+// 路由自己的中间件包在 Handler 和 next 外面，不调用 next 时消息不会继续处理
+func (r *Router) Middleware() Middleware {
+	return func(next Handler) Handler {
+		return func(c *Context) error {
+			if c.Message == nil {
+				return next(c)
+			}
+			rt := r.match(c.Message.Type)
+			if rt == nil {
+				return next(c)
+			}
+			return rt.chain(func(c *Context) error {
+				if err := rt.raw(c); err != nil {
+					return err
+				}
+				return next(c)
+			})(c)
+		}
+	}
+}
+
+func (r *Router) match(typ int64) *route {
+	if rt, ok := r.exact[typ]; ok {
+		return rt
+	}
+	for _, rt := range r.ranges {
+		if typ >= rt.min && typ <= rt.max {
+			return rt
+		}
+	}
+	if typ < 0 {
+		// 保留的控制类型由服务端处理，不走兜底路由
+		return nil
+	}
+	return r.fallback
+}
+
+func newRoute(min, max int64, handler Handler, middlewares []Middleware) *route {
+	if handler == nil {
+		panic("engine: nil handler")
+	}
+	chain := Chain(middlewares...)
+	return &route{
+		min:     min,
+		max:     max,
+		handler: chain(handler),
+		raw:     handler,
+		chain:   chain,
+		info: RouteInfo{
+			Min:         min,
+			Max:         max,
+			Middlewares: len(middlewares),
+			Handler:     funcName(handler),
+		},
+	}
+}
+
+func funcName(fn any) string {
+	if f := runtime.FuncForPC(reflect.ValueOf(fn).Pointer()); f != nil {
+		return f.Name()
+	}
+	return "unknown"
+}
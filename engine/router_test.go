@@ -0,0 +1,113 @@
+package engine
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/WangSiangCun/go-ws/config"
+	"github.com/WangSiangCun/go-ws/wsContext"
+	"github.com/stretchr/testify/assert"
+)
+
+func named(name string, got *string) Handler {
+	return func(c *Context) error {
+		*got = name
+		return nil
+	}
+}
+
+func TestRouter_Match(t *testing.T) {
+	var got string
+	r := NewRouter()
+	r.Handle(1, named("chat", &got))
+	r.HandleRange(0, 10, named("range", &got))
+	r.HandleRange(5, 20, named("overlap", &got))
+
+	tests := []struct {
+		typ  int64
+		want string
+	}{
+		{typ: 1, want: "chat"},
+		{typ: 2, want: "range"},
+		{typ: 15, want: "overlap"},
+		{typ: 30, want: ""},
+	}
+	for _, test := range tests {
+		got = ""
+		if handler := r.Match(test.typ); handler != nil {
+			assert.NoError(t, handler(nil))
+		}
+		assert.Equal(t, test.want, got, "type %d", test.typ)
+	}
+
+	r.Default(named("default", &got))
+	assert.NoError(t, r.Match(30)(nil))
+	assert.Equal(t, "default", got)
+}
+
+func TestRouter_Panics(t *testing.T) {
+	r := NewRouter()
+	r.Handle(1, noop)
+	assert.Panics(t, func() { r.Handle(1, noop) })
+	assert.Panics(t, func() { r.HandleRange(2, 1, noop) })
+	assert.Panics(t, func() { r.Handle(2, nil) })
+}
+
+func TestRouter_Routes(t *testing.T) {
+	r := NewRouter()
+	r.Default(noop)
+	r.HandleRange(10, 20, noop, Recover())
+	r.Handle(3, noop)
+
+	routes := r.Routes()
+	assert.Len(t, routes, 3)
+	assert.Equal(t, "type 3 -> github.com/WangSiangCun/go-ws/engine.noop (0 middlewares)", routes[0].String())
+	assert.Equal(t, "type 10..20 -> github.com/WangSiangCun/go-ws/engine.noop (1 middlewares)", routes[1].String())
+	assert.True(t, routes[2].Default)
+}
+
+func TestRunSendHandlers_Router(t *testing.T) {
+	e := NewEngine(config.NewStandaloneConfig("127.0.0.1", ":0", 60))
+	var order []string
+	e.UseSend(record(&order, "global"))
+	e.Router.Handle(1, func(c *Context) error {
+		order = append(order, "handler")
+		c.Handled()
+		return nil
+	}, record(&order, "route"))
+	wantErr := errors.New("bad")
+	e.Router.Handle(2, func(c *Context) error {
+		return wantErr
+	})
+	e.Router.Handle(4, func(c *Context) error {
+		order = append(order, "handler")
+		return nil
+	}, func(next Handler) Handler {
+		return func(c *Context) error {
+			order = append(order, "deny")
+			return nil
+		}
+	})
+
+	var disposition Disposition
+	final := func(c *Context) error {
+		order = append(order, "final")
+		disposition = c.Disposition
+		return nil
+	}
+	assert.NoError(t, e.RunSendHandlers(wsContext.WSContext{}, &Message{Type: 1}, final))
+	assert.Equal(t, []string{"global before", "route before", "handler", "final", "route after", "global after"}, order)
+	assert.Equal(t, DispositionHandled, disposition)
+
+	// 路由中间件不调用 next 时 Handler 和后面的处理都不执行
+	order, disposition = nil, DispositionDrop
+	assert.NoError(t, e.RunSendHandlers(wsContext.WSContext{}, &Message{Type: 4}, final))
+	assert.Equal(t, []string{"global before", "deny", "global after"}, order)
+	assert.Equal(t, DispositionDrop, disposition)
+
+	// 没有匹配的路由照常转发
+	assert.NoError(t, e.RunSendHandlers(wsContext.WSContext{}, &Message{Type: 3}, final))
+	assert.Equal(t, DispositionForward, disposition)
+
+	assert.ErrorIs(t, e.RunSendHandlers(wsContext.WSContext{}, &Message{Type: 2}, final), wantErr)
+}
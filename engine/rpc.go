@@ -0,0 +1,162 @@
+package engine
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+)
+
+const defaultRPCTimeout = 10 * time.Second
+
+// RPC 错误码，和 HTTP 状态码含义一致
+const (
+	RPCBadRequest     = 400
+	RPCUnauthorized   = 401
+	RPCForbidden      = 403
+	RPCMethodNotFound = 404
+	RPCInternal       = 500
+	RPCTimeout        = 504
+)
+
+// RPCError RPC 调用失败时回复给客户端的错误
+type RPCError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// NewRPCError 创建 RPC 错误，RPCHandler 返回它时会原样回复给客户端
+func NewRPCError(code int, message string) *RPCError {
+	return &RPCError{Code: code, Message: message}
+}
+
+func (e *RPCError) Error() string {
+	return fmt.Sprintf("rpc error %d: %s", e.Code, e.Message)
+}
+
+// RPCHandler 处理一次 RPC 调用，result 为字符串时原样回复，否则编码成 JSON
+// 返回 *RPCError 时原样回复给客户端，其他错误只记录日志，回复 RPCInternal
+type RPCHandler func(c *Context) (result any, err error)
+
+// RPC 把强类型的函数适配成 RPCHandler，请求参数从 Message.Message 按 JSON 解码
+func RPC[Req, Res any](fn func(c *Context, req Req) (Res, error)) RPCHandler {
+	return func(c *Context) (any, error) {
+		var req Req
+		if c.Message.Message != "" {
+			if err := json.Unmarshal([]byte(c.Message.Message), &req); err != nil {
+				return nil, NewRPCError(RPCBadRequest, "invalid params: "+err.Error())
+			}
+		}
+		return fn(c, req)
+	}
+}
+
+// HandleRPC 注册 RPC 方法，客户端发送 {"type": TypeRPC, "request_id": "1", "method": method} 调用，重复注册会 panic
+func (e *Engine) HandleRPC(method string, handler RPCHandler) {
+	if handler == nil {
+		panic("engine: nil rpc handler")
+	}
+	if _, ok := e.rpcHandlers[method]; ok {
+		panic("engine: multiple rpc handlers for " + method)
+	}
+	e.rpcHandlers[method] = handler
+}
+
+// rpcMiddleware 执行 TypeRPC 请求并把结果回复给调用的连接，RPC 请求不会被转发
+func (e *Engine) rpcMiddleware() Middleware {
+	return func(next Handler) Handler {
+		return func(c *Context) error {
+			if c.Message == nil || c.Message.Type != TypeRPC {
+				return next(c)
+			}
+			c.ReplyWith(e.call(c))
+			return next(c)
+		}
+	}
+}
+
+type rpcResult struct {
+	result any
+	err    error
+}
+
+// call 在超时时间内执行 RPC 方法，返回回复消息
+func (e *Engine) call(c *Context) *Message {
+	request := c.Message
+	// 中间件可能替换了 c.Message，回复给创建上下文时的发送方
+	sourceId := c.SenderId
+	if sourceId == "" {
+		sourceId = request.SourceId
+	}
+	reply := &Message{
+		Type:      TypeRPC,
+		TargetIds: []string{sourceId},
+		RequestId: request.RequestId,
+		Method:    request.Method,
+	}
+	if request.RequestId == "" {
+		reply.Error = NewRPCError(RPCBadRequest, "missing request_id")
+		return reply
+	}
+	handler, ok := e.rpcHandlers[request.Method]
+	if !ok {
+		reply.Error = NewRPCError(RPCMethodNotFound, "method not found: "+request.Method)
+		return reply
+	}
+
+	ctx, cancel := context.WithTimeout(c.Context, e.RPCTimeout)
+	defer cancel()
+	// 超时后方法可能还在执行，给它一份自己的 Context，避免和回复同时修改
+	called := *c
+	called.Context = ctx
+	done := make(chan rpcResult, 1)
+	go func() {
+		defer func() {
+			if p := recover(); p != nil {
+				done <- rpcResult{err: fmt.Errorf("rpc %s panic: %v", request.Method, p)}
+			}
+		}()
+		result, err := handler(&called)
+		done <- rpcResult{result: result, err: err}
+	}()
+
+	select {
+	case <-ctx.Done():
+		reply.Error = NewRPCError(RPCTimeout, "rpc timeout")
+	case res := <-done:
+		if res.err != nil {
+			reply.Error = toRPCError(request.Method, res.err)
+			break
+		}
+		message, err := encodeResult(res.result)
+		if err != nil {
+			reply.Error = toRPCError(request.Method, err)
+			break
+		}
+		reply.Message = message
+	}
+	return reply
+}
+
+func toRPCError(method string, err error) *RPCError {
+	if rpcErr, ok := err.(*RPCError); ok {
+		return rpcErr
+	}
+	log.Printf("rpc %s error: %v", method, err)
+	return NewRPCError(RPCInternal, "internal error")
+}
+
+func encodeResult(result any) (string, error) {
+	switch result := result.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return result, nil
+	}
+	data, err := json.Marshal(result)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
@@ -0,0 +1,84 @@
+package engine
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/WangSiangCun/go-ws/config"
+	"github.com/WangSiangCun/go-ws/wsContext"
+	"github.com/stretchr/testify/assert"
+)
+
+type addRequest struct {
+	A int `json:"a"`
+	B int `json:"b"`
+}
+
+type addResponse struct {
+	Sum int `json:"sum"`
+}
+
+func callRPC(t *testing.T, e *Engine, request *Message) *Message {
+	var reply *Message
+	err := e.RunSendHandlers(wsContext.WSContext{}, request, func(c *Context) error {
+		assert.Equal(t, DispositionReply, c.Disposition)
+		reply = c.Reply
+		return nil
+	})
+	assert.NoError(t, err)
+	return reply
+}
+
+func TestHandleRPC(t *testing.T) {
+	e := NewEngine(config.NewStandaloneConfig("127.0.0.1", ":0", 60))
+	e.RPCTimeout = 50 * time.Millisecond
+	e.HandleRPC("add", RPC(func(c *Context, req addRequest) (addResponse, error) {
+		return addResponse{Sum: req.A + req.B}, nil
+	}))
+	e.HandleRPC("forbidden", func(c *Context) (any, error) {
+		return nil, NewRPCError(403, "forbidden")
+	})
+	e.HandleRPC("internal", func(c *Context) (any, error) {
+		return nil, errors.New("database is down")
+	})
+	e.HandleRPC("slow", func(c *Context) (any, error) {
+		<-c.Done()
+		return "late", nil
+	})
+	e.HandleRPC("panic", func(c *Context) (any, error) {
+		panic("boom")
+	})
+	assert.Panics(t, func() { e.HandleRPC("add", func(c *Context) (any, error) { return nil, nil }) })
+
+	reply := callRPC(t, e, &Message{Type: TypeRPC, SourceId: "u1", RequestId: "1", Method: "add", Message: `{"a":1,"b":2}`})
+	assert.Equal(t, &Message{Type: TypeRPC, TargetIds: []string{"u1"}, RequestId: "1", Method: "add", Message: `{"sum":3}`}, reply)
+
+	tests := []struct {
+		name    string
+		request *Message
+		want    *RPCError
+	}{
+		{name: "bad params", request: &Message{RequestId: "2", Method: "add", Message: "{"}, want: &RPCError{Code: RPCBadRequest}},
+		{name: "missing request id", request: &Message{Method: "add"}, want: &RPCError{Code: RPCBadRequest, Message: "missing request_id"}},
+		{name: "not found", request: &Message{RequestId: "3", Method: "nope"}, want: &RPCError{Code: RPCMethodNotFound, Message: "method not found: nope"}},
+		{name: "rpc error", request: &Message{RequestId: "4", Method: "forbidden"}, want: &RPCError{Code: 403, Message: "forbidden"}},
+		{name: "internal", request: &Message{RequestId: "5", Method: "internal"}, want: &RPCError{Code: RPCInternal, Message: "internal error"}},
+		{name: "timeout", request: &Message{RequestId: "6", Method: "slow"}, want: &RPCError{Code: RPCTimeout, Message: "rpc timeout"}},
+		{name: "panic", request: &Message{RequestId: "7", Method: "panic"}, want: &RPCError{Code: RPCInternal, Message: "internal error"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			test.request.Type = TypeRPC
+			reply := callRPC(t, e, test.request)
+			assert.Equal(t, test.request.RequestId, reply.RequestId)
+			assert.Empty(t, reply.Message)
+			if assert.NotNil(t, reply.Error) {
+				assert.Equal(t, test.want.Code, reply.Error.Code)
+				if test.want.Message != "" {
+					assert.Equal(t, test.want.Message, reply.Error.Message)
+				}
+			}
+		})
+	}
+}
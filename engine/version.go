@@ -0,0 +1,34 @@
+package engine
+
+// 消息格式版本，连接时通过 version 参数协商
+const (
+	// Version1 最初的格式，没有 Timestamp、Headers 和 ContentType
+	Version1 = 1
+	// Version2 带 Version、Timestamp、Headers 和 ContentType
+	Version2 = 2
+	// LatestVersion 服务端支持的最高版本
+	LatestVersion = Version2
+)
+
+// NegotiateVersion 客户端请求的版本和服务端支持的最高版本取较小值，没有请求或者不合法时为 Version1
+func NegotiateVersion(requested int) int {
+	if requested < Version1 {
+		return Version1
+	}
+	return min(requested, LatestVersion)
+}
+
+// ForVersion 按连接的版本返回要发给客户端的消息，v1 去掉新增的字段，不修改原消息
+func (m *Message) ForVersion(version int) *Message {
+	copied := *m
+	copied.ConnIds = nil
+	if version < Version2 {
+		copied.Version = 0
+		copied.Timestamp = 0
+		copied.Headers = nil
+		copied.ContentType = ""
+		return &copied
+	}
+	copied.Version = version
+	return &copied
+}
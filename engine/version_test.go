@@ -0,0 +1,40 @@
+package engine
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNegotiateVersion(t *testing.T) {
+	assert.Equal(t, Version1, NegotiateVersion(0))
+	assert.Equal(t, Version1, NegotiateVersion(-1))
+	assert.Equal(t, Version1, NegotiateVersion(1))
+	assert.Equal(t, Version2, NegotiateVersion(2))
+	assert.Equal(t, LatestVersion, NegotiateVersion(99))
+}
+
+func TestMessage_ForVersion(t *testing.T) {
+	message := &Message{
+		Id:          "m1",
+		Message:     "hi",
+		ConnIds:     []string{"c1"},
+		Timestamp:   1,
+		Headers:     map[string]string{"trace": "t1"},
+		ContentType: "text/plain",
+	}
+
+	v1 := message.ForVersion(Version1)
+	assert.Equal(t, &Message{Id: "m1", Message: "hi"}, v1)
+
+	v2 := message.ForVersion(Version2)
+	assert.Equal(t, Version2, v2.Version)
+	assert.Equal(t, int64(1), v2.Timestamp)
+	assert.Equal(t, "text/plain", v2.ContentType)
+	assert.Equal(t, map[string]string{"trace": "t1"}, v2.Headers)
+	assert.Nil(t, v2.ConnIds)
+
+	// 不修改原消息
+	assert.Equal(t, []string{"c1"}, message.ConnIds)
+	assert.Equal(t, 0, message.Version)
+}
@@ -0,0 +1,90 @@
+package hub
+
+import (
+	"log"
+	"time"
+)
+
+const (
+	// ackTimeout 客户端在这个时间内没有确认就重发
+	ackTimeout = 10 * time.Second
+	// maxRetransmits 最多重发次数，之后放弃这条消息
+	maxRetransmits = 3
+	// maxUnacked 每个连接最多保留的未确认消息，满了丢弃最早的
+	maxUnacked = 256
+)
+
+// unacked 已发给客户端但还没有确认的消息
+type unacked struct {
+	data     []byte
+	sentAt   time.Time
+	attempts int
+	// seq 第一次发送的顺序，断开时按这个顺序保存为离线消息
+	seq uint64
+}
+
+// deliver 把消息写给客户端，补发历史和离线消息期间先暂存
+func (c *Client) deliver(id string, seq uint64, data []byte) {
+	c.replayMu.Lock()
+	if c.replaying {
+		c.held = append(c.held, outgoing{id: id, seq: seq, data: data})
+		c.replayMu.Unlock()
+		return
+	}
+	c.replayMu.Unlock()
+	c.write(id, data)
+}
+
+// write 写给客户端，开启确认的连接会记录消息直到客户端确认
+func (c *Client) write(id string, data []byte) {
+	if c.ackEnabled && id != "" {
+		c.track(id, data)
+	}
+	c.enqueue(data)
+}
+
+func (c *Client) track(id string, data []byte) {
+	c.ackMu.Lock()
+	defer c.ackMu.Unlock()
+	if _, ok := c.unacked[id]; !ok && len(c.unacked) >= maxUnacked {
+		oldestId := ""
+		var oldest *unacked
+		for pendingId, pending := range c.unacked {
+			if oldest == nil || pending.seq < oldest.seq {
+				oldestId, oldest = pendingId, pending
+			}
+		}
+		delete(c.unacked, oldestId)
+		log.Printf("%s too many unacked messages, drop %s", c.ConnId, oldestId)
+	}
+	c.ackSeq++
+	c.unacked[id] = &unacked{data: data, sentAt: time.Now(), seq: c.ackSeq}
+}
+
+// ack 客户端确认收到 id
+func (c *Client) ack(id string) {
+	c.ackMu.Lock()
+	defer c.ackMu.Unlock()
+	delete(c.unacked, id)
+}
+
+// expired 返回超时需要重发的消息，超过重发次数的直接放弃
+func (c *Client) expired(now time.Time) [][]byte {
+	c.ackMu.Lock()
+	defer c.ackMu.Unlock()
+	var resend [][]byte
+	for id, pending := range c.unacked {
+		if now.Sub(pending.sentAt) < ackTimeout {
+			continue
+		}
+		if pending.attempts >= maxRetransmits {
+			delete(c.unacked, id)
+			log.Printf("%s message %s not acked after %d retransmits", c.ConnId, id, pending.attempts)
+			continue
+		}
+		pending.attempts++
+		pending.sentAt = now
+		resend = append(resend, pending.data)
+	}
+	return resend
+}
@@ -0,0 +1,61 @@
+package hub
+
+import (
+	"errors"
+	"log"
+
+	"github.com/WangSiangCun/go-ws/auth"
+	"github.com/WangSiangCun/go-ws/engine"
+	"github.com/WangSiangCun/go-ws/wsContext"
+)
+
+// authorize 按 Engine.Authorizer 检查客户端发来的消息，拒绝时给发送方回复 engine.TypeError 并返回 false
+// 发送方取自 Context.SenderConnId，中间件替换 c.Message 不会跳过检查；服务端产生的消息没有发送方，不检查
+func (h *Hub) authorize(c *engine.Context) bool {
+	authorizer := c.Engine.Authorizer
+	if authorizer == nil || c.SenderConnId == "" || c.Message == nil {
+		return true
+	}
+	sender, ok := h.Clients.Get(c.SenderConnId)
+	if !ok {
+		// 发送方已经断开，无法检查也无法回复
+		log.Printf("authorize: sender %s is gone, drop message %s", c.SenderConnId, c.Message.Id)
+		return false
+	}
+	identity := sender.Identity()
+	if identity == nil {
+		identity = &auth.Identity{UserId: sender.Id}
+	}
+	err := authorizer.Authorize(c, identity)
+	if err == nil {
+		return true
+	}
+	var rpcErr *engine.RPCError
+	if !errors.As(err, &rpcErr) {
+		// 查询黑名单、租户等失败，不把内部错误发给客户端
+		log.Printf("authorize %s message %s: %v", sender.Id, c.Message.Id, err)
+		rpcErr = engine.NewRPCError(engine.RPCInternal, "authorization failed")
+	}
+	reject := &engine.Message{Type: engine.TypeError, TargetIds: []string{sender.Id}, RequestId: c.Message.RequestId, Error: rpcErr}
+	if err := h.reply(sender.ConnId, reject); err != nil {
+		log.Printf("reject %s message %s: %v", sender.Id, c.Message.Id, err)
+	}
+	return false
+}
+
+// authorizeFirst 作为第一个发送中间件检查客户端发来的消息，被中间件、路由处理或者直接回复的消息也要检查
+func (h *Hub) authorizeFirst(next engine.Handler) engine.Handler {
+	return func(c *engine.Context) error {
+		if !h.authorize(c) {
+			return nil
+		}
+		return next(c)
+	}
+}
+
+// authorizeControl 按 Engine.Authorizer 检查加入和退出房间，控制消息不经过发送中间件，发送方为 c
+func (c *Client) authorizeControl(ws wsContext.WSContext, e *engine.Engine, message *engine.Message) bool {
+	message.SourceId = c.Id
+	message.SourceConnId = c.ConnId
+	return c.Hub.authorize(engine.NewContext(e, ws, message))
+}
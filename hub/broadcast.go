@@ -0,0 +1,43 @@
+package hub
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/WangSiangCun/go-ws/engine"
+	"github.com/WangSiangCun/go-ws/wsContext"
+	"github.com/google/uuid"
+)
+
+// Broadcast 广播给所有在线节点上符合 filters 的客户端，每个节点只发布一次
+// 某个节点发布失败时继续发布其他节点，返回所有失败节点的错误
+func (h *Hub) Broadcast(ws wsContext.WSContext, message *engine.Message, e *engine.Engine, filters ...engine.Filter) error {
+	nodes, err := ws.Registry.Nodes(ws.Context)
+	if err != nil {
+		return err
+	}
+	toMessage := broadcastMessage(message, filters)
+	var errs []error
+	for _, node := range nodes {
+		if err = h.publish(ws, e, node, toMessage); err != nil {
+			errs = append(errs, fmt.Errorf("broadcast to %s: %w", node, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// BroadcastNode 只广播给 node 上符合 filters 的客户端
+func (h *Hub) BroadcastNode(ws wsContext.WSContext, node string, message *engine.Message, e *engine.Engine, filters ...engine.Filter) error {
+	return h.publish(ws, e, node, broadcastMessage(message, filters))
+}
+
+func broadcastMessage(message *engine.Message, filters []engine.Filter) *engine.Message {
+	toMessage := *message
+	if toMessage.Id == "" {
+		toMessage.Id = uuid.NewString()
+	}
+	toMessage.Broadcast = true
+	toMessage.TargetIds = nil
+	toMessage.Filters = append(append([]engine.Filter{}, message.Filters...), filters...)
+	return &toMessage
+}
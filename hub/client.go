@@ -1,45 +1,31 @@
 package hub
 
 import (
-	"encoding/json"
 	"fmt"
+	"github.com/WangSiangCun/go-ws/auth"
+	"github.com/WangSiangCun/go-ws/codec"
+	"github.com/WangSiangCun/go-ws/config"
 	"github.com/WangSiangCun/go-ws/engine"
-	"github.com/WangSiangCun/go-ws/rabbitMQService"
 	"github.com/WangSiangCun/go-ws/wsContext"
+	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
-	"github.com/zeromicro/go-zero/core/logx"
-	clientv3 "go.etcd.io/etcd/client/v3"
 	"log"
 	"net/http"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
-const (
-	// Time allowed to write a message to the peer.
-	writeWait = 10 * time.Second
-
-	// Time allowed to read the next pong message from the peer.
-	pongWait = 60 * time.Second
-
-	// Send pings to peer with this period. Must be less than pongWait.
-	pingPeriod = (pongWait * 9) / 10
-
-	// Maximum message size allowed from peer.
-	maxMessageSize = 2048
-
-	// send buffer size
-	bufSize = 2048
-)
+// CloseKicked 被同一个用户的新设备踢下线时的关闭码
+const CloseKicked = 4001
 
 var (
 	newline = []byte{'\n'}
 	space   = []byte{' '}
 )
 
+// upGrader 缓冲区大小按 config.Connection 设置
 var upGrader = websocket.Upgrader{
-	ReadBufferSize:  1024,
-	WriteBufferSize: 1024,
 	CheckOrigin: func(r *http.Request) bool {
 		return true
 	},
@@ -54,55 +40,131 @@ type Client struct {
 	WriteChannel chan []byte // 用于发送给客户端的channel，消息发到这里面，websocket会从channel里读取消息并发送给客户端
 	ReadChannel  chan []byte // 用于服务端接收端的channel，websocket会从客户端读消息并发到这个channel
 
-	// Buffered channel of outbound messages.
+	// Id 用户 id，同一个用户可以有多个连接
 	Id string
+	// ConnId 连接 id，每个连接（设备）唯一
+	ConnId string
+	// ConnectedAt 连接建立时间，DevicePolicy 为 latest 和 kick-old 时用来比较新旧
+	ConnectedAt time.Time
 
 	ToOffline chan bool
 
-	LeaseId *clientv3.LeaseID
+	// identity 认证的身份，Id 为 identity.UserId，authenticator 用来验证 engine.TypeReauth 的新 token
+	authMu        sync.Mutex
+	identity      *auth.Identity
+	authenticator auth.Authenticator
+	// reauthed 更换 token 后通知 watchExpiry
+	reauthed chan struct{}
+
+	// Metadata 客户端元数据，广播时按 engine.Filter 过滤
+	Metadata map[string]string
+	// Version 连接协商的消息格式版本，见 engine.NegotiateVersion
+	Version int
+	// Codec 连接协商的编码，见 codec.Negotiate，二进制编码使用二进制帧
+	Codec codec.Codec
+	// settings 连接参数，见 config.Connection.ForRoute
+	settings config.Connection
+	// writeConfig 写给客户端的方式，见 config.Write
+	writeConfig config.Write
+	// compression 压缩配置，wire 为 nil 时这个连接没有协商压缩
+	compression config.Compression
+	wire        *countingConn
+	compressed  compressionCounter
+	// overflowed 消息队列满的次数，evicted 因为消息队列满已经被断开
+	overflowed overflowCounter
+	evicted    atomic.Bool
+
+	// registered 第一次注册在线状态后关闭，之后才处理客户端发来的消息
+	registered chan struct{}
+	closeOnce  sync.Once
+	// closed 连接关闭时关闭，writePump 写完队列中的消息后发送 closeMessage
+	closed       chan struct{}
+	closeMessage []byte
+	// unregistered RegisterClient 注销在线状态后关闭
+	unregistered chan struct{}
+
+	// ackEnabled 客户端连接时带上 ack=1，收到消息后需要发送 TypeAck 确认，否则会重发
+	ackEnabled bool
+	ackMu      sync.Mutex
+	unacked    map[string]*unacked
+	ackSeq     uint64
 
-	SendHandlers    []func(msg *engine.Message) *engine.Message
-	ReceiveHandlers []func(msg *engine.Message) *engine.Message
+	// resume 客户端连接时带上了 seq，resumeSeq 为收到的最大序号
+	resume    bool
+	resumeSeq uint64
+	// replaying 正在补发历史和离线消息，新消息暂存在 held 中
+	replayMu  sync.Mutex
+	replaying bool
+	held      []outgoing
 }
 
-// readPump pumps messages from the websocket connection to the hub.
-//
-// The application runs readPump in a per-connection goroutine. The application
-// ensures that there is at most one reader on a connection by executing all
-// reads from this goroutine.
-var unOnlineMutex sync.Mutex
+// outgoing 暂存的待发送消息
+type outgoing struct {
+	id   string
+	seq  uint64
+	data []byte
+}
 
+// NewClient 使用默认的连接参数创建客户端
 func NewClient(hub *Hub, conn *websocket.Conn, id string) *Client {
+	return newClient(hub, conn, id, config.DefaultConnection())
+}
+
+func newClient(hub *Hub, conn *websocket.Conn, id string, settings config.Connection) *Client {
 	client := &Client{
-		Hub:             hub,
-		Conn:            conn,
-		WriteChannel:    make(chan []byte, bufSize),
-		ReadChannel:     make(chan []byte, bufSize),
-		Id:              id,
-		ToOffline:       make(chan bool),
-		SendHandlers:    []func(msg *engine.Message) *engine.Message{},
-		ReceiveHandlers: []func(msg *engine.Message) *engine.Message{},
+		Hub:          hub,
+		Conn:         conn,
+		WriteChannel: make(chan []byte, settings.SendBuffer),
+		ReadChannel:  make(chan []byte, settings.SendBuffer),
+		Id:           id,
+		ConnId:       uuid.NewString(),
+		ConnectedAt:  time.Now(),
+		ToOffline:    make(chan bool),
+		Metadata:     map[string]string{},
+		Version:      engine.Version1,
+		Codec:        codec.JSON,
+		settings:     settings,
+		writeConfig:  config.DefaultWrite(),
+		registered:   make(chan struct{}),
+		closed:       make(chan struct{}),
+		unregistered: make(chan struct{}),
+		reauthed:     make(chan struct{}, 1),
+		unacked:      make(map[string]*unacked),
 	}
 	return client
 }
 func (c *Client) Close() {
+	// 被踢下线后 readPump 还会再调用一次，只执行一次
+	c.closeOnce.Do(c.close)
+}
+func (c *Client) close() {
 	//断开链接默认会走这里
 	fmt.Println("exit")
-	unOnlineMutex.Lock() //加锁，避免不同步
-	// 通知hub下线
+	// 通知hub下线，closeOnce 保证每个连接只执行一次
 	c.Hub.Unregister <- c
-	// 通知etcd离线
-	c.ToOffline <- true
-	// 关闭写channel
-	close(c.WriteChannel)
-	close(c.ReadChannel)
-	unOnlineMutex.Unlock()
-	c.Conn.Close()
+	// 通知etcd离线，关闭而不是发送，RegisterClient 还没开始或者已经退出时也不会阻塞
+	close(c.ToOffline)
+	// 通知读写协程退出，连接由 writePump 发送关闭帧后关闭
+	close(c.closed)
+}
+
+// Kick 写完队列中的消息，发送关闭帧后断开连接
+func (c *Client) Kick(code int, reason string) {
+	c.closeOnce.Do(func() {
+		c.closeMessage = websocket.FormatCloseMessage(code, reason)
+		c.close()
+	})
 }
+
+// readPump pumps messages from the websocket connection to the hub.
+//
+// The application runs readPump in a per-connection goroutine. The application
+// ensures that there is at most one reader on a connection by executing all
+// reads from this goroutine.
 func (c *Client) readPump(wsContext wsContext.WSContext) {
-	c.Conn.SetReadLimit(maxMessageSize)
-	c.Conn.SetReadDeadline(time.Now().Add(pongWait))
-	c.Conn.SetPongHandler(func(string) error { c.Conn.SetReadDeadline(time.Now().Add(pongWait)); return nil })
+	c.Conn.SetReadLimit(c.settings.MaxMessageSize)
+	c.Conn.SetReadDeadline(time.Now().Add(c.pongWait()))
+	c.Conn.SetPongHandler(func(string) error { c.Conn.SetReadDeadline(time.Now().Add(c.pongWait())); return nil })
 	for {
 
 		_, messageByte, err := c.Conn.ReadMessage()
@@ -115,90 +177,156 @@ func (c *Client) readPump(wsContext wsContext.WSContext) {
 			return
 		}
 
-		c.ReadChannel <- messageByte
+		select {
+		case c.ReadChannel <- messageByte:
+		case <-c.closed:
+			return
+		}
 
 	}
 }
 func (c *Client) writePump(wsContext wsContext.WSContext) {
-	ticker := time.NewTicker(pingPeriod)
+	ticker := time.NewTicker(c.pingPeriod())
+	// 没有开启确认的连接不重发
+	var retransmit <-chan time.Time
+	if c.ackEnabled {
+		retransmitTicker := time.NewTicker(ackTimeout / 2)
+		defer retransmitTicker.Stop()
+		retransmit = retransmitTicker.C
+	}
 	defer func() {
 		ticker.Stop()
 		c.Conn.Close()
 	}()
 
+	frameType := websocket.TextMessage
+	if c.Codec.Binary() {
+		frameType = websocket.BinaryMessage
+	}
+
 	for {
 		select {
-		case message, ok := <-c.WriteChannel:
-			c.Conn.SetWriteDeadline(time.Now().Add(writeWait))
-			if !ok {
-				// The hub closed the channel.
-				c.Conn.WriteMessage(websocket.CloseMessage, []byte{})
+		case message := <-c.WriteChannel:
+			// 按 Write.Strategy 合并队列中的消息
+			if err := c.writeBatch(frameType, c.collect(message)); err != nil {
 				return
 			}
-
-			w, err := c.Conn.NextWriter(websocket.TextMessage)
-			if err != nil {
-				return
-			}
-			w.Write(message)
-
-			// Add queued chat messages to the current websocket message.
-			n := len(c.WriteChannel)
-			for i := 0; i < n; i++ {
-				w.Write(newline)
-				w.Write(<-c.WriteChannel)
-			}
-
-			if err := w.Close(); err != nil {
+		case <-c.closed:
+			// 先写完队列中的消息，再发送关闭帧
+			if err := c.flush(frameType); err != nil {
 				return
 			}
+			c.Conn.WriteControl(websocket.CloseMessage, c.closeMessage, time.Now().Add(c.writeWait()))
+			return
 		case <-ticker.C:
-			c.Conn.SetWriteDeadline(time.Now().Add(writeWait))
+			c.Conn.SetWriteDeadline(time.Now().Add(c.writeWait()))
 			if err := c.Conn.WriteMessage(websocket.PingMessage, nil); err != nil {
 				return
 			}
+		case now := <-retransmit:
+			if resend := c.expired(now); len(resend) > 0 {
+				if err := c.writeBatch(frameType, resend); err != nil {
+					return
+				}
+			}
 		}
 	}
 
 }
 func (c *Client) SendMessage(wsContext wsContext.WSContext, e *engine.Engine) {
+	<-c.registered
 	for {
 		select {
-		case messageByte, ok := <-c.ReadChannel:
-			if !ok {
-				logx.Error("SendMessage !ok	" + string(messageByte))
-			}
+		case <-c.closed:
+			return
+		case messageByte := <-c.ReadChannel:
 			message := &engine.Message{}
-			err := json.Unmarshal(messageByte, message)
+			err := c.Codec.Unmarshal(messageByte, message)
 			if err != nil {
 				log.Printf("error: %v", err)
 				return
 			}
-			// 进入中转中心
-			c.Hub.SendChannel <- message
+			// 控制消息由服务端处理，不进入中转中心
+			if c.handleControl(wsContext, e, message) {
+				continue
+			}
+			// 进入中转中心，消息 id 由服务端分配，发送方为认证的用户，客户端填写的 source_id 会被覆盖
+			message.Id = uuid.NewString()
+			message.SourceId = c.Id
+			message.SourceConnId = c.ConnId
+			// 序号只由服务端分配，客户端填写的会让消息绕过用户的投递队列
+			message.Seq = 0
+			// 错误和版本只由服务端填写，客户端不能伪造 RPC 错误或者其他版本的消息
+			message.Error = nil
+			message.Version = 0
+			// 广播默认只能由服务端发起
+			if message.Broadcast && !e.Config.ClientBroadcast {
+				log.Printf("%s may not broadcast, message %s", c.Id, message.Id)
+				message.Broadcast = false
+			}
+			select {
+			case c.Hub.SendChannel <- message:
+			case <-c.closed:
+				return
+			}
 		}
 	}
 }
-func (c *Client) ReceiveMessage(wsContext wsContext.WSContext, e *engine.Engine) {
-	working, err := rabbitMQService.ReceiveWorking(wsContext.RabbitMQConnection, e.Config.Host+e.Config.WSPort)
-	if err != nil {
-		log.Panicln("启动接收错误")
+
+// writeWait 写一帧的超时时间
+func (c *Client) writeWait() time.Duration {
+	return time.Duration(c.settings.WriteWait) * time.Second
+}
+
+// pongWait 超过这个时间没有收到 pong 就断开
+func (c *Client) pongWait() time.Duration {
+	return time.Duration(c.settings.PongWait) * time.Second
+}
+
+// pingPeriod 发送 ping 的间隔，没有配置时取 pongWait 的 9/10
+func (c *Client) pingPeriod() time.Duration {
+	if c.settings.PingPeriod > 0 {
+		return time.Duration(c.settings.PingPeriod) * time.Second
 	}
-	for mqMessage := range working {
-		message := &engine.Message{}
-		err = json.Unmarshal(mqMessage.Body, message)
-		fmt.Println(string(mqMessage.Body))
-		//  执行插件
-		for _, msgHandler := range c.ReceiveHandlers {
-			message = msgHandler(message)
+	return c.pongWait() * 9 / 10
+}
+
+// encode 按连接协商的版本和编码生成发给客户端的帧
+func (c *Client) encode(message *engine.Message) ([]byte, error) {
+	return c.Codec.Marshal(message.ForVersion(c.Version))
+}
+
+// handleControl 处理控制消息，返回 false 表示是普通消息
+func (c *Client) handleControl(wsContext wsContext.WSContext, e *engine.Engine, message *engine.Message) bool {
+	var err error
+	switch message.Type {
+	case engine.TypeJoinRoom:
+		if c.authorizeControl(wsContext, e, message) {
+			err = c.Hub.JoinRoom(wsContext, message.Room, c.Id, c.ConnId)
 		}
-		//handler.ChatMessageHandler(ctx, message.Body)
-		//必须，否则会导致无法正常接收
-		err := mqMessage.Ack(false)
-		if err != nil {
-			fmt.Println(err)
+	case engine.TypeLeaveRoom:
+		if c.authorizeControl(wsContext, e, message) {
+			err = c.Hub.LeaveRoom(wsContext, message.Room, c.Id, c.ConnId)
+		}
+	case engine.TypeAck:
+		c.ack(message.Id)
+		return true
+	case engine.TypeReauth:
+		c.reauth(message)
+		return true
+	case engine.TypeRPC:
+		// RPC 请求经过发送中间件，由 Engine 回复给这个连接
+		return false
+	default:
+		if message.Type < 0 {
+			// 其他保留类型只能由服务端使用，直接丢弃
+			log.Printf("%s send reserved type %d", c.Id, message.Type)
+			return true
 		}
-		c.Hub.ReadChannel <- message
+		return false
 	}
-
+	if err != nil {
+		log.Printf("%s room %s error: %v", c.Id, message.Room, err)
+	}
+	return true
 }
@@ -0,0 +1,119 @@
+package hub
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+)
+
+// CompressionStats 压缩统计，WireBytes 包括帧头，Bytes 和 WireBytes 的差就是节省的流量
+type CompressionStats struct {
+	// Frames 压缩后写出的帧数
+	Frames uint64
+	// Bytes 压缩前的字节数
+	Bytes uint64
+	// WireBytes 压缩后实际写出的字节数
+	WireBytes uint64
+}
+
+// Saved 节省的字节数，压缩效果不好时可能为负数
+func (s CompressionStats) Saved() int64 {
+	return int64(s.Bytes) - int64(s.WireBytes)
+}
+
+type compressionCounter struct {
+	frames    atomic.Uint64
+	bytes     atomic.Uint64
+	wireBytes atomic.Uint64
+}
+
+func (c *compressionCounter) add(bytes, wireBytes uint64) {
+	c.frames.Add(1)
+	c.bytes.Add(bytes)
+	c.wireBytes.Add(wireBytes)
+}
+
+func (c *compressionCounter) stats() CompressionStats {
+	return CompressionStats{
+		Frames:    c.frames.Load(),
+		Bytes:     c.bytes.Load(),
+		WireBytes: c.wireBytes.Load(),
+	}
+}
+
+// CompressionStats 这个连接的压缩统计
+func (c *Client) CompressionStats() CompressionStats {
+	return c.compressed.stats()
+}
+
+// CompressionStats 本节点所有连接的压缩统计
+func (h *Hub) CompressionStats() CompressionStats {
+	return h.compressed.stats()
+}
+
+// writeFrame 写一帧，连接协商了压缩时按 Threshold 决定这一帧是否压缩，并记录压缩前后的字节数
+func (c *Client) writeFrame(size int, write func() error) error {
+	if c.wire == nil {
+		return write()
+	}
+	compress := size >= c.compression.Threshold
+	c.Conn.EnableWriteCompression(compress)
+	if !compress {
+		return write()
+	}
+	before := c.wire.written.Load()
+	if err := write(); err != nil {
+		return err
+	}
+	wireBytes := c.wire.written.Load() - before
+	c.compressed.add(uint64(size), wireBytes)
+	c.Hub.compressed.add(uint64(size), wireBytes)
+	return nil
+}
+
+// offersDeflate 客户端是否支持 permessage-deflate
+func offersDeflate(r *http.Request) bool {
+	for _, value := range r.Header.Values("Sec-Websocket-Extensions") {
+		for _, extension := range strings.Split(value, ",") {
+			name, _, _ := strings.Cut(extension, ";")
+			if strings.TrimSpace(name) == "permessage-deflate" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// countingConn 记录写出的字节数，用来统计压缩后的大小
+type countingConn struct {
+	net.Conn
+	written atomic.Uint64
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.written.Add(uint64(n))
+	return n, err
+}
+
+// countingResponseWriter 升级时把连接换成 countingConn
+type countingResponseWriter struct {
+	http.ResponseWriter
+	conn *countingConn
+}
+
+func (w *countingResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response does not implement http.Hijacker")
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, nil, err
+	}
+	w.conn = &countingConn{Conn: conn}
+	return w.conn, rw, nil
+}
@@ -0,0 +1,130 @@
+package hub
+
+import (
+	"hash/fnv"
+	"sync"
+)
+
+// connShardCount 分片数，连接和用户按 id 的哈希分到不同的分片，减少锁竞争
+const connShardCount = 32
+
+// Connections 本节点的连接，按连接 id 和用户 id 建立索引，可以在多个协程中并发访问
+type Connections struct {
+	// conns connId -> client
+	conns [connShardCount]connShard
+	// users userId -> connId -> client，同一个用户的多个设备
+	users [connShardCount]userShard
+}
+
+type connShard struct {
+	mu      sync.RWMutex
+	clients map[string]*Client
+}
+
+type userShard struct {
+	mu    sync.RWMutex
+	users map[string]map[string]*Client
+}
+
+func NewConnections() *Connections {
+	c := &Connections{}
+	for i := range c.conns {
+		c.conns[i].clients = make(map[string]*Client)
+		c.users[i].users = make(map[string]map[string]*Client)
+	}
+	return c
+}
+
+func shardIndex(id string) int {
+	h := fnv.New32a()
+	h.Write([]byte(id))
+	return int(h.Sum32() % connShardCount)
+}
+
+// Add 添加连接，ConnId 相同的连接会被替换
+func (c *Connections) Add(client *Client) {
+	conns := &c.conns[shardIndex(client.ConnId)]
+	conns.mu.Lock()
+	conns.clients[client.ConnId] = client
+	conns.mu.Unlock()
+
+	users := &c.users[shardIndex(client.Id)]
+	users.mu.Lock()
+	if users.users[client.Id] == nil {
+		users.users[client.Id] = make(map[string]*Client)
+	}
+	users.users[client.Id][client.ConnId] = client
+	users.mu.Unlock()
+}
+
+// Remove 删除连接，已经被同一个 ConnId 的其他连接替换时不删除
+func (c *Connections) Remove(client *Client) {
+	conns := &c.conns[shardIndex(client.ConnId)]
+	conns.mu.Lock()
+	if conns.clients[client.ConnId] == client {
+		delete(conns.clients, client.ConnId)
+	}
+	conns.mu.Unlock()
+
+	users := &c.users[shardIndex(client.Id)]
+	users.mu.Lock()
+	if devices := users.users[client.Id]; devices[client.ConnId] == client {
+		delete(devices, client.ConnId)
+		if len(devices) == 0 {
+			delete(users.users, client.Id)
+		}
+	}
+	users.mu.Unlock()
+}
+
+// Get 按连接 id 查找
+func (c *Connections) Get(connId string) (*Client, bool) {
+	conns := &c.conns[shardIndex(connId)]
+	conns.mu.RLock()
+	defer conns.mu.RUnlock()
+	client, ok := conns.clients[connId]
+	return client, ok
+}
+
+// User 用户在本节点的所有连接
+func (c *Connections) User(userId string) []*Client {
+	users := &c.users[shardIndex(userId)]
+	users.mu.RLock()
+	defer users.mu.RUnlock()
+	devices := users.users[userId]
+	clients := make([]*Client, 0, len(devices))
+	for _, client := range devices {
+		clients = append(clients, client)
+	}
+	return clients
+}
+
+// Range 依次对每个连接调用 fn，fn 返回 false 时停止，fn 中可以调用 Add 和 Remove
+func (c *Connections) Range(fn func(client *Client) bool) {
+	for i := range c.conns {
+		conns := &c.conns[i]
+		conns.mu.RLock()
+		clients := make([]*Client, 0, len(conns.clients))
+		for _, client := range conns.clients {
+			clients = append(clients, client)
+		}
+		conns.mu.RUnlock()
+		for _, client := range clients {
+			if !fn(client) {
+				return
+			}
+		}
+	}
+}
+
+// Count 连接数
+func (c *Connections) Count() int {
+	count := 0
+	for i := range c.conns {
+		conns := &c.conns[i]
+		conns.mu.RLock()
+		count += len(conns.clients)
+		conns.mu.RUnlock()
+	}
+	return count
+}
@@ -0,0 +1,139 @@
+package hub
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/WangSiangCun/go-ws/auth"
+	"github.com/WangSiangCun/go-ws/engine"
+)
+
+// CloseTokenExpired 凭证过期前没有通过 engine.TypeReauth 更换 token 时的关闭码
+const CloseTokenExpired = 4002
+
+// Identity 连接当前的身份，通过 engine.TypeReauth 更换 token 后会更新
+func (c *Client) Identity() *auth.Identity {
+	c.authMu.Lock()
+	defer c.authMu.Unlock()
+	return c.identity
+}
+
+func (c *Client) setIdentity(identity *auth.Identity) {
+	c.authMu.Lock()
+	c.identity = identity
+	c.authMu.Unlock()
+	// 通知 watchExpiry 按新的过期时间计时
+	select {
+	case c.reauthed <- struct{}{}:
+	default:
+	}
+}
+
+// expiresAt 当前凭证的过期时间，为零时不过期
+func (c *Client) expiresAt() time.Time {
+	if identity := c.Identity(); identity != nil {
+		return identity.ExpiresAt
+	}
+	return time.Time{}
+}
+
+// watchExpiry 凭证过期前 ExpiryWarning 发送 engine.TypeTokenExpiring，过期时以 CloseTokenExpired 关闭连接
+func (c *Client) watchExpiry() {
+	warning := time.Duration(c.settings.ExpiryWarning) * time.Second
+	// warned 已经发送过提醒的过期时间，更换 token 后重新提醒
+	var warned time.Time
+	for {
+		expiresAt := c.expiresAt()
+		if expiresAt.IsZero() {
+			select {
+			case <-c.reauthed:
+				continue
+			case <-c.closed:
+				return
+			}
+		}
+		now := time.Now()
+		if !now.Before(expiresAt) {
+			c.Kick(CloseTokenExpired, "token expired")
+			return
+		}
+		wait := expiresAt.Sub(now)
+		if warning > 0 && !warned.Equal(expiresAt) {
+			if warnAt := expiresAt.Add(-warning); now.Before(warnAt) {
+				wait = warnAt.Sub(now)
+			} else {
+				c.notifyExpiring(expiresAt)
+				warned = expiresAt
+				continue
+			}
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-c.reauthed:
+			timer.Stop()
+		case <-c.closed:
+			timer.Stop()
+			return
+		}
+	}
+}
+
+func (c *Client) notifyExpiring(expiresAt time.Time) {
+	frame, err := c.encode(&engine.Message{
+		Type:      engine.TypeTokenExpiring,
+		TargetIds: []string{c.Id},
+		Message:   strconv.FormatInt(expiresAt.Unix(), 10),
+	})
+	if err != nil {
+		return
+	}
+	c.write("", frame)
+}
+
+// reauth 处理 engine.TypeReauth，验证新 token 后替换连接的身份，并回复结果
+func (c *Client) reauth(message *engine.Message) {
+	reply := &engine.Message{Type: engine.TypeReauth, TargetIds: []string{c.Id}, RequestId: message.RequestId}
+	identity, err := c.authenticateToken(message.Message)
+	if err != nil {
+		code := engine.RPCUnauthorized
+		switch {
+		case errors.Is(err, errReauthUnsupported):
+			code = engine.RPCBadRequest
+		case auth.StatusCode(err) == http.StatusForbidden:
+			code = engine.RPCForbidden
+		}
+		reply.Error = engine.NewRPCError(code, err.Error())
+	} else {
+		c.setIdentity(identity)
+		if !identity.ExpiresAt.IsZero() {
+			reply.Message = strconv.FormatInt(identity.ExpiresAt.Unix(), 10)
+		}
+	}
+	frame, err := c.encode(reply)
+	if err != nil {
+		return
+	}
+	c.write("", frame)
+}
+
+var errReauthUnsupported = errors.New("authenticator does not support reauth")
+
+// authenticateToken 验证新 token，只能换成同一个用户的 token
+func (c *Client) authenticateToken(token string) (*auth.Identity, error) {
+	authenticator, ok := c.authenticator.(auth.TokenAuthenticator)
+	if !ok {
+		return nil, errReauthUnsupported
+	}
+	identity, err := authenticator.AuthenticateToken(token)
+	if err != nil {
+		return nil, err
+	}
+	if identity.UserId != c.Id {
+		return nil, fmt.Errorf("%w: token belongs to another user", auth.ErrForbidden)
+	}
+	return identity, nil
+}
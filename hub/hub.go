@@ -1,26 +1,35 @@
 package hub
 
 import (
-	"encoding/json"
+	"context"
+	"errors"
 	"fmt"
-	"github.com/WangSiangCun/go-ws/core/jwtHelper"
+	"github.com/WangSiangCun/go-ws/auth"
+	"github.com/WangSiangCun/go-ws/codec"
+	"github.com/WangSiangCun/go-ws/config"
 	"github.com/WangSiangCun/go-ws/engine"
-	"github.com/WangSiangCun/go-ws/etcdService"
-	"github.com/WangSiangCun/go-ws/rabbitMQService"
+	"github.com/WangSiangCun/go-ws/registry"
 	"github.com/WangSiangCun/go-ws/wsContext"
-	"github.com/golang-jwt/jwt/v4"
-	clientv3 "go.etcd.io/etcd/client/v3"
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
 	"log"
 	"net/http"
-	"strings"
+	"slices"
+	"strconv"
+	"sync"
 	"time"
 )
 
+var errNoBroker = errors.New("no broker configured")
+
+// versionHeader 升级响应中协商后的消息格式版本
+const versionHeader = "X-Message-Version"
+
 // Hub maintains the set of active clients and broadcasts messages to the
 // clients.
 type Hub struct {
-	// Registered clients.
-	Clients map[string]*Client
+	// Registered clients，按连接 id 和用户 id 索引，可以并发读写
+	Clients *Connections
 
 	// Inbound messages from the clients.
 	SendChannel chan *engine.Message
@@ -30,171 +39,611 @@ type Hub struct {
 
 	// Unregister requests from clients.
 	Unregister chan *Client
+
+	// Context 所有连接共享的上下文（etcd、Broker）
+	Context wsContext.WSContext
+
+	// streams 按用户分片的序号流，同一个用户的消息按序号的顺序投递，见 routeStream
+	streams [connShardCount]streamShard
+
+	// compressed 所有连接的压缩统计
+	compressed compressionCounter
+	// overflowed 所有连接的消息队列满的次数，onEvict 见 OnEvict
+	overflowed overflowCounter
+	onEvict    func(client *Client, policy string)
+
+	// closing Shutdown 时关闭，之后不再接受新连接，Run 关闭所有连接
+	closing      chan struct{}
+	shutdownMu   sync.Mutex
+	shuttingDown bool
+	// active 还没有关闭完成的连接
+	active sync.WaitGroup
+	// done 连接都关闭后关闭，Run 和后台任务退出
+	done     chan struct{}
+	stopOnce sync.Once
+	// workers consume 和 keepNodeAlive
+	workers sync.WaitGroup
 }
 
-func NewHub() *Hub {
+func NewHub(ws wsContext.WSContext) *Hub {
 	return &Hub{
+		Context:     ws,
 		SendChannel: make(chan *engine.Message),
 		ReadChannel: make(chan *engine.Message),
 		Register:    make(chan *Client),
 		Unregister:  make(chan *Client),
-		Clients:     make(map[string]*Client),
+		Clients:     NewConnections(),
+		closing:     make(chan struct{}),
+		done:        make(chan struct{}),
 	}
 }
-func (h *Hub) RemoveClient(clientId string) {
-	h.Clients[clientId] = nil
+func (h *Hub) RemoveClient(c *Client) {
+	h.Clients.Remove(c)
 }
 func (h *Hub) RegisterClient(wsContext wsContext.WSContext, hub *Hub, e *engine.Engine, clientId string, c *Client) {
-	hub.Clients[clientId] = c
-	//注册用户在etcd上
-	ticker := time.Tick(10 * time.Second)
-	var leaseId clientv3.LeaseID
-	//立刻设置租约，不然要等五秒
-	leaseId = etcdService.SetLease(wsContext.EtcdClient, e.Config.PongTime, clientId, e.Config.Host+e.Config.WSPort)
-	fmt.Println("register:" + clientId)
+	//注册连接在线状态，在租约过期之前续期
+	ticker := time.NewTicker(renewInterval(e.Config.PongTime))
+	defer ticker.Stop()
+	session := registry.Session{
+		UserId: clientId,
+		ConnId: c.ConnId,
+		Node:   e.Config.Host + e.Config.WSPort,
+		Since:  c.ConnectedAt.UnixNano(),
+	}
+	register := func() {
+		err := wsContext.Registry.Register(wsContext.Context, session, e.Config.PongTime)
+		if err != nil {
+			log.Printf("register %s error: %v", clientId, err)
+		}
+	}
+	//立刻注册，不然要等十秒
+	register()
+	close(c.registered)
+	if e.Config.DevicePolicy == config.DevicePolicyKickOld {
+		hub.kickOld(wsContext, e, c)
+	}
+	hub.replay(wsContext, c)
+	defer close(c.unregistered)
 	for {
 		select {
-		case <-ticker:
-			// 每隔 10 秒执行一次该操作
-			fmt.Println("On", c.Id)
-			leaseId = etcdService.SetLease(wsContext.EtcdClient, e.Config.PongTime, clientId, e.Config.Host+e.Config.WSPort)
+		case <-ticker.C:
+			// 每隔 PongTime 的 1/3 续期一次
+			register()
 		case <-c.ToOffline:
-			//退出直接取消租约，设置租约时间只是保障
-			etcdService.CancelLease(wsContext.EtcdClient, leaseId)
+			// 先保存没有确认的消息，注销后发来的离线消息排在它们后面
+			hub.saveUnacked(wsContext, c)
+			//退出直接注销，设置过期时间只是保障
+			if err := wsContext.Registry.Unregister(wsContext.Context, clientId, c.ConnId); err != nil {
+				log.Printf("unregister %s error: %v", clientId, err)
+			}
 			return
 		}
 	}
 
 }
-func (h *Hub) SendMessage(ws wsContext.WSContext, message *engine.Message, e *engine.Engine) {
-	// 插件
-	e.RunSendHandlers(ws, message)
-	if e.IsServerHandlerModel {
-		// 如果是Server handler 模式，就不继续执行了
-		return
+
+// renewInterval ttl 秒的租约的续期间隔，取 ttl 的 1/3，续期失败一次还有机会在过期前重试
+func renewInterval(ttl int64) time.Duration {
+	if ttl <= 0 {
+		return time.Second
 	}
+	return time.Duration(ttl) * time.Second / 3
+}
 
-	fmt.Println("SendChannel", e.Config.Host+e.Config.WSPort, message)
-	serverToMessage := map[string]*engine.Message{}
+func (h *Hub) SendMessage(ws wsContext.WSContext, message *engine.Message, e *engine.Engine) {
 	if message == nil {
 		log.Println("消息为空")
 		return
 	}
-	// 按服务器：IP分组 重新组装message
-	for _, targetId := range message.TargetIds {
-		get, err := ws.EtcdClient.Get(ws.Context, targetId, clientv3.WithPrefix())
-		if err != nil {
-			return
+	if message.Id == "" {
+		// 服务端直接调用 SendMessage 时分配消息 id
+		message.Id = uuid.NewString()
+	}
+	message.Timestamp = time.Now().UnixMilli()
+	// 先检查发送方，再执行中间件和插件，最后一环按这条消息的 Disposition 处理
+	err := e.RunSendHandlers(ws, message, func(c *engine.Context) error {
+		switch c.Disposition {
+		case engine.DispositionForward:
+			return h.route(c.WS, c.Message, c.SenderConnId, e)
+		case engine.DispositionReply:
+			return h.reply(c.SenderConnId, c.Reply)
+		default:
+			// 丢弃或者已由服务端处理，不影响其他消息
+			return nil
 		}
-		if len(get.Kvs) == 0 {
-			continue
+	}, h.authorizeFirst)
+	if err != nil {
+		log.Printf("send error: %v", err)
+	}
+}
+
+// reply 把 reply 直接写给本节点上的 connId 连接
+func (h *Hub) reply(connId string, reply *engine.Message) error {
+	if reply == nil {
+		return nil
+	}
+	if connId == "" {
+		return errors.New("reply: message has no source connection")
+	}
+	copied := *reply
+	copied.Broadcast = false
+	copied.ConnIds = []string{connId}
+	_, err := h.deliver(&copied)
+	return err
+}
+
+// route 按 Registry 把消息分发到目标连接所在的节点，房间消息不发回 senderConnId 这个连接
+func (h *Hub) route(ws wsContext.WSContext, message *engine.Message, senderConnId string, e *engine.Engine) error {
+	if message == nil {
+		return nil
+	}
+	if message.Broadcast {
+		return h.Broadcast(ws, message, e)
+	}
+	var sessions []registry.Session
+	var err error
+	if message.Room != "" {
+		// 房间消息，由服务端展开成员
+		sessions, err = h.roomSessions(ws, message.Room, senderConnId)
+	} else {
+		sessions, err = h.targetSessions(ws, e, message.TargetIds)
+	}
+	if err != nil {
+		return fmt.Errorf("lookup: %w", err)
+	}
+	var offline []string
+	if message.Room == "" {
+		// 不在线的用户先保存，上线后投递
+		offline = offlineTargets(message.TargetIds, sessions)
+	}
+	if ws.Sequence != nil {
+		h.routeSequenced(ws, e, message, sessions, offline)
+		return nil
+	}
+	h.saveOffline(ws, message, offline)
+	h.publishSessions(ws, e, message, sessions)
+	return nil
+}
+
+// publishSessions 按节点分组，每个节点发布一条消息，ConnIds 为该节点上要投递的连接
+func (h *Hub) publishSessions(ws wsContext.WSContext, e *engine.Engine, message *engine.Message, sessions []registry.Session) {
+	serverToMessage := map[string]*engine.Message{}
+	// 按服务器：IP分组 重新组装message
+	for _, session := range sessions {
+		toMessage := serverToMessage[session.Node]
+		if toMessage == nil {
+			copied := *message
+			copied.TargetIds = nil
+			copied.ConnIds = nil
+			toMessage = &copied
+			serverToMessage[session.Node] = toMessage
 		}
-		serverIPANDHost := string(get.Kvs[0].Value)
-		if serverToMessage[serverIPANDHost] == nil {
-			serverToMessage[serverIPANDHost] = &engine.Message{
-				Message:   message.Message,
-				TargetIds: []string{targetId},
-				SourceId:  message.SourceId,
-			}
-		} else {
-			serverToMessage[serverIPANDHost].TargetIds = append(serverToMessage[serverIPANDHost].TargetIds, targetId)
+		if !slices.Contains(toMessage.TargetIds, session.UserId) {
+			toMessage.TargetIds = append(toMessage.TargetIds, session.UserId)
 		}
+		toMessage.ConnIds = append(toMessage.ConnIds, session.ConnId)
 	}
 	// 发送消息
 	for serverIPANDHost, toMessage := range serverToMessage {
-		messageByte, err := json.Marshal(toMessage)
-		if err != nil {
-			log.Printf("error: %v", err)
+		if err := h.publish(ws, e, serverIPANDHost, toMessage); err != nil {
+			log.Printf("publish to %s error: %v", serverIPANDHost, err)
 		}
-		rabbitMQService.PublishWorking(ws.RabbitMQConnection, serverIPANDHost, messageByte)
 	}
 }
+
+// targetSessions 按 DevicePolicy 选出 targetIds 要投递的连接
+func (h *Hub) targetSessions(ws wsContext.WSContext, e *engine.Engine, targetIds []string) ([]registry.Session, error) {
+	found, err := ws.Registry.BatchLookup(ws.Context, targetIds)
+	if err != nil {
+		return nil, err
+	}
+	sessions := make([]registry.Session, 0, len(targetIds))
+	for _, targetId := range targetIds {
+		if e.Config.DevicePolicy == config.DevicePolicyLatest {
+			if latest, ok := registry.Latest(found[targetId]); ok {
+				sessions = append(sessions, latest)
+			}
+			continue
+		}
+		sessions = append(sessions, found[targetId]...)
+	}
+	return sessions, nil
+}
+
+// kickOld 踢掉 c 所属用户更早建立的连接，包括其他节点上的连接
+func (h *Hub) kickOld(ws wsContext.WSContext, e *engine.Engine, c *Client) {
+	sessions, err := ws.Registry.Lookup(ws.Context, c.Id)
+	if err != nil {
+		log.Printf("lookup %s error: %v", c.Id, err)
+		return
+	}
+	nodeToConnIds := map[string][]string{}
+	for _, session := range sessions {
+		if session.ConnId != c.ConnId && session.Since <= c.ConnectedAt.UnixNano() {
+			nodeToConnIds[session.Node] = append(nodeToConnIds[session.Node], session.ConnId)
+		}
+	}
+	for node, connIds := range nodeToConnIds {
+		kick := &engine.Message{Type: engine.TypeKick, TargetIds: []string{c.Id}, ConnIds: connIds}
+		if err = h.publish(ws, e, node, kick); err != nil {
+			log.Printf("kick %s on %s error: %v", c.Id, node, err)
+		}
+	}
+}
+
+// publish 把消息交给 node 处理，本节点直接在内存中投递，不经过 Broker
+func (h *Hub) publish(ws wsContext.WSContext, e *engine.Engine, node string, message *engine.Message) error {
+	if node == e.Config.Host+e.Config.WSPort {
+		if message.Seq != 0 {
+			// 带序号的消息由用户的投递协程同步投递，经过 ReadChannel 会在不同的协程中乱序
+			h.ReceiveMessage(ws, message, e)
+			return nil
+		}
+		h.ReadChannel <- message
+		return nil
+	}
+	if ws.Broker == nil {
+		return errNoBroker
+	}
+	messageByte, err := brokerCodec(e).Marshal(message)
+	if err != nil {
+		return err
+	}
+	return ws.Broker.Publish(node, messageByte)
+}
+
+// brokerCodec 节点间转发使用的编码，没有配置或者不支持时使用 JSON
+func brokerCodec(e *engine.Engine) codec.Codec {
+	if c, ok := codec.Get(e.Config.BrokerCodec); ok {
+		return c
+	}
+	return codec.JSON
+}
+
+// ReceiveMessage 处理本节点直接投递的消息，目标连接已经断开的用户重新查找所在节点
 func (h *Hub) ReceiveMessage(ws wsContext.WSContext, message *engine.Message, e *engine.Engine) {
-	// 插件
-	e.RunReceiverHandlers(ws, message)
+	h.redeliver(ws, e, message, h.receive(ws, message, e))
+}
 
+// receive 处理发给本节点的消息，返回目标连接都不在本节点、没有投递的用户
+func (h *Hub) receive(ws wsContext.WSContext, message *engine.Message, e *engine.Engine) []string {
 	if message == nil {
 		log.Println("消息为空")
+		return nil
+	}
+	if message.Type == engine.TypeKick {
+		for _, connId := range message.ConnIds {
+			if client, ok := h.Clients.Get(connId); ok {
+				go client.Kick(CloseKicked, "logged in on another device")
+			}
+		}
+		return nil
+	}
+	// 中间件和插件，最后一环才投递给客户端，被中间件截断也算处理过
+	var missing []string
+	err := e.RunReceiverHandlers(ws, message, func(c *engine.Context) error {
+		delivered, err := h.deliver(c.Message)
+		if c.Message != nil && !c.Message.Broadcast {
+			for _, targetId := range c.Message.TargetIds {
+				if _, ok := delivered[targetId]; !ok {
+					missing = append(missing, targetId)
+				}
+			}
+		}
+		return err
+	})
+	if err != nil {
+		log.Printf("receive error: %v", err)
+	}
+	return missing
+}
+
+// redeliver userIds 的连接不在本节点（比如 Registry 还没过期），重新查找 Registry：
+// 路由之后在其他节点建立的连接转发过去，其他节点上没有连接的用户保存为离线消息，
+// 其他节点上路由时就在线的连接已经收到，不再处理
+func (h *Hub) redeliver(ws wsContext.WSContext, e *engine.Engine, message *engine.Message, userIds []string) {
+	if len(userIds) == 0 {
+		return
+	}
+	log.Printf("message %s: targets %v not on this node", message.Id, userIds)
+	if message.Room != "" {
+		// 房间消息不补发
 		return
 	}
-	// 发送给对应的客户端
+	sessions, err := h.targetSessions(ws, e, userIds)
+	if err != nil {
+		log.Printf("lookup %v error: %v", userIds, err)
+		h.saveOffline(ws, message, userIds)
+		return
+	}
+	node := e.Config.Host + e.Config.WSPort
+	routedAt := message.Timestamp * int64(time.Millisecond)
+	var elsewhere, fresh []registry.Session
+	redelivered := false
+	for _, session := range sessions {
+		if session.Node == node {
+			// 发给本节点路由之后才建立的连接，说明这条消息已经转发过一次，不再转发，避免节点之间来回转发
+			if session.Since > routedAt && slices.Contains(message.ConnIds, session.ConnId) {
+				redelivered = true
+			}
+			continue
+		}
+		elsewhere = append(elsewhere, session)
+		if session.Since > routedAt {
+			fresh = append(fresh, session)
+		}
+	}
+	h.saveOffline(ws, message, offlineTargets(userIds, elsewhere))
+	if !redelivered {
+		h.publishSessions(ws, e, message, fresh)
+	}
+}
+
+// frameKey 相同版本和编码的连接共用一次编码结果
+type frameKey struct {
+	version int
+	codec   string
+}
+
+// deliver 把消息写给本节点上的目标连接，按连接协商的版本和编码编码，返回写入了连接的用户
+func (h *Hub) deliver(message *engine.Message) (map[string]struct{}, error) {
+	if message == nil {
+		return nil, nil
+	}
+	frames := map[frameKey][]byte{}
+	sent := map[string]struct{}{}
+	for _, client := range h.localClients(message) {
+		key := frameKey{version: client.Version, codec: client.Codec.Name()}
+		frame, ok := frames[key]
+		if !ok {
+			var err error
+			// ConnIds 只在节点间使用，不发给客户端
+			if frame, err = client.encode(message); err != nil {
+				return sent, err
+			}
+			frames[key] = frame
+		}
+		client.deliver(message.Id, message.Seq, frame)
+		sent[client.Id] = struct{}{}
+	}
+	return sent, nil
+}
+
+// localClients 本节点上要投递的连接
+func (h *Hub) localClients(message *engine.Message) []*Client {
+	var clients []*Client
+	if message.Broadcast {
+		// 广播给本节点所有符合条件的客户端
+		h.Clients.Range(func(client *Client) bool {
+			if engine.MatchFilters(message.Filters, client.Metadata) {
+				clients = append(clients, client)
+			}
+			return true
+		})
+		return clients
+	}
+	if len(message.ConnIds) > 0 {
+		// 发送给指定的连接
+		for _, connId := range message.ConnIds {
+			if client, ok := h.Clients.Get(connId); ok {
+				clients = append(clients, client)
+			}
+		}
+		return clients
+	}
+	// 发送给对应用户在本节点的所有连接
 	for _, targetId := range message.TargetIds {
-		if client, ok := h.Clients[targetId]; ok {
-			jsonMessage, err := json.Marshal(message)
-			if err != nil {
-				log.Printf("error: %v", err)
+		clients = append(clients, h.Clients.User(targetId)...)
+	}
+	return clients
+}
+
+// consume 消费本节点的队列，投递给本节点的连接之后才确认
+// 目标连接不在本节点的用户重新查找 Registry，转发给现在持有连接的节点或者保存为离线消息之后确认
+func (h *Hub) consume(ws wsContext.WSContext, e *engine.Engine) {
+	deliveries, err := ws.Broker.Subscribe(e.Config.Host + e.Config.WSPort)
+	if err != nil {
+		log.Printf("启动接收错误: %v", err)
+		return
+	}
+	for delivery := range deliveries {
+		message := &engine.Message{}
+		if err = brokerCodec(e).Unmarshal(delivery.Body, message); err != nil {
+			log.Printf("error: %v", err)
+			delivery.Nack(false)
+			continue
+		}
+		h.redeliver(ws, e, message, h.receive(ws, message, e))
+		if err = delivery.Ack(); err != nil {
+			log.Printf("ack error: %v", err)
+		}
+	}
+}
+
+// keepNodeAlive 注册本节点在线，广播时通过 Registry 发现所有节点，Shutdown 时注销
+func (h *Hub) keepNodeAlive(ws wsContext.WSContext, e *engine.Engine) {
+	node := e.Config.Host + e.Config.WSPort
+	// 和连接一样按 PongTime 的 1/3 续期，续期失败一次不会过期
+	ticker := time.NewTicker(renewInterval(e.Config.PongTime))
+	defer ticker.Stop()
+	for {
+		if err := ws.Registry.RegisterNode(ws.Context, node, e.Config.PongTime); err != nil {
+			log.Printf("register node %s error: %v", node, err)
+		}
+		select {
+		case <-ticker.C:
+		case <-h.done:
+			if err := ws.Registry.UnregisterNode(context.Background(), node); err != nil {
+				log.Printf("unregister node %s error: %v", node, err)
 			}
-			client.WriteChannel <- jsonMessage
+			return
 		}
 	}
 }
-func (h *Hub) Run(ws wsContext.WSContext, e *engine.Engine) {
+
+func (h *Hub) Run(e *engine.Engine) {
+	ws := h.Context
+	h.goWorker(func() { h.keepNodeAlive(ws, e) })
+	h.goWorker(func() { h.runAuthenticator(e) })
+	// 单机模式没有 Broker，只在本进程内路由
+	if ws.Broker != nil {
+		h.goWorker(func() { h.consume(ws, e) })
+	}
+	closing := h.closing
 	for {
 		select {
+		case <-closing:
+			// 只处理一次，之后的连接在注册时关闭
+			closing = nil
+			h.Clients.Range(func(client *Client) bool {
+				go client.closeForShutdown()
+				return true
+			})
+		case <-h.done:
+			return
 		case client := <-h.Register:
+			h.Clients.Add(client)
 			go h.RegisterClient(ws, h, e, client.Id, client)
+			if closing == nil {
+				// Shutdown 之前升级的连接
+				go client.closeForShutdown()
+			}
 		case client := <-h.Unregister:
-			h.RemoveClient(client.Id)
+			h.RemoveClient(client)
 		case message, ok := <-h.SendChannel:
 			if !ok {
 				log.Println("SendChannel通道关闭")
 			}
-			fmt.Println("SendChannel", e.Config.Host+e.Config.WSPort, message)
 			go h.SendMessage(ws, message, e)
 		case message, ok := <-h.ReadChannel:
 			if !ok {
 				log.Println("ReadChannel通道关闭")
 			}
-			fmt.Println("ReadChannel", e.Config.Host+e.Config.WSPort, message)
 			go h.ReceiveMessage(ws, message, e)
 		}
 
 	}
 }
-func (h *Hub) ServeWs(w http.ResponseWriter, r *http.Request, e *engine.Engine) {
-	wsContext := wsContext.NewContext(r.Context(), e.Config)
-	token, found := strings.CutPrefix(r.URL.RawQuery, "token=")
-	claims := &jwt.MapClaims{}
-	clientId := ""
-	ok := false
-	//鉴权，判断是是否登录
-	if e.IsOpenJWT {
-		isValid := false
-		isValid, claims = jwtHelper.IsValid(e.Config.JWT.AccessSecret, token)
-		isValid = true
-		if !isValid {
-			_, err := w.Write([]byte("鉴权失败"))
-			fmt.Println(err)
-			return
+
+// runAuthenticator 运行认证方式的后台任务，比如定期重新加载 JWT 公钥，Shutdown 时退出
+func (h *Hub) runAuthenticator(e *engine.Engine) {
+	runner, ok := e.Authenticator.(auth.Runner)
+	if !ok {
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-h.done:
+			cancel()
+		case <-ctx.Done():
 		}
-		clientId, ok = (*claims)["client_id"].(string)
-		if !ok {
-			_, err := w.Write([]byte("鉴权失败"))
-			fmt.Println(err)
-			return
+	}()
+	runner.Run(ctx)
+}
+
+// authenticator e 设置的认证方式，没有设置时直接使用查询参数 client_id
+func authenticator(e *engine.Engine) auth.Authenticator {
+	if e.Authenticator != nil {
+		return e.Authenticator
+	}
+	return auth.Query()
+}
+
+func (h *Hub) ServeWs(w http.ResponseWriter, r *http.Request, e *engine.Engine) {
+	wsContext := h.Context
+	query := r.URL.Query()
+	// 正在关闭时不再接受新连接
+	if !h.accept() {
+		http.Error(w, ShutdownReason, http.StatusServiceUnavailable)
+		return
+	}
+	upgraded := false
+	defer func() {
+		if !upgraded {
+			h.active.Done()
 		}
-	} else {
-		clientId, found = strings.CutPrefix(r.URL.RawQuery, "client_id=")
-		if found == false {
-			return
+	}()
+	//鉴权，失败时在升级之前返回 401 或 403
+	authn := authenticator(e)
+	identity, err := authn.Authenticate(r)
+	if err != nil {
+		status := auth.StatusCode(err)
+		if status == http.StatusUnauthorized {
+			w.Header().Set("WWW-Authenticate", "Bearer")
 		}
+		log.Printf("authenticate %s: %v", r.RemoteAddr, err)
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+	// 用户 id 是 Registry key 的一部分，不能包含 "/"
+	if err := registry.ValidateName(identity.UserId); err != nil {
+		log.Printf("authenticate %s: %v", r.RemoteAddr, err)
+		http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+		return
 	}
 	//升级协议
-	conn, err := upGrader.Upgrade(w, r, nil)
+	// 协商消息格式版本，通过响应头告诉客户端
+	requested, _ := strconv.Atoi(query.Get("version"))
+	version := engine.NegotiateVersion(requested)
+	header := http.Header{versionHeader: {strconv.Itoa(version)}}
+	// 按客户端在 Sec-WebSocket-Protocol 中给出的顺序选择编码，没有支持的编码时使用 JSON
+	wireCodec, ok := codec.Negotiate(websocket.Subprotocols(r))
+	if ok {
+		header.Set("Sec-Websocket-Protocol", wireCodec.Name())
+	}
+	// 按路由覆盖连接参数，代码中创建的配置没有经过 conf 检查，不合法时使用默认值
+	settings := e.Config.Connection.ForRoute(r.URL.Path)
+	if err := settings.Validate(); err != nil {
+		log.Printf("connection settings for %s: %v, using defaults", r.URL.Path, err)
+		settings = config.DefaultConnection()
+	}
+	upgrader := upGrader
+	upgrader.ReadBufferSize = settings.ReadBufferSize
+	upgrader.WriteBufferSize = settings.WriteBufferSize
+	// 客户端支持 permessage-deflate 时才压缩，记录写出的字节数用来统计压缩效果
+	var counting *countingResponseWriter
+	if e.Config.Compression.Enabled && offersDeflate(r) {
+		upgrader.EnableCompression = true
+		counting = &countingResponseWriter{ResponseWriter: w}
+		w = counting
+	}
+	conn, err := upgrader.Upgrade(w, r, header)
 	if err != nil {
 		log.Println(err)
 		return
 	}
-	// myMap 包含 key 值，val 为对应的 value 值
-	if h.Clients[clientId] != nil {
-		// 存在 key
-		h.Clients[clientId].Close()
-	}
 
-	client := NewClient(h, conn, clientId)
+	client := newClient(h, conn, identity.UserId, settings)
+	client.identity = identity
+	client.authenticator = authn
+	client.Version = version
+	client.Codec = wireCodec
+	client.writeConfig = e.Config.Write
+	if counting != nil {
+		if err = conn.SetCompressionLevel(e.Config.Compression.Level); err != nil {
+			log.Printf("compression level %d: %v", e.Config.Compression.Level, err)
+		}
+		client.compression = e.Config.Compression
+		client.wire = counting.conn
+	}
+	client.Metadata = identity.Metadata()
+	client.ackEnabled = query.Get("ack") == "1"
+	if seq, err := strconv.ParseUint(query.Get("seq"), 10, 64); err == nil {
+		// 重连时带上收到的最大序号，补发之后的消息
+		client.resume, client.resumeSeq = true, seq
+	}
+	// 补发完历史和离线消息之前，新消息先暂存，保证顺序
+	client.replaying = true
+	upgraded = true
 	client.Hub.Register <- client
 	go client.readPump(wsContext)
-	go client.writePump(wsContext)
-	go client.ReceiveMessage(wsContext, e)
+	go func() {
+		client.writePump(wsContext)
+		<-client.unregistered
+		h.active.Done()
+	}()
 	go client.SendMessage(wsContext, e)
+	go client.watchExpiry()
 }
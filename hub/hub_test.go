@@ -1,8 +1,27 @@
 package hub
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
 	"fmt"
+	"github.com/WangSiangCun/go-ws/auth"
+	"github.com/WangSiangCun/go-ws/broker"
+	"github.com/WangSiangCun/go-ws/codec"
+	"github.com/WangSiangCun/go-ws/config"
+	"github.com/WangSiangCun/go-ws/engine"
+	"github.com/WangSiangCun/go-ws/offline"
+	"github.com/WangSiangCun/go-ws/registry"
+	"github.com/WangSiangCun/go-ws/wsContext"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestHandler(t *testing.T) {
@@ -13,3 +32,1189 @@ func do(p [][]any) {
 
 	fmt.Println(p)
 }
+
+func newStandaloneServer(t *testing.T, opts ...func(e *engine.Engine)) (*Hub, *httptest.Server) {
+	c := config.NewStandaloneConfig("127.0.0.1", ":0", 10)
+	e := engine.NewEngine(c)
+	for _, opt := range opts {
+		opt(e)
+	}
+	h := NewHub(wsContext.NewContext(context.Background(), c))
+	go h.Run(e)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h.ServeWs(w, r, e)
+	}))
+	t.Cleanup(server.Close)
+	return h, server
+}
+
+func dial(t *testing.T, server *httptest.Server, clientId string) *websocket.Conn {
+	return dialQuery(t, server, "client_id="+clientId)
+}
+
+func dialQuery(t *testing.T, server *httptest.Server, query string) *websocket.Conn {
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/ws?" + query
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	assert.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func waitOnline(t *testing.T, h *Hub, clientId string) {
+	waitDevices(t, h, clientId, 1)
+}
+
+func waitDevices(t *testing.T, h *Hub, clientId string, devices int) {
+	assert.Eventually(t, func() bool {
+		sessions, _ := h.Context.Registry.Lookup(context.Background(), clientId)
+		return len(sessions) == devices
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestRenewInterval(t *testing.T) {
+	assert.Equal(t, 10*time.Second/3, renewInterval(10))
+	assert.Equal(t, time.Second/3, renewInterval(1))
+	assert.Equal(t, time.Second, renewInterval(0))
+}
+
+func TestHub_Standalone(t *testing.T) {
+	h, server := newStandaloneServer(t)
+	sender := dial(t, server, "u1")
+	receiver := dial(t, server, "u2")
+	waitOnline(t, h, "u2")
+
+	assert.NoError(t, sender.WriteJSON(engine.Message{Message: "hello", TargetIds: []string{"u2"}, SourceId: "u1"}))
+
+	receiver.SetReadDeadline(time.Now().Add(time.Second))
+	message := engine.Message{}
+	assert.NoError(t, receiver.ReadJSON(&message))
+	assert.Equal(t, "hello", message.Message)
+	assert.Equal(t, "u1", message.SourceId)
+}
+
+func TestHub_Room(t *testing.T) {
+	h, server := newStandaloneServer(t)
+	sender := dial(t, server, "u1")
+	// 发送者的另一台设备
+	laptop := dial(t, server, "u1")
+	member := dial(t, server, "u2")
+	outsider := dial(t, server, "u3")
+	waitOnline(t, h, "u2")
+	waitOnline(t, h, "u3")
+
+	for _, conn := range []*websocket.Conn{sender, laptop, member} {
+		assert.NoError(t, conn.WriteJSON(engine.Message{Type: engine.TypeJoinRoom, Room: "lobby"}))
+	}
+	assert.Eventually(t, func() bool {
+		members, _ := h.Context.Registry.RoomMembers(context.Background(), "lobby")
+		return len(members) == 3
+	}, time.Second, 10*time.Millisecond)
+
+	assert.NoError(t, sender.WriteJSON(engine.Message{Message: "hi all", SourceId: "u1", Room: "lobby"}))
+
+	message := engine.Message{}
+	for _, conn := range []*websocket.Conn{member, laptop} {
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		message = engine.Message{}
+		assert.NoError(t, conn.ReadJSON(&message))
+		assert.Equal(t, "hi all", message.Message)
+		assert.Equal(t, "lobby", message.Room)
+	}
+
+	// 不发回发送的连接
+	for _, conn := range []*websocket.Conn{sender, outsider} {
+		conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		assert.Error(t, conn.ReadJSON(&message))
+	}
+
+	// "/" 是 key 的分隔符，房间 lobby/u3 不能让 u3 成为 lobby 的成员
+	assert.NoError(t, outsider.WriteJSON(engine.Message{Type: engine.TypeJoinRoom, Room: "lobby/u3"}))
+	assert.ErrorIs(t, h.JoinRoom(h.Context, "lobby/u3", "u3", ""), registry.ErrInvalidName)
+	members, _ := h.Context.Registry.RoomMembers(context.Background(), "lobby")
+	assert.Len(t, members, 3)
+
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/ws?client_id=u1%2Fx"
+	_, resp, err := websocket.DefaultDialer.Dial(url, nil)
+	assert.ErrorIs(t, err, websocket.ErrBadHandshake)
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
+
+func TestHub_Broadcast(t *testing.T) {
+	h, server := newStandaloneServer(t)
+	conns := []*websocket.Conn{dial(t, server, "u1"), dial(t, server, "u2")}
+	waitOnline(t, h, "u1")
+	waitOnline(t, h, "u2")
+	assert.Eventually(t, func() bool {
+		nodes, _ := h.Context.Registry.Nodes(context.Background())
+		return len(nodes) == 1
+	}, time.Second, 10*time.Millisecond)
+
+	e := engine.NewEngine(config.NewStandaloneConfig("127.0.0.1", ":0", 10))
+	assert.NoError(t, h.Broadcast(h.Context, &engine.Message{Message: "notice", SourceId: "system"}, e))
+
+	for _, conn := range conns {
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		message := engine.Message{}
+		assert.NoError(t, conn.ReadJSON(&message))
+		assert.Equal(t, "notice", message.Message)
+		assert.True(t, message.Broadcast)
+	}
+}
+
+func TestHub_ClientBroadcast(t *testing.T) {
+	for _, allowed := range []bool{false, true} {
+		h, server := newStandaloneServer(t, func(e *engine.Engine) { e.Config.ClientBroadcast = allowed })
+		sender := dial(t, server, "u1")
+		receiver := dial(t, server, "u2")
+		waitOnline(t, h, "u1")
+		waitOnline(t, h, "u2")
+		assert.Eventually(t, func() bool {
+			nodes, _ := h.Context.Registry.Nodes(context.Background())
+			return len(nodes) == 1
+		}, time.Second, 10*time.Millisecond)
+
+		assert.NoError(t, sender.WriteJSON(engine.Message{Message: "everyone", Broadcast: true}))
+
+		receiver.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+		message := engine.Message{}
+		err := receiver.ReadJSON(&message)
+		if allowed {
+			assert.NoError(t, err)
+			assert.Equal(t, "everyone", message.Message)
+			assert.Equal(t, "u1", message.SourceId)
+		} else {
+			// 默认只有服务端可以广播
+			assert.Error(t, err)
+		}
+	}
+}
+
+func TestHub_MultiDevice(t *testing.T) {
+	h, server := newStandaloneServer(t)
+	sender := dial(t, server, "u1")
+	phone := dial(t, server, "u2")
+	laptop := dial(t, server, "u2")
+	waitDevices(t, h, "u2", 2)
+
+	assert.NoError(t, sender.WriteJSON(engine.Message{Message: "hello", TargetIds: []string{"u2"}, SourceId: "u1"}))
+
+	for _, conn := range []*websocket.Conn{phone, laptop} {
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		message := engine.Message{}
+		assert.NoError(t, conn.ReadJSON(&message))
+		assert.Equal(t, "hello", message.Message)
+		assert.Empty(t, message.ConnIds)
+	}
+}
+
+func TestHub_DevicePolicyLatest(t *testing.T) {
+	h, server := newStandaloneServer(t, func(e *engine.Engine) {
+		e.Config.DevicePolicy = config.DevicePolicyLatest
+	})
+	sender := dial(t, server, "u1")
+	phone := dial(t, server, "u2")
+	waitDevices(t, h, "u2", 1)
+	laptop := dial(t, server, "u2")
+	waitDevices(t, h, "u2", 2)
+
+	assert.NoError(t, sender.WriteJSON(engine.Message{Message: "hello", TargetIds: []string{"u2"}, SourceId: "u1"}))
+
+	laptop.SetReadDeadline(time.Now().Add(time.Second))
+	message := engine.Message{}
+	assert.NoError(t, laptop.ReadJSON(&message))
+	assert.Equal(t, "hello", message.Message)
+
+	phone.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	assert.Error(t, phone.ReadJSON(&message))
+}
+
+func TestHub_DevicePolicyKickOld(t *testing.T) {
+	h, server := newStandaloneServer(t, func(e *engine.Engine) {
+		e.Config.DevicePolicy = config.DevicePolicyKickOld
+	})
+	phone := dial(t, server, "u2")
+	waitDevices(t, h, "u2", 1)
+	dial(t, server, "u2")
+
+	phone.SetReadDeadline(time.Now().Add(time.Second))
+	_, _, err := phone.ReadMessage()
+	assert.True(t, websocket.IsCloseError(err, CloseKicked))
+	waitDevices(t, h, "u2", 1)
+}
+
+func TestHub_Disposition(t *testing.T) {
+	h, server := newStandaloneServer(t, func(e *engine.Engine) {
+		e.UseSend(func(next engine.Handler) engine.Handler {
+			return func(c *engine.Context) error {
+				switch c.Message.Type {
+				case 1:
+					c.Handled()
+				case 2:
+					c.ReplyWith(&engine.Message{Message: "pong", SourceId: "server"})
+				}
+				return next(c)
+			}
+		})
+	})
+	sender := dial(t, server, "u1")
+	receiver := dial(t, server, "u2")
+	waitOnline(t, h, "u2")
+
+	// 服务端处理的消息不转发，也不影响之后的普通消息
+	assert.NoError(t, sender.WriteJSON(engine.Message{Message: "match", TargetIds: []string{"u2"}, SourceId: "u1", Type: 1}))
+	assert.NoError(t, sender.WriteJSON(engine.Message{Message: "ping", TargetIds: []string{"u2"}, SourceId: "u1", Type: 2}))
+	assert.NoError(t, sender.WriteJSON(engine.Message{Message: "hello", TargetIds: []string{"u2"}, SourceId: "u1"}))
+
+	sender.SetReadDeadline(time.Now().Add(time.Second))
+	message := engine.Message{}
+	assert.NoError(t, sender.ReadJSON(&message))
+	assert.Equal(t, "pong", message.Message)
+
+	receiver.SetReadDeadline(time.Now().Add(time.Second))
+	assert.NoError(t, receiver.ReadJSON(&message))
+	assert.Equal(t, "hello", message.Message)
+}
+
+// rebuild 旧版插件常见的写法，按原消息重新构造一条，不带 json:"-" 的字段
+func rebuild(_ *engine.Engine, _ wsContext.WSContext, message *engine.Message, _ ...any) *engine.Message {
+	return &engine.Message{Id: message.Id, Type: message.Type, Message: message.Message, SourceId: message.SourceId,
+		TargetIds: message.TargetIds, RequestId: message.RequestId, Method: message.Method}
+}
+
+func TestHub_RPC(t *testing.T) {
+	h, server := newStandaloneServer(t, func(e *engine.Engine) {
+		e.SetSendHandlers([]engine.HandlersFunc{rebuild})
+		e.HandleRPC("echo", func(c *engine.Context) (any, error) {
+			return c.Message.Message, nil
+		})
+	})
+	caller := dial(t, server, "u1")
+	other := dial(t, server, "u1")
+	waitDevices(t, h, "u1", 2)
+
+	assert.NoError(t, caller.WriteJSON(engine.Message{Type: engine.TypeRPC, SourceId: "u1", RequestId: "42", Method: "echo", Message: "hi"}))
+
+	caller.SetReadDeadline(time.Now().Add(time.Second))
+	message := engine.Message{}
+	assert.NoError(t, caller.ReadJSON(&message))
+	assert.Equal(t, engine.Message{Type: engine.TypeRPC, TargetIds: []string{"u1"}, RequestId: "42", Method: "echo", Message: "hi"}, message)
+
+	// 回复只发给调用的连接，同一用户的其他设备收不到
+	other.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	assert.Error(t, other.ReadJSON(&message))
+}
+
+func TestClient_Unacked(t *testing.T) {
+	c := NewClient(nil, nil, "u1")
+	c.ackEnabled = true
+	for i := 0; i < maxUnacked+1; i++ {
+		c.track(fmt.Sprint(i), []byte(fmt.Sprint(i)))
+	}
+	// 满了丢弃最早的
+	assert.Len(t, c.unacked, maxUnacked)
+	assert.NotContains(t, c.unacked, "0")
+
+	c.ack("1")
+	assert.NotContains(t, c.unacked, "1")
+	assert.Empty(t, c.expired(time.Now()))
+
+	now := time.Now()
+	for i := 0; i < maxRetransmits; i++ {
+		now = now.Add(ackTimeout)
+		assert.Len(t, c.expired(now), maxUnacked-1)
+	}
+	// 超过重发次数放弃
+	assert.Empty(t, c.expired(now.Add(ackTimeout)))
+	assert.Empty(t, c.unacked)
+}
+
+func TestHub_Ack(t *testing.T) {
+	h, server := newStandaloneServer(t)
+	sender := dial(t, server, "u1")
+	receiver := dialQuery(t, server, "client_id=u2&ack=1")
+	waitOnline(t, h, "u2")
+
+	assert.NoError(t, sender.WriteJSON(engine.Message{Message: "hello", TargetIds: []string{"u2"}, SourceId: "u1", Id: "forged",
+		Error: engine.NewRPCError(engine.RPCInternal, "forged")}))
+
+	receiver.SetReadDeadline(time.Now().Add(time.Second))
+	message := engine.Message{}
+	assert.NoError(t, receiver.ReadJSON(&message))
+	assert.Equal(t, "hello", message.Message)
+	// 消息 id 由服务端分配，客户端填写的 error 被清除
+	assert.NotEmpty(t, message.Id)
+	assert.NotEqual(t, "forged", message.Id)
+	assert.Nil(t, message.Error)
+
+	clients := h.Clients.User("u2")
+	assert.Len(t, clients, 1)
+	client := clients[0]
+	client.ackMu.Lock()
+	assert.Contains(t, client.unacked, message.Id)
+	client.ackMu.Unlock()
+
+	assert.NoError(t, receiver.WriteJSON(engine.Message{Type: engine.TypeAck, Id: message.Id}))
+	assert.Eventually(t, func() bool {
+		client.ackMu.Lock()
+		defer client.ackMu.Unlock()
+		return len(client.unacked) == 0
+	}, time.Second, 10*time.Millisecond)
+}
+
+// fakeBroker 记录每条消息的确认结果和转发到的节点
+type fakeBroker struct {
+	deliveries chan *broker.Delivery
+	results    chan string
+	published  chan string
+}
+
+func (b *fakeBroker) Publish(node string, body []byte) error {
+	b.published <- node
+	return nil
+}
+
+func (b *fakeBroker) Subscribe(node string) (<-chan *broker.Delivery, error) {
+	return b.deliveries, nil
+}
+
+func (b *fakeBroker) Close() error { return nil }
+
+func (b *fakeBroker) deliver(message engine.Message, redelivered bool) string {
+	body, _ := json.Marshal(message)
+	b.deliveries <- broker.NewDelivery(body, redelivered, func() error {
+		b.results <- "ack"
+		return nil
+	}, func(requeue bool) error {
+		b.results <- fmt.Sprintf("nack requeue=%v", requeue)
+		return nil
+	})
+	return <-b.results
+}
+
+func TestHub_ConsumeAck(t *testing.T) {
+	c := config.NewStandaloneConfig("127.0.0.1", ":0", 10)
+	e := engine.NewEngine(c)
+	b := &fakeBroker{deliveries: make(chan *broker.Delivery), results: make(chan string), published: make(chan string, 1)}
+	h := NewHub(wsContext.WSContext{
+		Context:  context.Background(),
+		Broker:   b,
+		Registry: registry.NewMemoryRegistry(),
+		Offline:  offline.NewMemoryStore(offline.Options{}),
+	})
+	go h.consume(h.Context, e)
+
+	client := NewClient(h, nil, "u1")
+	h.Clients.Add(client)
+
+	assert.Equal(t, "ack", b.deliver(engine.Message{Id: "m1", Message: "hi", TargetIds: []string{"u1"}}, false))
+	assert.Equal(t, `{"id":"m1","message":"hi","target_ids":["u1"],"source_id":"","type":0}`, string(<-client.WriteChannel))
+
+	// 只有没投递的 u2 保存为离线消息
+	assert.Equal(t, "ack", b.deliver(engine.Message{Message: "hi", TargetIds: []string{"u1", "u2"}, Timestamp: 1}, false))
+	<-client.WriteChannel
+	assert.Equal(t, 0, offlineCount(h, "u1"))
+	assert.Equal(t, 1, offlineCount(h, "u2"))
+
+	// 路由之后 u3 在 node-b 重新连接，转发给 node-b，不保存离线消息
+	ctx := context.Background()
+	routedAt := time.Now()
+	assert.NoError(t, h.Context.Registry.Register(ctx, registry.Session{UserId: "u3", ConnId: "c3", Node: "node-b", Since: routedAt.Add(time.Second).UnixNano()}, 10))
+	assert.Equal(t, "ack", b.deliver(engine.Message{Message: "hi", TargetIds: []string{"u3"}, Timestamp: routedAt.UnixMilli()}, false))
+	assert.Equal(t, "node-b", <-b.published)
+	assert.Equal(t, 0, offlineCount(h, "u3"))
+
+	// 路由时就在 node-b 的连接已经收到，不再转发
+	assert.NoError(t, h.Context.Registry.Register(ctx, registry.Session{UserId: "u4", ConnId: "c4", Node: "node-b", Since: 1}, 10))
+	assert.Equal(t, "ack", b.deliver(engine.Message{Message: "hi", TargetIds: []string{"u4"}, Timestamp: routedAt.UnixMilli()}, false))
+	assert.Empty(t, b.published)
+	assert.Equal(t, 0, offlineCount(h, "u4"))
+
+	// 广播没有符合条件的客户端也算处理过
+	filters := []engine.Filter{{Key: "platform", Op: engine.FilterEq, Values: []string{"ios"}}}
+	assert.Equal(t, "ack", b.deliver(engine.Message{Message: "hi", Broadcast: true, Filters: filters}, false))
+	assert.Empty(t, client.WriteChannel)
+}
+
+// readMessages 读取 n 条消息，默认每条消息单独一帧
+func readMessages(t *testing.T, conn *websocket.Conn, n int) []engine.Message {
+	var messages []engine.Message
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	for len(messages) < n {
+		message := engine.Message{}
+		if !assert.NoError(t, conn.ReadJSON(&message)) {
+			return messages
+		}
+		messages = append(messages, message)
+	}
+	return messages
+}
+
+// offlineCount 离线消息条数，取出后按原顺序放回
+func offlineCount(h *Hub, userId string) int {
+	ctx := context.Background()
+	messages, _ := h.Context.Offline.Drain(ctx, userId)
+	for _, message := range messages {
+		h.Context.Offline.Save(ctx, userId, message)
+	}
+	return len(messages)
+}
+
+func TestHub_Offline(t *testing.T) {
+	h, server := newStandaloneServer(t)
+	sender := dial(t, server, "u1")
+	waitOnline(t, h, "u1")
+
+	for _, text := range []string{"first", "second"} {
+		assert.NoError(t, sender.WriteJSON(engine.Message{Message: text, TargetIds: []string{"u2"}, SourceId: "u1"}))
+	}
+	assert.Eventually(t, func() bool {
+		return offlineCount(h, "u2") == 2
+	}, time.Second, 10*time.Millisecond)
+
+	// 上线后收到离线消息，没有确认就断开的消息会按原顺序重新保存
+	receiver := dialQuery(t, server, "client_id=u2&ack=1")
+	var texts []string
+	for _, message := range readMessages(t, receiver, 2) {
+		texts = append(texts, message.Message)
+	}
+	assert.ElementsMatch(t, []string{"first", "second"}, texts)
+	receiver.Close()
+	waitDevices(t, h, "u2", 0)
+	assert.Equal(t, 2, offlineCount(h, "u2"))
+
+	receiver = dial(t, server, "u2")
+	var replayed []string
+	for _, message := range readMessages(t, receiver, 2) {
+		replayed = append(replayed, message.Message)
+	}
+	assert.Equal(t, texts, replayed)
+	assert.Equal(t, 0, offlineCount(h, "u2"))
+
+	// 本节点直接投递时目标连接已经断开
+	e := engine.NewEngine(config.NewStandaloneConfig("127.0.0.1", ":0", 10))
+	h.ReceiveMessage(h.Context, &engine.Message{Message: "gone", TargetIds: []string{"u3"}, ConnIds: []string{"c3"}}, e)
+	assert.Equal(t, 1, offlineCount(h, "u3"))
+}
+
+func TestHub_Sequence(t *testing.T) {
+	h, server := newStandaloneServer(t, func(e *engine.Engine) {
+		e.Config.Sequence = config.Sequence{Enabled: true, History: 3}
+	})
+	sender := dial(t, server, "u1")
+	waitOnline(t, h, "u1")
+
+	for _, text := range []string{"a", "b", "c"} {
+		assert.NoError(t, sender.WriteJSON(engine.Message{Message: text, TargetIds: []string{"u2"}, SourceId: "u1"}))
+		// 等上一条保存后再发，保证序号和发送顺序一致
+		assert.Eventually(t, func() bool {
+			return offlineCount(h, "u2") == int(text[0]-'a')+1
+		}, time.Second, 10*time.Millisecond)
+	}
+
+	// 已经收到 1，补发 2 和 3，离线消息中的 1 不再重复发送
+	receiver := dialQuery(t, server, "client_id=u2&seq=1")
+	messages := readMessages(t, receiver, 2)
+	assert.Equal(t, []uint64{2, 3}, []uint64{messages[0].Seq, messages[1].Seq})
+	assert.Equal(t, []string{"b", "c"}, []string{messages[0].Message, messages[1].Message})
+
+	assert.NoError(t, sender.WriteJSON(engine.Message{Message: "d", TargetIds: []string{"u2"}, SourceId: "u1"}))
+	messages = readMessages(t, receiver, 1)
+	assert.Equal(t, uint64(4), messages[0].Seq)
+	receiver.Close()
+	waitDevices(t, h, "u2", 0)
+
+	// 历史只保存 3 条，1 之后的消息已经不全，通知全量同步
+	receiver = dialQuery(t, server, "client_id=u2&seq=0")
+	messages = readMessages(t, receiver, 1)
+	assert.Equal(t, engine.TypeResync, messages[0].Type)
+}
+
+func TestHub_SequenceOrder(t *testing.T) {
+	var server *engine.Engine
+	h, ts := newStandaloneServer(t, func(e *engine.Engine) {
+		e.Config.Sequence = config.Sequence{Enabled: true, History: 1000}
+		server = e
+	})
+	receiver := dial(t, ts, "u2")
+	waitOnline(t, h, "u2")
+
+	// 并发发给同一个用户，收到的序号必须递增，否则断线续传时会漏掉消息
+	const count = 200
+	var wg sync.WaitGroup
+	for i := 0; i < count; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			h.SendMessage(h.Context, &engine.Message{Message: fmt.Sprint(i), TargetIds: []string{"u2"}, SourceId: "system"}, server)
+		}(i)
+	}
+	wg.Wait()
+
+	expected := make([]uint64, 0, count)
+	received := make([]uint64, 0, count)
+	for i, message := range readMessages(t, receiver, count) {
+		expected = append(expected, uint64(i+1))
+		received = append(received, message.Seq)
+	}
+	assert.Equal(t, expected, received)
+}
+
+func TestHub_SequenceReentrant(t *testing.T) {
+	var h *Hub
+	h, ts := newStandaloneServer(t, func(e *engine.Engine) {
+		e.Config.Sequence = config.Sequence{Enabled: true, History: 1000}
+		// 投递时给同一个用户再发一条，不能卡住这个用户的投递
+		e.UseReceive(func(next engine.Handler) engine.Handler {
+			return func(c *engine.Context) error {
+				if c.Message.Message == "ping" {
+					h.SendMessage(c.WS, &engine.Message{Message: "pong", TargetIds: []string{"u2"}, SourceId: "system"}, e)
+				}
+				return next(c)
+			}
+		})
+	})
+	receiver := dial(t, ts, "u2")
+	sender := dial(t, ts, "u1")
+	waitOnline(t, h, "u2")
+	waitOnline(t, h, "u1")
+
+	assert.NoError(t, sender.WriteJSON(engine.Message{Message: "ping", TargetIds: []string{"u2"}, Seq: 99}))
+	messages := readMessages(t, receiver, 2)
+	assert.Equal(t, []string{"ping", "pong"}, []string{messages[0].Message, messages[1].Message})
+	// 客户端填写的序号被忽略
+	assert.Equal(t, []uint64{1, 2}, []uint64{messages[0].Seq, messages[1].Seq})
+}
+
+func TestHub_Version(t *testing.T) {
+	h, server := newStandaloneServer(t)
+	sender := dialQuery(t, server, "client_id=u1&version=2")
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/ws?client_id=u2&version=3"
+	v2, resp, err := websocket.DefaultDialer.Dial(url, nil)
+	assert.NoError(t, err)
+	t.Cleanup(func() { v2.Close() })
+	assert.Equal(t, "2", resp.Header.Get(versionHeader))
+	v1 := dial(t, server, "u2")
+	waitDevices(t, h, "u2", 2)
+
+	assert.NoError(t, sender.WriteJSON(engine.Message{
+		Message:     `{"text":"hi"}`,
+		TargetIds:   []string{"u2"},
+		SourceId:    "u1",
+		Type:        3,
+		Headers:     map[string]string{"trace-id": "t1"},
+		ContentType: "application/json",
+	}))
+
+	message := readMessages(t, v2, 1)[0]
+	assert.Equal(t, engine.Version2, message.Version)
+	assert.Equal(t, int64(3), message.Type)
+	assert.Equal(t, map[string]string{"trace-id": "t1"}, message.Headers)
+	assert.Equal(t, "application/json", message.ContentType)
+	assert.NotZero(t, message.Timestamp)
+	assert.NotEmpty(t, message.Id)
+
+	// v1 客户端收到的还是原来的格式
+	v1.SetReadDeadline(time.Now().Add(time.Second))
+	_, data, err := v1.ReadMessage()
+	assert.NoError(t, err)
+	var fields map[string]any
+	assert.NoError(t, json.Unmarshal(data, &fields))
+	for _, field := range []string{"version", "timestamp", "headers", "content_type"} {
+		assert.NotContains(t, fields, field)
+	}
+	assert.Equal(t, `{"text":"hi"}`, fields["message"])
+}
+
+func dialCodec(t *testing.T, server *httptest.Server, clientId string, protocols ...string) (*websocket.Conn, string) {
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/ws?client_id=" + clientId
+	dialer := websocket.Dialer{Subprotocols: protocols}
+	conn, _, err := dialer.Dial(url, nil)
+	assert.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	return conn, conn.Subprotocol()
+}
+
+func TestHub_Codec(t *testing.T) {
+	h, server := newStandaloneServer(t)
+	sender, protocol := dialCodec(t, server, "u1", "unknown", codec.NameMsgPack, codec.NameJSON)
+	assert.Equal(t, codec.NameMsgPack, protocol)
+	receiver, protocol := dialCodec(t, server, "u2", codec.NameProtobuf)
+	assert.Equal(t, codec.NameProtobuf, protocol)
+	// 没有子协议时使用 JSON
+	legacy, protocol := dialCodec(t, server, "u2")
+	assert.Empty(t, protocol)
+	waitDevices(t, h, "u2", 2)
+
+	data := []byte{0, 1, 0xfe, 0xff}
+	frame, err := codec.MsgPack.Marshal(&engine.Message{TargetIds: []string{"u2"}, SourceId: "u1", Type: 3, Data: data})
+	assert.NoError(t, err)
+	assert.NoError(t, sender.WriteMessage(websocket.BinaryMessage, frame))
+
+	receiver.SetReadDeadline(time.Now().Add(time.Second))
+	frameType, frame, err := receiver.ReadMessage()
+	assert.NoError(t, err)
+	assert.Equal(t, websocket.BinaryMessage, frameType)
+	message := &engine.Message{}
+	assert.NoError(t, codec.Protobuf.Unmarshal(frame, message))
+	assert.Equal(t, data, message.Data)
+	assert.Equal(t, "u1", message.SourceId)
+
+	// JSON 客户端收到 base64 编码的 Data
+	messages := readMessages(t, legacy, 1)
+	assert.Equal(t, data, messages[0].Data)
+}
+
+func TestHub_BrokerCodec(t *testing.T) {
+	c := config.NewStandaloneConfig("127.0.0.1", ":0", 10)
+	c.BrokerCodec = codec.NameProtobuf
+	e := engine.NewEngine(c)
+	b := &fakeBroker{deliveries: make(chan *broker.Delivery), results: make(chan string)}
+	h := NewHub(wsContext.WSContext{Context: context.Background(), Broker: b, Registry: registry.NewMemoryRegistry()})
+	go h.consume(h.Context, e)
+
+	client := NewClient(h, nil, "u1")
+	h.Clients.Add(client)
+
+	body, err := codec.Protobuf.Marshal(&engine.Message{Id: "m1", Message: "hi", TargetIds: []string{"u1"}, ConnIds: []string{client.ConnId}})
+	assert.NoError(t, err)
+	b.deliveries <- broker.NewDelivery(body, false, func() error {
+		b.results <- "ack"
+		return nil
+	}, nil)
+	assert.Equal(t, "ack", <-b.results)
+	assert.Equal(t, `{"id":"m1","message":"hi","target_ids":["u1"],"source_id":"","type":0}`, string(<-client.WriteChannel))
+}
+
+func TestHub_WriteStrategy(t *testing.T) {
+	send := func(t *testing.T, write config.Write) [][]byte {
+		h, server := newStandaloneServer(t, func(e *engine.Engine) {
+			e.Config.Write = write
+		})
+		sender := dial(t, server, "u1")
+		receiver := dial(t, server, "u2")
+		waitOnline(t, h, "u2")
+		for i := 0; i < 3; i++ {
+			assert.NoError(t, sender.WriteJSON(engine.Message{Message: fmt.Sprint(i), TargetIds: []string{"u2"}}))
+		}
+		var frames [][]byte
+		receiver.SetReadDeadline(time.Now().Add(time.Second))
+		for received := 0; received < 3; {
+			_, frame, err := receiver.ReadMessage()
+			if !assert.NoError(t, err) {
+				break
+			}
+			frames = append(frames, frame)
+			received += bytes.Count(frame, []byte(`"message"`))
+		}
+		return frames
+	}
+
+	// 默认每条消息单独一帧
+	frames := send(t, config.DefaultWrite())
+	assert.Len(t, frames, 3)
+	for _, frame := range frames {
+		assert.NoError(t, json.Unmarshal(frame, &engine.Message{}))
+	}
+
+	// 等待 FlushInterval 后合并成一个数组
+	frames = send(t, config.Write{Strategy: config.WriteArray, FlushInterval: 200, MaxBatch: 64})
+	assert.Len(t, frames, 1)
+	var messages []engine.Message
+	assert.NoError(t, json.Unmarshal(frames[0], &messages))
+	assert.Len(t, messages, 3)
+
+	// 每帧最多 MaxBatch 条
+	frames = send(t, config.Write{Strategy: config.WriteNewline, FlushInterval: 200, MaxBatch: 2})
+	assert.Len(t, frames, 2)
+	assert.Len(t, bytes.Split(frames[0], []byte("\n")), 2)
+}
+
+func TestHub_Compression(t *testing.T) {
+	h, server := newStandaloneServer(t, func(e *engine.Engine) {
+		e.Config.Compression = config.Compression{Enabled: true, Level: 6, Threshold: 256}
+	})
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/ws?client_id="
+	dialer := websocket.Dialer{EnableCompression: true}
+	sender, _, err := dialer.Dial(url+"u1", nil)
+	assert.NoError(t, err)
+	t.Cleanup(func() { sender.Close() })
+	receiver, resp, err := dialer.Dial(url+"u2", nil)
+	assert.NoError(t, err)
+	t.Cleanup(func() { receiver.Close() })
+	assert.Contains(t, resp.Header.Get("Sec-Websocket-Extensions"), "permessage-deflate")
+	// 客户端不支持压缩
+	plain := dial(t, server, "u2")
+	waitDevices(t, h, "u2", 2)
+
+	long := strings.Repeat("hello world ", 100)
+	assert.NoError(t, sender.WriteJSON(engine.Message{Message: "short", TargetIds: []string{"u2"}}))
+	assert.Equal(t, "short", readMessages(t, receiver, 1)[0].Message)
+	assert.Equal(t, "short", readMessages(t, plain, 1)[0].Message)
+	// 小于 Threshold 的消息不压缩
+	assert.Zero(t, h.CompressionStats().Frames)
+
+	assert.NoError(t, sender.WriteJSON(engine.Message{Message: long, TargetIds: []string{"u2"}}))
+	assert.Equal(t, long, readMessages(t, receiver, 1)[0].Message)
+	assert.Equal(t, long, readMessages(t, plain, 1)[0].Message)
+
+	// 统计在写完之后记录
+	assert.Eventually(t, func() bool {
+		return h.CompressionStats().Frames == 1
+	}, time.Second, 10*time.Millisecond)
+	stats := h.CompressionStats()
+	assert.Greater(t, stats.Bytes, uint64(len(long)))
+	assert.Greater(t, stats.Saved(), int64(len(long)/2))
+}
+
+func TestOffersDeflate(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/ws", nil)
+	assert.False(t, offersDeflate(r))
+	r.Header.Add("Sec-WebSocket-Extensions", "x-foo, permessage-deflate; client_max_window_bits")
+	assert.True(t, offersDeflate(r))
+}
+
+func TestHub_ConnectionRoutes(t *testing.T) {
+	h, server := newStandaloneServer(t, func(e *engine.Engine) {
+		e.Config.Connection.MaxMessageSize = 512
+		e.Config.Connection.Routes = map[string]config.ConnectionOverride{
+			"/ws/large": {MaxMessageSize: 4096},
+		}
+	})
+	base := "ws" + strings.TrimPrefix(server.URL, "http")
+	large, _, err := websocket.DefaultDialer.Dial(base+"/ws/large?client_id=u1", nil)
+	assert.NoError(t, err)
+	t.Cleanup(func() { large.Close() })
+	small := dial(t, server, "u1")
+	receiver := dial(t, server, "u2")
+	waitDevices(t, h, "u1", 2)
+	waitOnline(t, h, "u2")
+
+	payload := strings.Repeat("x", 1024)
+	assert.NoError(t, large.WriteJSON(engine.Message{Message: payload, TargetIds: []string{"u2"}}))
+	assert.Equal(t, payload, readMessages(t, receiver, 1)[0].Message)
+
+	// 超过 /ws 的 MaxMessageSize，连接被关闭
+	assert.NoError(t, small.WriteJSON(engine.Message{Message: payload, TargetIds: []string{"u2"}}))
+	small.SetReadDeadline(time.Now().Add(time.Second))
+	_, _, err = small.ReadMessage()
+	assert.True(t, websocket.IsCloseError(err, websocket.CloseMessageTooBig), "%v", err)
+}
+
+func TestHub_Shutdown(t *testing.T) {
+	h, server := newStandaloneServer(t)
+	sender := dial(t, server, "u1")
+	receiver := dial(t, server, "u2")
+	waitOnline(t, h, "u1")
+	waitOnline(t, h, "u2")
+	assert.Eventually(t, func() bool {
+		nodes, _ := h.Context.Registry.Nodes(context.Background())
+		return len(nodes) == 1
+	}, time.Second, 10*time.Millisecond)
+
+	assert.NoError(t, sender.WriteJSON(engine.Message{Message: "bye", TargetIds: []string{"u2"}}))
+	assert.Equal(t, "bye", readMessages(t, receiver, 1)[0].Message)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	assert.NoError(t, h.Shutdown(ctx))
+
+	for _, conn := range []*websocket.Conn{sender, receiver} {
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		_, _, err := conn.ReadMessage()
+		closeErr := &websocket.CloseError{}
+		if assert.ErrorAs(t, err, &closeErr) {
+			assert.Equal(t, websocket.CloseGoingAway, closeErr.Code)
+			assert.Equal(t, ShutdownReason, closeErr.Text)
+		}
+	}
+	// 在线状态已经注销
+	for _, userId := range []string{"u1", "u2"} {
+		sessions, _ := h.Context.Registry.Lookup(context.Background(), userId)
+		assert.Empty(t, sessions)
+	}
+	nodes, _ := h.Context.Registry.Nodes(context.Background())
+	assert.Empty(t, nodes)
+
+	// 不再接受新连接
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/ws?client_id=u3"
+	_, resp, err := websocket.DefaultDialer.Dial(url, nil)
+	assert.ErrorIs(t, err, websocket.ErrBadHandshake)
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+
+	// 重复调用直接返回
+	assert.NoError(t, h.Shutdown(ctx))
+}
+
+func TestClient_FlushOnClose(t *testing.T) {
+	h := NewHub(wsContext.WSContext{Context: context.Background(), Registry: registry.NewMemoryRegistry()})
+	clients := make(chan *Client, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upGrader.Upgrade(w, r, nil)
+		if !assert.NoError(t, err) {
+			return
+		}
+		client := NewClient(h, conn, "u1")
+		// 关闭前已经在队列中的消息
+		for i := 0; i < 3; i++ {
+			client.WriteChannel <- []byte(fmt.Sprintf(`{"message":"%d"}`, i))
+		}
+		client.closeMessage = websocket.FormatCloseMessage(websocket.CloseGoingAway, ShutdownReason)
+		close(client.closed)
+		clients <- client
+		client.writePump(h.Context)
+	}))
+	t.Cleanup(server.Close)
+	conn := dialQuery(t, server, "")
+	<-clients
+
+	messages := readMessages(t, conn, 3)
+	assert.Equal(t, []string{"0", "1", "2"}, []string{messages[0].Message, messages[1].Message, messages[2].Message})
+	_, _, err := conn.ReadMessage()
+	assert.True(t, websocket.IsCloseError(err, websocket.CloseGoingAway), "%v", err)
+}
+
+func TestClient_CloseIndependent(t *testing.T) {
+	h := NewHub(wsContext.WSContext{Context: context.Background(), Registry: registry.NewMemoryRegistry()})
+	go func() {
+		// 代替 Run 处理注销，没有 RegisterClient 接收 ToOffline
+		for range h.Unregister {
+		}
+	}()
+	t.Cleanup(func() { close(h.Unregister) })
+
+	// 一个连接关闭时不能卡住其他连接的关闭
+	closed := make(chan struct{})
+	go func() {
+		NewClient(h, nil, "u1").Kick(websocket.CloseNormalClosure, "")
+		NewClient(h, nil, "u2").Kick(websocket.CloseNormalClosure, "")
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("close blocked")
+	}
+}
+
+func TestConnections(t *testing.T) {
+	conns := NewConnections()
+	phone := NewClient(nil, nil, "u1")
+	pc := NewClient(nil, nil, "u1")
+	other := NewClient(nil, nil, "u2")
+	for _, c := range []*Client{phone, pc, other} {
+		conns.Add(c)
+	}
+	assert.Equal(t, 3, conns.Count())
+	assert.ElementsMatch(t, []*Client{phone, pc}, conns.User("u1"))
+	client, ok := conns.Get(other.ConnId)
+	assert.True(t, ok)
+	assert.Same(t, other, client)
+
+	// 同一个 ConnId 已经被替换时，旧连接注销不影响新连接
+	replaced := NewClient(nil, nil, "u2")
+	replaced.ConnId = other.ConnId
+	conns.Add(replaced)
+	conns.Remove(other)
+	client, _ = conns.Get(other.ConnId)
+	assert.Same(t, replaced, client)
+	assert.Equal(t, []*Client{replaced}, conns.User("u2"))
+
+	conns.Remove(phone)
+	conns.Remove(replaced)
+	assert.Equal(t, 1, conns.Count())
+	assert.Empty(t, conns.User("u2"))
+	visited := 0
+	conns.Range(func(c *Client) bool {
+		visited++
+		// Range 中可以修改
+		conns.Remove(c)
+		return true
+	})
+	assert.Equal(t, 1, visited)
+	assert.Zero(t, conns.Count())
+	// 用户的连接都删除后不再占用空间
+	for i := range conns.users {
+		assert.Empty(t, conns.users[i].users)
+	}
+}
+
+func TestConnections_Concurrent(t *testing.T) {
+	conns := NewConnections()
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				c := NewClient(nil, nil, fmt.Sprint("u", i))
+				conns.Add(c)
+				conns.Get(c.ConnId)
+				conns.User(c.Id)
+				conns.Range(func(*Client) bool { return false })
+				conns.Remove(c)
+			}
+		}(i)
+	}
+	wg.Wait()
+	assert.Zero(t, conns.Count())
+}
+
+func TestClient_Overflow(t *testing.T) {
+	for _, test := range []struct {
+		policy  string
+		queued  []string
+		stats   OverflowStats
+		evicted bool
+	}{
+		{policy: config.OverflowDropOldest, queued: []string{"1", "2"}, stats: OverflowStats{DroppedOldest: 1}},
+		{policy: config.OverflowDropNewest, queued: []string{"0", "1"}, stats: OverflowStats{DroppedNewest: 1}},
+		{policy: config.OverflowDisconnect, queued: []string{"0", "1"}, stats: OverflowStats{Disconnected: 1}, evicted: true},
+		{policy: config.OverflowBlock, queued: []string{"0", "1"}, stats: OverflowStats{TimedOut: 1}, evicted: true},
+	} {
+		t.Run(test.policy, func(t *testing.T) {
+			h := NewHub(wsContext.WSContext{Context: context.Background(), Registry: registry.NewMemoryRegistry()})
+			evicted := make(chan string, 1)
+			h.OnEvict(func(client *Client, policy string) { evicted <- policy })
+			settings := config.DefaultConnection()
+			settings.SendBuffer = 2
+			settings.Overflow = test.policy
+			settings.OverflowTimeout = 1
+			client := newClient(h, nil, "u1", settings)
+			go func() {
+				// 代替 Run 和 RegisterClient 处理注销
+				<-h.Unregister
+				<-client.ToOffline
+			}()
+
+			for i := 0; i < 3; i++ {
+				client.write("", []byte(fmt.Sprint(i)))
+			}
+			var queued []string
+			for len(client.WriteChannel) > 0 {
+				queued = append(queued, string(<-client.WriteChannel))
+			}
+			assert.Equal(t, test.queued, queued)
+			assert.Equal(t, test.stats, client.OverflowStats())
+			assert.Equal(t, test.stats, h.OverflowStats())
+			if !test.evicted {
+				assert.Empty(t, evicted)
+				return
+			}
+			assert.Equal(t, test.policy, <-evicted)
+			select {
+			case <-client.closed:
+			case <-time.After(time.Second):
+				t.Fatal("slow consumer was not disconnected")
+			}
+			assert.Equal(t, websocket.FormatCloseMessage(websocket.ClosePolicyViolation, SlowConsumerReason), client.closeMessage)
+			// 关闭后不再写入，也不再计数
+			client.write("", []byte("3"))
+			assert.Equal(t, test.stats, client.OverflowStats())
+		})
+	}
+}
+
+func TestHub_Authenticate(t *testing.T) {
+	keys := auth.NewAPIKeys(
+		auth.APIKey{Key: "k1", UserId: "u1", Roles: []string{"user"}},
+		auth.APIKey{Key: "k2", UserId: "u2", Roles: []string{"guest"}},
+	)
+	authenticator := auth.RequireRoles(keys, "user")
+	h, server := newStandaloneServer(t, func(e *engine.Engine) { e.SetAuthenticator(authenticator) })
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/ws?"
+
+	for query, status := range map[string]int{
+		"client_id=u1": http.StatusUnauthorized,
+		"api_key=bad":  http.StatusUnauthorized,
+		"api_key=k2":   http.StatusForbidden,
+	} {
+		_, resp, err := websocket.DefaultDialer.Dial(url+query, nil)
+		assert.ErrorIs(t, err, websocket.ErrBadHandshake, query)
+		assert.Equal(t, status, resp.StatusCode, query)
+		if status == http.StatusUnauthorized {
+			assert.Equal(t, "Bearer", resp.Header.Get("WWW-Authenticate"), query)
+		}
+	}
+	assert.Zero(t, h.Clients.Count())
+
+	dialQuery(t, server, "api_key=k1&client_id=forged")
+	waitOnline(t, h, "u1")
+	clients := h.Clients.User("u1")
+	assert.Len(t, clients, 1)
+	assert.Equal(t, []string{"user"}, clients[0].Identity().Roles)
+	assert.Empty(t, h.Clients.User("forged"))
+}
+
+func TestHub_TokenExpiry(t *testing.T) {
+	h, server := newStandaloneServer(t, func(e *engine.Engine) {
+		e.SetAuthenticator(auth.NewJWT("secret"))
+		e.Config.Connection.ExpiryWarning = 1
+	})
+	token := func(userId string, expiresAt time.Time) string {
+		signed, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"client_id": userId, "exp": expiresAt.Unix()}).SignedString([]byte("secret"))
+		assert.NoError(t, err)
+		return signed
+	}
+	read := func(conn *websocket.Conn) engine.Message {
+		conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+		message := engine.Message{}
+		assert.NoError(t, conn.ReadJSON(&message))
+		return message
+	}
+	expiresAt := time.Now().Add(2 * time.Second)
+	refreshed := dialQuery(t, server, "token="+token("u1", expiresAt))
+	expired := dialQuery(t, server, "token="+token("u2", expiresAt))
+	waitOnline(t, h, "u1")
+	waitOnline(t, h, "u2")
+
+	for _, conn := range []*websocket.Conn{refreshed, expired} {
+		message := read(conn)
+		assert.Equal(t, engine.TypeTokenExpiring, message.Type)
+		assert.Equal(t, fmt.Sprint(expiresAt.Unix()), message.Message)
+	}
+
+	// 只能换成同一个用户的有效 token
+	for token, code := range map[string]int{
+		token("u2", time.Now().Add(time.Hour)): engine.RPCForbidden,
+		"garbage":                              engine.RPCUnauthorized,
+	} {
+		assert.NoError(t, refreshed.WriteJSON(engine.Message{Type: engine.TypeReauth, RequestId: "1", Message: token}))
+		reply := read(refreshed)
+		assert.Equal(t, engine.TypeReauth, reply.Type)
+		if assert.NotNil(t, reply.Error) {
+			assert.Equal(t, code, reply.Error.Code)
+		}
+	}
+	renewed := time.Now().Add(time.Hour)
+	assert.NoError(t, refreshed.WriteJSON(engine.Message{Type: engine.TypeReauth, RequestId: "2", Message: token("u1", renewed)}))
+	reply := read(refreshed)
+	assert.Nil(t, reply.Error)
+	assert.Equal(t, "2", reply.RequestId)
+	assert.Equal(t, fmt.Sprint(renewed.Unix()), reply.Message)
+
+	// 没有更换 token 的连接在过期时关闭
+	expired.SetReadDeadline(time.Now().Add(3 * time.Second))
+	_, _, err := expired.ReadMessage()
+	assert.True(t, websocket.IsCloseError(err, CloseTokenExpired), "%v", err)
+
+	// 更换过 token 的连接过了原来的过期时间还可以收发消息
+	time.Sleep(time.Until(expiresAt.Add(500 * time.Millisecond)))
+	assert.NoError(t, refreshed.WriteJSON(engine.Message{Message: "still here", TargetIds: []string{"u1"}}))
+	assert.Equal(t, "still here", read(refreshed).Message)
+	assert.Equal(t, renewed.Unix(), h.Clients.User("u1")[0].Identity().ExpiresAt.Unix())
+}
+
+func TestHub_TokenLeeway(t *testing.T) {
+	authenticator, err := auth.NewJWTFromConfig(config.JWT{AccessSecret: "secret", Leeway: 60})
+	assert.NoError(t, err)
+	h, server := newStandaloneServer(t, func(e *engine.Engine) {
+		e.SetAuthenticator(authenticator)
+		e.Config.Connection.ExpiryWarning = 0
+	})
+	// 已经过期 5 秒，在允许的误差内，不能一连接就被关闭
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"client_id": "u1", "exp": time.Now().Add(-5 * time.Second).Unix()}).SignedString([]byte("secret"))
+	assert.NoError(t, err)
+	conn := dialQuery(t, server, "token="+token)
+	waitOnline(t, h, "u1")
+
+	assert.NoError(t, conn.WriteJSON(engine.Message{Message: "in leeway", TargetIds: []string{"u1"}}))
+	messages := readMessages(t, conn, 1)
+	if assert.Len(t, messages, 1) {
+		assert.Equal(t, "in leeway", messages[0].Message)
+	}
+}
+
+func TestHub_Authorize(t *testing.T) {
+	h, server := newStandaloneServer(t, func(e *engine.Engine) {
+		e.SetAuthorizer(engine.BlockList(func(ctx context.Context, userId, senderId string) (bool, error) {
+			return userId == "u3", nil
+		}))
+		// 插件替换消息后仍然按真正的发送方检查
+		e.SetSendHandlers([]engine.HandlersFunc{rebuild})
+		// 路由直接回复的消息也要检查
+		e.Router.Handle(7, func(c *engine.Context) error {
+			c.ReplyWith(&engine.Message{Message: "ok"})
+			return nil
+		})
+	})
+	sender := dial(t, server, "u1")
+	receiver := dial(t, server, "u2")
+	dial(t, server, "u3")
+	waitOnline(t, h, "u2")
+	waitOnline(t, h, "u3")
+
+	// 客户端填写的 source_id 会被覆盖
+	assert.NoError(t, sender.WriteJSON(engine.Message{Message: "hello", TargetIds: []string{"u2"}, SourceId: "admin"}))
+	receiver.SetReadDeadline(time.Now().Add(time.Second))
+	message := engine.Message{}
+	assert.NoError(t, receiver.ReadJSON(&message))
+	assert.Equal(t, "u1", message.SourceId)
+
+	// 被拒绝时只回复发送方，不投递给任何人
+	assert.NoError(t, sender.WriteJSON(engine.Message{Message: "hi", TargetIds: []string{"u2", "u3"}, RequestId: "r1"}))
+	sender.SetReadDeadline(time.Now().Add(time.Second))
+	reject := engine.Message{}
+	assert.NoError(t, sender.ReadJSON(&reject))
+	assert.Equal(t, engine.TypeError, reject.Type)
+	assert.Equal(t, "r1", reject.RequestId)
+	if assert.NotNil(t, reject.Error) {
+		assert.Equal(t, engine.RPCForbidden, reject.Error.Code)
+		assert.Equal(t, "u3 has blocked u1", reject.Error.Message)
+	}
+	receiver.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	_, _, err := receiver.ReadMessage()
+	assert.Error(t, err)
+
+	// 路由处理之前就被拒绝，不会收到路由的回复
+	assert.NoError(t, sender.WriteJSON(engine.Message{Type: 7, TargetIds: []string{"u3"}, RequestId: "r2"}))
+	sender.SetReadDeadline(time.Now().Add(time.Second))
+	reject = engine.Message{}
+	assert.NoError(t, sender.ReadJSON(&reject))
+	assert.Equal(t, engine.TypeError, reject.Type)
+	assert.Equal(t, "r2", reject.RequestId)
+}
+
+func TestHub_AuthorizeRoom(t *testing.T) {
+	tenants := map[string]string{"u1": "t1", "u2": "t1", "u3": "t2"}
+	tenantOf := func(ctx context.Context, userId string) (string, error) {
+		return tenants[userId], nil
+	}
+	h, server := newStandaloneServer(t, func(e *engine.Engine) {
+		e.SetAuthenticator(auth.AuthenticatorFunc(func(r *http.Request) (*auth.Identity, error) {
+			userId := r.URL.Query().Get("client_id")
+			return &auth.Identity{UserId: userId, Tenant: tenants[userId]}, nil
+		}))
+		e.SetAuthorizer(engine.Authorizers(engine.TenantBoundary(tenantOf), engine.RoomMembership()))
+	})
+	members := func() int {
+		found, _ := h.Context.Registry.RoomMembers(context.Background(), "lobby")
+		return len(found)
+	}
+	owner := dial(t, server, "u1")
+	outsider := dial(t, server, "u3")
+	waitOnline(t, h, "u1")
+	waitOnline(t, h, "u3")
+
+	assert.NoError(t, owner.WriteJSON(engine.Message{Type: engine.TypeJoinRoom, Room: "lobby"}))
+	assert.Eventually(t, func() bool { return members() == 1 }, time.Second, 10*time.Millisecond)
+
+	// 其他租户的用户不能加入，也就不能发送房间消息
+	assert.NoError(t, outsider.WriteJSON(engine.Message{Type: engine.TypeJoinRoom, Room: "lobby", RequestId: "j1"}))
+	assert.NoError(t, outsider.WriteJSON(engine.Message{Message: "hi", Room: "lobby", RequestId: "m1"}))
+	for _, reject := range readMessages(t, outsider, 2) {
+		assert.Equal(t, engine.TypeError, reject.Type)
+		if assert.NotNil(t, reject.Error, reject.RequestId) {
+			assert.Equal(t, engine.RPCForbidden, reject.Error.Code, reject.RequestId)
+		}
+	}
+	assert.Equal(t, 1, members())
+	owner.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	_, _, err := owner.ReadMessage()
+	assert.Error(t, err)
+
+	// 同一个租户的用户可以加入
+	member := dial(t, server, "u2")
+	waitOnline(t, h, "u2")
+	assert.NoError(t, member.WriteJSON(engine.Message{Type: engine.TypeJoinRoom, Room: "lobby"}))
+	assert.Eventually(t, func() bool { return members() == 2 }, time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,83 @@
+package hub
+
+import (
+	"encoding/json"
+	"log"
+	"sort"
+
+	"github.com/WangSiangCun/go-ws/codec"
+	"github.com/WangSiangCun/go-ws/engine"
+	"github.com/WangSiangCun/go-ws/registry"
+	"github.com/WangSiangCun/go-ws/wsContext"
+)
+
+// offlineTargets targetIds 中没有在线连接的用户
+func offlineTargets(targetIds []string, sessions []registry.Session) []string {
+	online := make(map[string]struct{}, len(sessions))
+	for _, session := range sessions {
+		online[session.UserId] = struct{}{}
+	}
+	var offline []string
+	for _, targetId := range targetIds {
+		if _, ok := online[targetId]; !ok {
+			offline = append(offline, targetId)
+		}
+	}
+	return offline
+}
+
+// saveOffline 为 userIds 保存离线消息，控制消息和广播不保存
+func (h *Hub) saveOffline(ws wsContext.WSContext, message *engine.Message, userIds []string) {
+	if ws.Offline == nil || len(userIds) == 0 || message.Type < 0 || message.Broadcast {
+		return
+	}
+	toClient := *message
+	toClient.ConnIds = nil
+	body, err := json.Marshal(&toClient)
+	if err != nil {
+		log.Printf("error: %v", err)
+		return
+	}
+	for _, userId := range userIds {
+		if err = ws.Offline.Save(ws.Context, userId, body); err != nil {
+			log.Printf("save offline message for %s error: %v", userId, err)
+		}
+	}
+}
+
+// saveUnacked 连接断开时还没有确认的消息重新保存为离线消息
+func (h *Hub) saveUnacked(ws wsContext.WSContext, c *Client) {
+	if ws.Offline == nil {
+		return
+	}
+	c.ackMu.Lock()
+	pending := make([]*unacked, 0, len(c.unacked))
+	for _, message := range c.unacked {
+		pending = append(pending, message)
+	}
+	c.unacked = make(map[string]*unacked)
+	c.ackMu.Unlock()
+
+	sort.Slice(pending, func(i, j int) bool {
+		return pending[i].seq < pending[j].seq
+	})
+	for _, message := range pending {
+		// 发给客户端的帧按连接的编码，离线消息统一保存为 JSON
+		body := message.data
+		if c.Codec != codec.JSON {
+			decoded := &engine.Message{}
+			if err := c.Codec.Unmarshal(body, decoded); err != nil {
+				log.Printf("error: %v", err)
+				continue
+			}
+			var err error
+			if body, err = json.Marshal(decoded); err != nil {
+				log.Printf("error: %v", err)
+				continue
+			}
+		}
+		if err := ws.Offline.Save(ws.Context, c.Id, body); err != nil {
+			log.Printf("save unacked message for %s error: %v", c.Id, err)
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package hub
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/WangSiangCun/go-ws/config"
+	"github.com/gorilla/websocket"
+)
+
+// SlowConsumerReason 消息队列满被断开时的关闭原因，关闭码为 1008
+const SlowConsumerReason = "slow consumer"
+
+// OverflowStats 消息队列满时各处理方式的次数
+type OverflowStats struct {
+	// DroppedOldest drop-oldest 丢弃的消息数
+	DroppedOldest uint64
+	// DroppedNewest drop-newest 丢弃的消息数
+	DroppedNewest uint64
+	// Disconnected disconnect 断开的连接数
+	Disconnected uint64
+	// TimedOut block 等待超时后断开的连接数
+	TimedOut uint64
+}
+
+type overflowCounter struct {
+	droppedOldest atomic.Uint64
+	droppedNewest atomic.Uint64
+	disconnected  atomic.Uint64
+	timedOut      atomic.Uint64
+}
+
+func (c *overflowCounter) stats() OverflowStats {
+	return OverflowStats{
+		DroppedOldest: c.droppedOldest.Load(),
+		DroppedNewest: c.droppedNewest.Load(),
+		Disconnected:  c.disconnected.Load(),
+		TimedOut:      c.timedOut.Load(),
+	}
+}
+
+// OverflowStats 这个连接的消息队列满的次数
+func (c *Client) OverflowStats() OverflowStats {
+	return c.overflowed.stats()
+}
+
+// OverflowStats 本节点所有连接的消息队列满的次数
+func (h *Hub) OverflowStats() OverflowStats {
+	return h.overflowed.stats()
+}
+
+// OnEvict 设置连接因为消息队列满被断开时的回调，policy 为 disconnect 或 block，需要在 ServeWs 之前调用
+func (h *Hub) OnEvict(fn func(client *Client, policy string)) {
+	h.onEvict = fn
+}
+
+// enqueue 把 data 放进 WriteChannel，满了按 Overflow 处理，不会无限阻塞
+func (c *Client) enqueue(data []byte) {
+	select {
+	case c.WriteChannel <- data:
+		return
+	case <-c.closed:
+		// 连接已经关闭，不再写入
+		return
+	default:
+	}
+	switch c.settings.Overflow {
+	case config.OverflowDropOldest:
+		for {
+			select {
+			case <-c.WriteChannel:
+				c.count(func(o *overflowCounter) { o.droppedOldest.Add(1) })
+			default:
+				// writePump 刚好取走了一条
+			}
+			select {
+			case c.WriteChannel <- data:
+				return
+			case <-c.closed:
+				return
+			default:
+				// 其他协程先放进了新消息，再丢一条
+			}
+		}
+	case config.OverflowDropNewest:
+		c.count(func(o *overflowCounter) { o.droppedNewest.Add(1) })
+	case config.OverflowDisconnect:
+		c.evict(config.OverflowDisconnect)
+	default:
+		timer := time.NewTimer(time.Duration(c.settings.OverflowTimeout) * time.Second)
+		defer timer.Stop()
+		select {
+		case c.WriteChannel <- data:
+		case <-c.closed:
+		case <-timer.C:
+			c.evict(config.OverflowBlock)
+		}
+	}
+}
+
+// evict 断开来不及接收的连接，只计数和回调一次
+func (c *Client) evict(policy string) {
+	if !c.evicted.CompareAndSwap(false, true) {
+		return
+	}
+	if policy == config.OverflowDisconnect {
+		c.count(func(o *overflowCounter) { o.disconnected.Add(1) })
+	} else {
+		c.count(func(o *overflowCounter) { o.timedOut.Add(1) })
+	}
+	if c.Hub != nil && c.Hub.onEvict != nil {
+		c.Hub.onEvict(c, policy)
+	}
+	// Kick 需要等 Run 处理注销，不能在投递的协程中等待
+	go c.Kick(websocket.ClosePolicyViolation, SlowConsumerReason)
+}
+
+// count 同时记在连接和 Hub 上
+func (c *Client) count(add func(o *overflowCounter)) {
+	add(&c.overflowed)
+	if c.Hub != nil {
+		add(&c.Hub.overflowed)
+	}
+}
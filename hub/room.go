@@ -0,0 +1,37 @@
+package hub
+
+import (
+	"github.com/WangSiangCun/go-ws/registry"
+	"github.com/WangSiangCun/go-ws/wsContext"
+)
+
+// JoinRoom 连接加入房间，成员关系保存在 Registry 中，连接断开时自动退出，房间名不能为空或者包含 "/"
+func (h *Hub) JoinRoom(ws wsContext.WSContext, room, clientId, connId string) error {
+	if err := registry.ValidateName(room); err != nil {
+		return err
+	}
+	return ws.Registry.JoinRoom(ws.Context, room, clientId, connId)
+}
+
+// LeaveRoom 连接退出房间
+func (h *Hub) LeaveRoom(ws wsContext.WSContext, room, clientId, connId string) error {
+	if err := registry.ValidateName(room); err != nil {
+		return err
+	}
+	return ws.Registry.LeaveRoom(ws.Context, room, clientId, connId)
+}
+
+// roomSessions 房间内除了发送的连接以外的所有连接，发送者的其他设备也能收到
+func (h *Hub) roomSessions(ws wsContext.WSContext, room, senderConnId string) ([]registry.Session, error) {
+	members, err := ws.Registry.RoomMembers(ws.Context, room)
+	if err != nil {
+		return nil, err
+	}
+	sessions := members[:0]
+	for _, session := range members {
+		if session.ConnId != senderConnId {
+			sessions = append(sessions, session)
+		}
+	}
+	return sessions, nil
+}
@@ -0,0 +1,216 @@
+package hub
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"sync"
+
+	"github.com/WangSiangCun/go-ws/engine"
+	"github.com/WangSiangCun/go-ws/registry"
+	"github.com/WangSiangCun/go-ws/sequence"
+	"github.com/WangSiangCun/go-ws/wsContext"
+)
+
+// userStream 用户收到的所有消息共用一个序号流
+func userStream(userId string) string {
+	return "user/" + userId
+}
+
+// routeSequenced 每个接收方用户单独分配序号，所以按用户拆成多条消息，再按节点分组发布
+func (h *Hub) routeSequenced(ws wsContext.WSContext, e *engine.Engine, message *engine.Message,
+	sessions []registry.Session, offline []string) {
+	userSessions := map[string][]registry.Session{}
+	var userIds []string
+	for _, session := range sessions {
+		if _, ok := userSessions[session.UserId]; !ok {
+			userIds = append(userIds, session.UserId)
+		}
+		userSessions[session.UserId] = append(userSessions[session.UserId], session)
+	}
+	for _, userId := range append(userIds, offline...) {
+		h.routeStream(ws, e, message, userId, userSessions[userId])
+	}
+}
+
+// seqStream 一个用户的序号流，assign 保证分配序号和入队的顺序一致，
+// 队列由一个协程在锁外按顺序投递，慢的连接或者投递时再发消息都不会卡住其他用户
+type seqStream struct {
+	assign sync.Mutex
+
+	mu      sync.Mutex
+	queue   []stamped
+	running bool
+	// refs 正在分配序号的 routeStream 和投递协程的个数，由分片锁保护
+	refs int
+}
+
+// stamped 分配了序号、等待投递的消息
+type stamped struct {
+	message  *engine.Message
+	body     []byte
+	sessions []registry.Session
+}
+
+// streamShard 按用户分片保存序号流，没有待投递的消息时删除
+type streamShard struct {
+	mu      sync.Mutex
+	streams map[string]*seqStream
+}
+
+// routeStream 分配序号后放入 userId 的队列，本节点上同一个用户的消息按序号的顺序进入连接的队列和 Broker
+func (h *Hub) routeStream(ws wsContext.WSContext, e *engine.Engine, message *engine.Message,
+	userId string, sessions []registry.Session) {
+	stream := h.acquireStream(userId)
+	stream.assign.Lock()
+	toMessage, body := h.stamp(ws, message, userId)
+	stream.mu.Lock()
+	stream.queue = append(stream.queue, stamped{message: toMessage, body: body, sessions: sessions})
+	start := !stream.running
+	stream.running = true
+	stream.mu.Unlock()
+	stream.assign.Unlock()
+	if start {
+		// 这次的引用交给投递协程，退出时释放
+		go h.drainStream(ws, e, userId, stream)
+		return
+	}
+	h.releaseStream(userId, stream)
+}
+
+// drainStream 按入队顺序保存历史并投递，队列为空时退出
+func (h *Hub) drainStream(ws wsContext.WSContext, e *engine.Engine, userId string, stream *seqStream) {
+	for {
+		stream.mu.Lock()
+		if len(stream.queue) == 0 {
+			stream.running = false
+			stream.mu.Unlock()
+			h.releaseStream(userId, stream)
+			return
+		}
+		next := stream.queue[0]
+		stream.queue[0] = stamped{}
+		stream.queue = stream.queue[1:]
+		stream.mu.Unlock()
+
+		if next.body != nil {
+			if err := ws.Sequence.Append(ws.Context, userStream(userId), next.message.Seq, next.body); err != nil {
+				log.Printf("append history for %s error: %v", userId, err)
+			}
+		}
+		if len(next.sessions) > 0 {
+			h.publishSessions(ws, e, next.message, next.sessions)
+		} else {
+			h.saveOffline(ws, next.message, []string{userId})
+		}
+	}
+}
+
+func (h *Hub) acquireStream(userId string) *seqStream {
+	shard := &h.streams[shardIndex(userId)]
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	if shard.streams == nil {
+		shard.streams = make(map[string]*seqStream)
+	}
+	stream, ok := shard.streams[userId]
+	if !ok {
+		stream = &seqStream{}
+		shard.streams[userId] = stream
+	}
+	stream.refs++
+	return stream
+}
+
+// releaseStream 释放 acquireStream 的引用，没有人使用时删除
+func (h *Hub) releaseStream(userId string, stream *seqStream) {
+	shard := &h.streams[shardIndex(userId)]
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	stream.refs--
+	if stream.refs == 0 {
+		delete(shard.streams, userId)
+	}
+}
+
+// stamp 为发给 userId 的消息分配序号，返回要保存到历史的 JSON，失败时不带序号继续投递
+func (h *Hub) stamp(ws wsContext.WSContext, message *engine.Message, userId string) (*engine.Message, []byte) {
+	toMessage := *message
+	toMessage.TargetIds = []string{userId}
+	toMessage.ConnIds = nil
+	seq, err := ws.Sequence.Next(ws.Context, userStream(userId))
+	if err != nil {
+		log.Printf("next seq for %s error: %v", userId, err)
+		return &toMessage, nil
+	}
+	toMessage.Seq = seq
+	body, err := json.Marshal(&toMessage)
+	if err != nil {
+		log.Printf("error: %v", err)
+		return &toMessage, nil
+	}
+	return &toMessage, body
+}
+
+// replay 连接注册后依次补发历史消息、离线消息和补发期间暂存的新消息，按序号去重
+func (h *Hub) replay(ws wsContext.WSContext, c *Client) {
+	seen := map[uint64]struct{}{}
+	write := func(body []byte) {
+		message := &engine.Message{}
+		if err := json.Unmarshal(body, message); err != nil {
+			log.Printf("error: %v", err)
+			return
+		}
+		if message.Seq != 0 {
+			if _, ok := seen[message.Seq]; ok || (c.resume && message.Seq <= c.resumeSeq) {
+				// 客户端已经收到过
+				return
+			}
+			seen[message.Seq] = struct{}{}
+		}
+		// 保存的是完整的 JSON 消息，按连接的版本和编码重新编码
+		frame, err := c.encode(message)
+		if err != nil {
+			log.Printf("error: %v", err)
+			return
+		}
+		c.write(message.Id, frame)
+	}
+
+	if c.resume && ws.Sequence != nil {
+		history, err := ws.Sequence.Since(ws.Context, userStream(c.Id), c.resumeSeq)
+		switch {
+		case errors.Is(err, sequence.ErrGap):
+			if resync, err := c.encode(&engine.Message{Type: engine.TypeResync, TargetIds: []string{c.Id}}); err == nil {
+				c.write("", resync)
+			}
+		case err != nil:
+			log.Printf("load history for %s error: %v", c.Id, err)
+		}
+		for _, body := range history {
+			write(body)
+		}
+	}
+	if ws.Offline != nil {
+		messages, err := ws.Offline.Drain(ws.Context, c.Id)
+		if err != nil {
+			log.Printf("load offline messages for %s error: %v", c.Id, err)
+		}
+		for _, body := range messages {
+			write(body)
+		}
+	}
+
+	c.replayMu.Lock()
+	defer c.replayMu.Unlock()
+	for _, out := range c.held {
+		if out.seq != 0 {
+			if _, ok := seen[out.seq]; ok {
+				continue
+			}
+		}
+		c.write(out.id, out.data)
+	}
+	c.held = nil
+	c.replaying = false
+}
@@ -0,0 +1,76 @@
+package hub
+
+import (
+	"context"
+	"log"
+
+	"github.com/gorilla/websocket"
+)
+
+// ShutdownReason 关闭时发给客户端的关闭原因，客户端收到 1001 和这个原因后应该重新连接（负载均衡到其他节点）
+const ShutdownReason = "server shutting down, reconnect"
+
+// Shutdown 停止接受新连接，写完每个连接队列中的消息后以 1001 关闭，注销所有连接和本节点的在线状态，
+// 再关闭 Broker 的消费者，全部完成或者 ctx 结束时返回
+func (h *Hub) Shutdown(ctx context.Context) error {
+	h.shutdownMu.Lock()
+	if !h.shuttingDown {
+		h.shuttingDown = true
+		close(h.closing)
+	}
+	h.shutdownMu.Unlock()
+
+	// 等待所有连接写完消息并注销在线状态
+	if err := wait(ctx, h.active.Wait); err != nil {
+		return err
+	}
+
+	// 连接都已关闭，停止消费，还没处理的消息由 Broker 重新投递给其他节点或者过期
+	if h.Context.Broker != nil {
+		if err := h.Context.Broker.Close(); err != nil {
+			log.Printf("close broker error: %v", err)
+		}
+	}
+	h.stopOnce.Do(func() { close(h.done) })
+	return wait(ctx, h.workers.Wait)
+}
+
+// accept 没有关闭时为新连接计数，返回 false 表示正在关闭
+func (h *Hub) accept() bool {
+	h.shutdownMu.Lock()
+	defer h.shutdownMu.Unlock()
+	if h.shuttingDown {
+		return false
+	}
+	// writePump 退出并且注销在线状态后减一
+	h.active.Add(1)
+	return true
+}
+
+// goWorker 启动后台任务，Shutdown 等待它退出
+func (h *Hub) goWorker(fn func()) {
+	h.workers.Add(1)
+	go func() {
+		defer h.workers.Done()
+		fn()
+	}()
+}
+
+// closeForShutdown 写完消息后以 1001 关闭连接
+func (c *Client) closeForShutdown() {
+	c.Kick(websocket.CloseGoingAway, ShutdownReason)
+}
+
+func wait(ctx context.Context, fn func()) error {
+	done := make(chan struct{})
+	go func() {
+		fn()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,115 @@
+package hub
+
+import (
+	"time"
+
+	"github.com/WangSiangCun/go-ws/config"
+)
+
+var (
+	arrayStart = []byte{'['}
+	arrayEnd   = []byte{']'}
+	comma      = []byte{','}
+)
+
+// batching 是否把多条消息合并成一帧，二进制编码没有分隔符，不合并
+func (c *Client) batching() bool {
+	if c.Codec.Binary() {
+		return false
+	}
+	return c.writeConfig.Strategy == config.WriteArray || c.writeConfig.Strategy == config.WriteNewline
+}
+
+// collect 从 WriteChannel 中取出要和 first 合并的消息
+func (c *Client) collect(first []byte) [][]byte {
+	batch := [][]byte{first}
+	if !c.batching() {
+		return batch
+	}
+	var timeout <-chan time.Time
+	if c.writeConfig.FlushInterval > 0 {
+		timer := time.NewTimer(time.Duration(c.writeConfig.FlushInterval) * time.Millisecond)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	maxBatch := max(c.writeConfig.MaxBatch, 1)
+	for len(batch) < maxBatch {
+		var message []byte
+		if timeout == nil {
+			// 不等待，只取已经在队列中的消息
+			select {
+			case message = <-c.WriteChannel:
+			default:
+				return batch
+			}
+		} else {
+			select {
+			case message = <-c.WriteChannel:
+			case <-timeout:
+				return batch
+			}
+		}
+		batch = append(batch, message)
+	}
+	return batch
+}
+
+// flush 连接关闭时写完队列中剩下的消息
+func (c *Client) flush(frameType int) error {
+	for {
+		select {
+		case message := <-c.WriteChannel:
+			if err := c.writeBatch(frameType, c.collect(message)); err != nil {
+				return err
+			}
+		default:
+			return nil
+		}
+	}
+}
+
+// writeBatch 按 Write.Strategy 把 batch 写给客户端
+func (c *Client) writeBatch(frameType int, batch [][]byte) error {
+	if !c.batching() {
+		for _, message := range batch {
+			c.Conn.SetWriteDeadline(time.Now().Add(c.writeWait()))
+			err := c.writeFrame(len(message), func() error {
+				return c.Conn.WriteMessage(frameType, message)
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	separator := newline
+	size := len(batch) - 1
+	if c.writeConfig.Strategy == config.WriteArray {
+		separator = comma
+		size += 2
+	}
+	for _, message := range batch {
+		size += len(message)
+	}
+	c.Conn.SetWriteDeadline(time.Now().Add(c.writeWait()))
+	return c.writeFrame(size, func() error {
+		w, err := c.Conn.NextWriter(frameType)
+		if err != nil {
+			return err
+		}
+		if c.writeConfig.Strategy == config.WriteArray {
+			w.Write(arrayStart)
+		}
+		for i, message := range batch {
+			if i > 0 {
+				w.Write(separator)
+			}
+			w.Write(message)
+		}
+		if c.writeConfig.Strategy == config.WriteArray {
+			w.Write(arrayEnd)
+		}
+		return w.Close()
+	})
+}
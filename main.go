@@ -10,6 +10,10 @@ import (
 	"github.com/WangSiangCun/go-ws/hub"
 	"github.com/WangSiangCun/go-ws/wsContext"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 )
 
 var configFile = flag.String("f", "etc/webSocketService.yaml", "the config file")
@@ -21,28 +25,53 @@ func main() {
 	e := engine.NewEngine(&c)
 	// ... existing code ...
 	//  接收消息后插件
-	//e.OpenJWT(config.JWT{c.JWT.AccessSecret, c.JWT.AccessExpire})
+	//if err := e.OpenJWT(c.JWT); err != nil {
+	//	panic(err)
+	//}
 	e.SetReceiverHandlers([]engine.HandlersFunc{ReceiveHandler})
 	receiverParameters := [][]any{[]any{&engine.Message{Type: 1}}}
 	e.SetReceiverParameters(receiverParameters)
 	//	e.RunHandlers(wsContext.NewContext(context.Background(), &c), e.ReceiveHandlers, e.ReceiveParameters, &engine.Message{})
 
-	//  发送消息前插件
-	sendParameters := [][]any{[]any{1}}
-	e.SetSendHandlers([]engine.HandlersFunc{SendHandler})
-	e.SetSendParameters(sendParameters)
+	//  中间件，先于路由执行，可以截断、返回错误、统计耗时
+	e.UseSend(engine.Recover(), TimingMiddleware)
+	e.UseReceive(engine.Recover())
+
+	//  按消息类型路由，不用在一个插件里判断 message.Type
+	e.Router.Handle(WebSocketMessageTypeChat, ChatHandler)
+	e.Router.Handle(WebSocketMessageTypeMatch, MatchHandler)
+	//  RPC，回复只发给调用的连接
+	e.HandleRPC("match.join", engine.RPC(MatchJoin))
 
 	// ... existing code ...
-	hub := hub.NewHub()
-	go hub.Run(wsContext.NewContext(context.Background(), &c), e)
+	hub := hub.NewHub(wsContext.NewContext(context.Background(), &c))
+	go hub.Run(e)
 
 	http.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
 		hub.ServeWs(w, r, e)
 	})
-	err := http.ListenAndServe(c.WSPort, nil)
-	if err != nil {
+	server := &http.Server{Addr: c.WSPort}
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- server.ListenAndServe()
+	}()
+
+	//  收到退出信号后先关闭所有连接，客户端收到 1001 后重连到其他节点
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+	select {
+	case err := <-serveErr:
 		fmt.Println("ListenAndServe: ", err)
 		return
+	case <-quit:
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := hub.Shutdown(ctx); err != nil {
+		fmt.Println("shutdown hub: ", err)
+	}
+	if err := server.Shutdown(ctx); err != nil {
+		fmt.Println("shutdown server: ", err)
 	}
 
 }
@@ -52,31 +81,47 @@ const (
 	WebSocketMessageTypeMatch        // websocket message type match
 )
 
-func SendHandler(e *engine.Engine, wsCtx wsContext.WSContext, message *engine.Message, opts ...any) *engine.Message {
+// ChatHandler 聊天类型消息，处理完照常转发
+func ChatHandler(c *engine.Context) error {
+	fmt.Println("chat message")
+	return nil
+}
 
-	if message.Type == WebSocketMessageTypeChat {
-		// 聊天类型消息
-		fmt.Println("chat message")
-	} else if message.Type == WebSocketMessageTypeMatch {
-		// 截断，只和server
+// MatchHandler 匹配类型消息只和 server 通信，由服务端处理后不再转发，不影响其他消息
+func MatchHandler(c *engine.Context) error {
+	fmt.Println("match message")
+	c.Handled()
 
-		// 匹配类型消息
+	// 执行您的逻辑，单机模式下没有 EtcdClient
+	if c.WS.EtcdClient != nil {
+		c.WS.EtcdClient.Put(c, c.Message.SourceId, "test")
+	}
+	fmt.Println("serverHandler, this message is server handler")
+
+	/*
+	  这里可以写一些逻辑，比如：
+	  1. 过滤掉一些消息：c.Drop()
+	  2. webSocket的server逻辑，比如游戏服务器相关逻辑等等之类
+	  3. 直接回复发送方：c.ReplyWith(&engine.Message{...})
+	  4. 可以把消息转发转存给其他服务  如mysql，es，总之，一切看自己的需求
+	*/
+	return nil
+}
 
-		fmt.Println("match message")
-		e.IsServerHandlerModel = true
+type MatchJoinRequest struct {
+	Mode string `json:"mode"`
+}
 
-		// 执行您的逻辑
-		wsCtx.EtcdClient.Put(wsCtx.Context, message.SourceId, "test")
-		fmt.Println("serverHandler, this message is server handler")
+type MatchJoinResponse struct {
+	RoomId string `json:"room_id"`
+}
 
-		/*
-		  这里可以写一些逻辑，比如：
-		  1. 过滤掉一些消息
-		  2. webSocket的server逻辑，比如游戏服务器相关逻辑等等之类
-		  3. 可以把消息转发转存给其他服务  如mysql，es，总之，一切看自己的需求
-		*/
+// MatchJoin 客户端发送 {"type": -4, "request_id": "1", "method": "match.join", "message": "{\"mode\":\"1v1\"}"} 加入匹配
+func MatchJoin(c *engine.Context, req MatchJoinRequest) (MatchJoinResponse, error) {
+	if req.Mode == "" {
+		return MatchJoinResponse{}, engine.NewRPCError(engine.RPCBadRequest, "mode is required")
 	}
-	return message
+	return MatchJoinResponse{RoomId: req.Mode + "-" + c.Message.SourceId}, nil
 }
 
 func ReceiveHandler(e *engine.Engine, wsCtx wsContext.WSContext, message *engine.Message, opts ...any) *engine.Message {
@@ -95,3 +140,13 @@ func ReceiveHandler(e *engine.Engine, wsCtx wsContext.WSContext, message *engine
 
 	return message
 }
+
+// TimingMiddleware 统计下游处理一条消息的耗时
+func TimingMiddleware(next engine.Handler) engine.Handler {
+	return func(c *engine.Context) error {
+		start := time.Now()
+		err := next(c)
+		fmt.Println("message type:", c.Message.Type, "cost:", time.Since(start))
+		return err
+	}
+}
@@ -0,0 +1,148 @@
+package offline
+
+import (
+	"bufio"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// FileStore 把离线消息保存在 dir 目录，每个用户一个文件，每行一条消息，进程重启后不丢失
+// 同一个目录只能由一个进程使用，过期消息在 Save 和 Drain 时清理
+type FileStore struct {
+	mu      sync.Mutex
+	dir     string
+	options Options
+}
+
+// NewFileStore 创建文件 Store，dir 不存在时自动创建
+func NewFileStore(dir string, options Options) (*FileStore, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &FileStore{dir: dir, options: options}, nil
+}
+
+// Save 保存发给 userId 的消息，超过上限时重写文件
+func (s *FileStore) Save(_ context.Context, userId string, body []byte) error {
+	now := time.Now()
+	e, err := s.options.newEntry(body, now)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	path := s.path(userId)
+	entries, err := readEntries(path)
+	if err != nil {
+		return err
+	}
+	entries, changed := s.options.prune(append(entries, e), now)
+	if changed {
+		return writeEntries(path, entries)
+	}
+	return appendEntry(path, e)
+}
+
+// Drain 取出 userId 的离线消息并删除文件
+func (s *FileStore) Drain(_ context.Context, userId string) ([][]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	path := s.path(userId)
+	entries, err := readEntries(path)
+	if err != nil {
+		return nil, err
+	}
+	if err = os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	entries, _ = s.options.prune(entries, time.Now())
+	return bodies(entries), nil
+}
+
+// Close 文件 Store 不持有资源
+func (s *FileStore) Close() error {
+	return nil
+}
+
+// path 用户 id 编码成十六进制作为文件名，避免路径穿越
+func (s *FileStore) path(userId string) string {
+	return filepath.Join(s.dir, hex.EncodeToString([]byte(userId))+".jsonl")
+}
+
+func readEntries(path string) ([]entry, error) {
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var entries []entry
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 64*1024*1024)
+	for scanner.Scan() {
+		var e entry
+		if err = json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			// 写到一半的最后一行，忽略
+			continue
+		}
+		entries = append(entries, e)
+	}
+	return entries, scanner.Err()
+}
+
+func appendEntry(path string, e entry) error {
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err = file.Write(append(line, '\n')); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// writeEntries 先写临时文件再重命名，避免写到一半丢失所有消息
+func writeEntries(path string, entries []entry) error {
+	if len(entries) == 0 {
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+	tmp := path + ".tmp"
+	file, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(file)
+	for _, e := range entries {
+		line, err := json.Marshal(e)
+		if err != nil {
+			file.Close()
+			return err
+		}
+		writer.Write(line)
+		writer.WriteByte('\n')
+	}
+	if err = writer.Flush(); err != nil {
+		file.Close()
+		return err
+	}
+	if err = file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,79 @@
+package offline
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// MemoryStore 进程内的 Store，进程重启后丢失，用于单机部署和测试
+type MemoryStore struct {
+	mu      sync.Mutex
+	options Options
+	users   map[string][]entry
+	done    chan struct{}
+	once    sync.Once
+}
+
+// NewMemoryStore 创建进程内 Store，设置了 TTL 时会定期清理过期消息
+func NewMemoryStore(options Options) *MemoryStore {
+	s := &MemoryStore{
+		options: options,
+		users:   make(map[string][]entry),
+		done:    make(chan struct{}),
+	}
+	if options.TTL > 0 {
+		go s.cleanup(min(options.TTL, time.Minute))
+	}
+	return s
+}
+
+// Save 保存发给 userId 的消息
+func (s *MemoryStore) Save(_ context.Context, userId string, body []byte) error {
+	now := time.Now()
+	e, err := s.options.newEntry(body, now)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.users[userId], _ = s.options.prune(append(s.users[userId], e), now)
+	return nil
+}
+
+// Drain 取出 userId 的离线消息
+func (s *MemoryStore) Drain(_ context.Context, userId string) ([][]byte, error) {
+	s.mu.Lock()
+	entries := s.users[userId]
+	delete(s.users, userId)
+	s.mu.Unlock()
+	entries, _ = s.options.prune(entries, time.Now())
+	return bodies(entries), nil
+}
+
+// Close 停止清理
+func (s *MemoryStore) Close() error {
+	s.once.Do(func() { close(s.done) })
+	return nil
+}
+
+func (s *MemoryStore) cleanup(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case now := <-ticker.C:
+			s.mu.Lock()
+			for userId, entries := range s.users {
+				if entries, _ = s.options.prune(entries, now); len(entries) == 0 {
+					delete(s.users, userId)
+				} else {
+					s.users[userId] = entries
+				}
+			}
+			s.mu.Unlock()
+		}
+	}
+}
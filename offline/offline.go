@@ -0,0 +1,86 @@
+package offline
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// ErrTooLarge 单条消息超过 Options.MaxBytes
+var ErrTooLarge = errors.New("offline: message too large")
+
+// Store 保存用户不在线时发给他的消息，用户重新上线后按保存顺序投递
+type Store interface {
+	// Save 保存发给 userId 的消息，超过上限时丢弃最早的
+	Save(ctx context.Context, userId string, body []byte) error
+	// Drain 按保存顺序取出 userId 所有未过期的消息并删除
+	Drain(ctx context.Context, userId string) ([][]byte, error)
+	// Close 释放资源
+	Close() error
+}
+
+// Options 保存时间和大小上限，为 0 时不限制
+type Options struct {
+	// TTL 消息保存时间，过期后不再投递
+	TTL time.Duration
+	// MaxMessages 每个用户最多保存的消息条数
+	MaxMessages int
+	// MaxBytes 每个用户最多保存的消息字节数
+	MaxBytes int
+}
+
+// entry 一条离线消息
+type entry struct {
+	Body []byte `json:"body"`
+	// Expire 过期时间，UnixNano，0 表示不过期
+	Expire int64 `json:"expire,omitempty"`
+}
+
+func (o Options) newEntry(body []byte, now time.Time) (entry, error) {
+	if o.MaxBytes > 0 && len(body) > o.MaxBytes {
+		return entry{}, ErrTooLarge
+	}
+	e := entry{Body: body}
+	if o.TTL > 0 {
+		e.Expire = now.Add(o.TTL).UnixNano()
+	}
+	return e, nil
+}
+
+// prune 去掉过期的消息，再从最早的开始丢弃直到满足上限，返回剩下的消息和是否有变化
+func (o Options) prune(entries []entry, now time.Time) ([]entry, bool) {
+	alive := entries[:0]
+	for _, e := range entries {
+		if e.Expire == 0 || e.Expire > now.UnixNano() {
+			alive = append(alive, e)
+		}
+	}
+	changed := len(alive) != len(entries)
+	if o.MaxMessages > 0 && len(alive) > o.MaxMessages {
+		alive = alive[len(alive)-o.MaxMessages:]
+		changed = true
+	}
+	if o.MaxBytes > 0 {
+		size := 0
+		for _, e := range alive {
+			size += len(e.Body)
+		}
+		drop := 0
+		for ; size > o.MaxBytes; drop++ {
+			size -= len(alive[drop].Body)
+		}
+		if drop > 0 {
+			alive = alive[drop:]
+			changed = true
+		}
+	}
+	return alive, changed
+}
+
+func bodies(entries []entry) [][]byte {
+	result := make([][]byte, 0, len(entries))
+	for _, e := range entries {
+		result = append(result, e.Body)
+	}
+	return result
+}
@@ -0,0 +1,93 @@
+package offline
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func stores(t *testing.T, options Options) map[string]Store {
+	file, err := NewFileStore(t.TempDir(), options)
+	assert.NoError(t, err)
+	memory := NewMemoryStore(options)
+	t.Cleanup(func() { memory.Close() })
+	return map[string]Store{"memory": memory, "file": file}
+}
+
+func TestStore_SaveDrain(t *testing.T) {
+	for name, s := range stores(t, Options{}) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			assert.NoError(t, s.Save(ctx, "u1", []byte("a")))
+			assert.NoError(t, s.Save(ctx, "u2", []byte("x")))
+			assert.NoError(t, s.Save(ctx, "u1", []byte("b")))
+
+			messages, err := s.Drain(ctx, "u1")
+			assert.NoError(t, err)
+			assert.Equal(t, [][]byte{[]byte("a"), []byte("b")}, messages)
+
+			messages, err = s.Drain(ctx, "u1")
+			assert.NoError(t, err)
+			assert.Empty(t, messages)
+
+			messages, err = s.Drain(ctx, "u2")
+			assert.NoError(t, err)
+			assert.Equal(t, [][]byte{[]byte("x")}, messages)
+		})
+	}
+}
+
+func TestStore_Limits(t *testing.T) {
+	for name, s := range stores(t, Options{MaxMessages: 3, MaxBytes: 5}) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			assert.ErrorIs(t, s.Save(ctx, "u1", []byte("toolong")), ErrTooLarge)
+			for _, body := range []string{"a", "b", "c", "d"} {
+				assert.NoError(t, s.Save(ctx, "u1", []byte(body)))
+			}
+			// 条数上限，丢弃最早的
+			messages, err := s.Drain(ctx, "u1")
+			assert.NoError(t, err)
+			assert.Equal(t, [][]byte{[]byte("b"), []byte("c"), []byte("d")}, messages)
+
+			assert.NoError(t, s.Save(ctx, "u1", []byte("abc")))
+			assert.NoError(t, s.Save(ctx, "u1", []byte("de")))
+			assert.NoError(t, s.Save(ctx, "u1", []byte("f")))
+			// 字节上限，丢弃最早的
+			messages, err = s.Drain(ctx, "u1")
+			assert.NoError(t, err)
+			assert.Equal(t, [][]byte{[]byte("de"), []byte("f")}, messages)
+		})
+	}
+}
+
+func TestStore_TTL(t *testing.T) {
+	for name, s := range stores(t, Options{TTL: 50 * time.Millisecond}) {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			assert.NoError(t, s.Save(ctx, "u1", []byte("old")))
+			time.Sleep(100 * time.Millisecond)
+			assert.NoError(t, s.Save(ctx, "u1", []byte("new")))
+
+			messages, err := s.Drain(ctx, "u1")
+			assert.NoError(t, err)
+			assert.Equal(t, [][]byte{[]byte("new")}, messages)
+		})
+	}
+}
+
+func TestFileStore_Reopen(t *testing.T) {
+	dir := t.TempDir()
+	ctx := context.Background()
+	s, err := NewFileStore(dir, Options{})
+	assert.NoError(t, err)
+	assert.NoError(t, s.Save(ctx, "../u1", []byte(`{"message":"hi"}`)))
+
+	s, err = NewFileStore(dir, Options{})
+	assert.NoError(t, err)
+	messages, err := s.Drain(ctx, "../u1")
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{[]byte(`{"message":"hi"}`)}, messages)
+}
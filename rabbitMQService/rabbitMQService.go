@@ -2,8 +2,10 @@ package rabbitMQService
 
 import (
 	"fmt"
+	"github.com/WangSiangCun/go-ws/broker"
 	"github.com/streadway/amqp"
 	"log"
+	"sync"
 )
 
 func InitRabbitMQ(MQUrl string) *amqp.Connection {
@@ -127,84 +129,57 @@ func ReceiveRouting(conn *amqp.Connection, exchange, key string) (messages <-cha
 
 }
 
+// brokers 工作模式使用的 AMQPBroker，每个连接共用一个
+var brokers sync.Map
+
+func brokerFor(conn *amqp.Connection) *broker.AMQPBroker {
+	b, _ := brokers.LoadOrStore(conn, broker.NewAMQPBroker(conn))
+	return b.(*broker.AMQPBroker)
+}
+
 // PublishWorking 工作模式发送消息
+//
+// Deprecated: 使用 broker.AMQPBroker.Publish
 func PublishWorking(conn *amqp.Connection, queueName string, message []byte) {
-	channel, err := conn.Channel()
-	q, err := channel.QueueDeclare(
-		queueName, // name
-		true,      // durable
-		false,     // delete when unused
-		false,     // exclusive
-		false,     // no-wait
-		nil,       // arguments
-	)
-	failOnError(err, "Failed to declare a queue")
-
-	err = channel.Publish(
-		"",     // exchange
-		q.Name, // routing key
-		false,  // mandatory
-		false,
-		amqp.Publishing{
-			DeliveryMode: amqp.Persistent,
-			ContentType:  "text/plain",
-			Body:         []byte(message),
-		})
+	err := brokerFor(conn).Publish(queueName, message)
 	failOnError(err, "Failed to publish a message")
-	log.Printf(" [x] Sent %s", message)
-
 }
 
-// ReceiveWorking 工作模式接收消息
+// ReceiveWorking 工作模式接收消息，需要手动应答
+//
+// Deprecated: 使用 broker.AMQPBroker.Subscribe
 func ReceiveWorking(conn *amqp.Connection, queueName string) (messages <-chan amqp.Delivery, err error) {
-	channel, err := conn.Channel()
-	q, err := channel.QueueDeclare(
-		queueName, // name
-		true,      // durable
-		false,     // delete when unused
-		false,     // exclusive
-		false,     // no-wait
-		nil,       // arguments
-	)
-	failOnError(err, "Failed to declare a queue")
+	deliveries, err := brokerFor(conn).Subscribe(queueName)
+	if err != nil {
+		return nil, err
+	}
+	out := make(chan amqp.Delivery)
+	go func() {
+		defer close(out)
+		for delivery := range deliveries {
+			out <- amqp.Delivery{
+				Acknowledger: acknowledger{delivery},
+				Body:         delivery.Body,
+				Redelivered:  delivery.Redelivered,
+			}
+		}
+	}()
+	return out, nil
+}
 
-	err = channel.Qos(
-		1,     // prefetch count
-		0,     // prefetch size
-		false, // global
-	)
-	failOnError(err, "Failed to set QoS")
-
-	messages, err = channel.Consume(
-		q.Name, // queue
-		"",     // consumer
-		false,  // auto-ack
-		false,  // exclusive
-		false,  // no-local
-		false,  // no-wait
-		nil,    // args
-	)
-	failOnError(err, "Failed to register a consumer")
-	return
+// acknowledger 把 amqp.Delivery 的应答转给 broker.Delivery
+type acknowledger struct {
+	delivery *broker.Delivery
+}
+
+func (a acknowledger) Ack(uint64, bool) error {
+	return a.delivery.Ack()
 }
 
-/*
-这段代码是使用 AMQP 协议连接到 RabbitMQ 服务器，并声明一个队列，设置 QoS 和注册一个消费者。
-
-下面是各个字段的含义：
-- `queueName`：队列的名称。
-- `durable`：队列是否持久化。如果设置为 true，则队列将在服务器重启后继续存在。
-- `deleteWhenUnused`：当没有消费者连接到队列时，是否自动删除队列。
-- `exclusive`：是否将队列标记为独占队列。如果设置为 true，则只有当前连接的消费者可以使用该队列。
-- `noWait`：是否等待服务器响应。如果设置为 true，则不会等待服务器响应，而是立即返回。
-- `arguments`：队列的其他属性。可以设置队列的最大长度、过期时间等。
-- `prefetchCount`：每个消费者在确认之前可以接收的最大消息数。这个值可以控制消费者的负载均衡。
-- `prefetchSize`：每个消费者在确认之前可以接收的最大消息大小。通常设置为 0，表示不限制消息大小。
-- `global`：是否将 QoS 设置为全局。如果设置为 true，则将 QoS 应用于所有消费者，而不是单个消费者。
-- `queue`：要消费的队列的名称。
-- `consumer`：消费者的名称。如果设置为空字符串，则服务器将为消费者生成一个唯一的名称。
-- `autoAck`：是否自动确认消息。如果设置为 true，则消费者在接收到消息后立即确认消息。如果设置为 false，则消费者必须手动确认消息。
-- `noLocal`：是否禁止消费者接收自己发布的消息。
-- `noWait`：是否等待服务器响应。如果设置为 true，则不会等待服务器响应，而是立即返回。
-- `args`：消费者的其他属性。可以设置消费者的优先级、消息过滤等。
-*/
+func (a acknowledger) Nack(_ uint64, _ bool, requeue bool) error {
+	return a.delivery.Nack(requeue)
+}
+
+func (a acknowledger) Reject(_ uint64, requeue bool) error {
+	return a.delivery.Nack(requeue)
+}
@@ -0,0 +1,322 @@
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"sync"
+
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+// etcd 默认一个事务最多 128 个操作
+const maxTxnOps = 128
+
+const (
+	// etcd 中连接 key 的前缀，完整的 key 为 prefix+userPrefix+userId+"/"+connId，userId 和房间名中不能有 "/"，见 ValidateName
+	userPrefix = "user/"
+	// etcd 中房间成员 key 的前缀，完整的 key 为 prefix+roomPrefix+room+"/"+userId+"/"+connId
+	roomPrefix = "room/"
+	// etcd 中节点 key 的前缀，完整的 key 为 prefix+nodePrefix+node
+	nodePrefix = "node/"
+)
+
+// EtcdRegistry 基于 etcd 租约的 Registry，每个连接一个 key 和租约，value 为 Session 的 json，
+// 房间成员 key 绑定在连接的租约上，随连接下线一起删除
+type EtcdRegistry struct {
+	cli    *clientv3.Client
+	prefix string
+
+	mu         sync.Mutex
+	leases     map[string]clientv3.LeaseID
+	nodeLeases map[string]clientv3.LeaseID
+	// rooms 本节点连接加入的房间，租约过期重新申请时用来恢复房间成员 key
+	rooms map[string]map[string]struct{}
+}
+
+// NewEtcdRegistry 创建 etcd Registry，prefix 用来隔离不同的服务
+func NewEtcdRegistry(cli *clientv3.Client, prefix string) *EtcdRegistry {
+	return &EtcdRegistry{
+		cli:        cli,
+		prefix:     prefix,
+		leases:     make(map[string]clientv3.LeaseID),
+		nodeLeases: make(map[string]clientv3.LeaseID),
+		rooms:      make(map[string]map[string]struct{}),
+	}
+}
+
+// Register 已有租约时续期，否则申请新租约并写入 key，连接加入过的房间一起写到新租约上
+func (r *EtcdRegistry) Register(ctx context.Context, session Session, ttl int64) error {
+	if err := ValidateName(session.UserId); err != nil {
+		return err
+	}
+	value, err := json.Marshal(session)
+	if err != nil {
+		return err
+	}
+	id := session.UserId + "/" + session.ConnId
+	granted, err := r.putWithLease(ctx, r.leases, id, r.userKey(session.UserId, session.ConnId), string(value), ttl)
+	if err != nil || !granted {
+		return err
+	}
+	r.mu.Lock()
+	leaseId := r.leases[id]
+	rooms := make([]string, 0, len(r.rooms[id]))
+	for room := range r.rooms[id] {
+		rooms = append(rooms, room)
+	}
+	r.mu.Unlock()
+	for _, room := range rooms {
+		if _, err = r.cli.Put(ctx, r.roomKey(room, session.UserId, session.ConnId), string(value),
+			clientv3.WithLease(leaseId)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Unregister 撤销租约，key 和房间成员 key 会一起被删除
+func (r *EtcdRegistry) Unregister(ctx context.Context, userId, connId string) error {
+	r.mu.Lock()
+	delete(r.rooms, userId+"/"+connId)
+	r.mu.Unlock()
+	return r.revoke(ctx, r.leases, userId+"/"+connId, r.userKey(userId, connId))
+}
+
+// Lookup 按前缀读取 userId 的所有连接
+func (r *EtcdRegistry) Lookup(ctx context.Context, userId string) ([]Session, error) {
+	if ValidateName(userId) != nil {
+		// 不合法的用户 id 不会注册，按前缀读取会读到其他用户的连接
+		return nil, nil
+	}
+	prefix := r.userKey(userId, "")
+	resp, err := r.cli.Get(ctx, prefix, clientv3.WithPrefix())
+	if err != nil {
+		return nil, err
+	}
+	return parseSessions(prefix, userId, resp.Kvs), nil
+}
+
+// BatchLookup 用事务批量读取，每个事务最多 maxTxnOps 个用户
+func (r *EtcdRegistry) BatchLookup(ctx context.Context, userIds []string) (map[string][]Session, error) {
+	sessions := make(map[string][]Session, len(userIds))
+	for start := 0; start < len(userIds); start += maxTxnOps {
+		end := min(start+maxTxnOps, len(userIds))
+		batch := make([]string, 0, end-start)
+		ops := make([]clientv3.Op, 0, end-start)
+		for _, userId := range userIds[start:end] {
+			if ValidateName(userId) != nil {
+				continue
+			}
+			batch = append(batch, userId)
+			ops = append(ops, clientv3.OpGet(r.userKey(userId, ""), clientv3.WithPrefix()))
+		}
+		if len(ops) == 0 {
+			continue
+		}
+		resp, err := r.cli.Txn(ctx).Then(ops...).Commit()
+		if err != nil {
+			return nil, err
+		}
+		for i, op := range resp.Responses {
+			userId := batch[i]
+			found := parseSessions(r.userKey(userId, ""), userId, op.GetResponseRange().GetKvs())
+			if len(found) > 0 {
+				sessions[userId] = found
+			}
+		}
+	}
+	return sessions, nil
+}
+
+// Watch 监听 userId 的所有连接
+func (r *EtcdRegistry) Watch(ctx context.Context, userId string) (<-chan Event, error) {
+	if err := ValidateName(userId); err != nil {
+		return nil, err
+	}
+	prefix := r.userKey(userId, "")
+	watchChan := r.cli.Watch(ctx, prefix, clientv3.WithPrefix())
+	events := make(chan Event)
+	go func() {
+		defer close(events)
+		for resp := range watchChan {
+			for _, ev := range resp.Events {
+				event := Event{}
+				if ev.Type == clientv3.EventTypeDelete {
+					event.Type = EventDelete
+				} else {
+					// 值解析失败时只保留 UserId 和 ConnId
+					_ = json.Unmarshal(ev.Kv.Value, &event.Session)
+				}
+				event.Session.UserId = userId
+				event.Session.ConnId = strings.TrimPrefix(string(ev.Kv.Key), prefix)
+				select {
+				case events <- event:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+	return events, nil
+}
+
+// JoinRoom 写入房间成员 key，使用和连接相同的租约
+func (r *EtcdRegistry) JoinRoom(ctx context.Context, room, userId, connId string) error {
+	if err := ValidateName(room); err != nil {
+		return err
+	}
+	id := userId + "/" + connId
+	r.mu.Lock()
+	leaseId, ok := r.leases[id]
+	r.mu.Unlock()
+	if !ok {
+		return ErrNotRegistered
+	}
+	resp, err := r.cli.Get(ctx, r.userKey(userId, connId))
+	if err != nil {
+		return err
+	}
+	if len(resp.Kvs) == 0 {
+		return ErrNotRegistered
+	}
+	if _, err = r.cli.Put(ctx, r.roomKey(room, userId, connId), string(resp.Kvs[0].Value), clientv3.WithLease(leaseId)); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	if r.rooms[id] == nil {
+		r.rooms[id] = make(map[string]struct{})
+	}
+	r.rooms[id][room] = struct{}{}
+	r.mu.Unlock()
+	return nil
+}
+
+// LeaveRoom 删除房间成员 key
+func (r *EtcdRegistry) LeaveRoom(ctx context.Context, room, userId, connId string) error {
+	if err := ValidateName(room); err != nil {
+		return err
+	}
+	id := userId + "/" + connId
+	r.mu.Lock()
+	delete(r.rooms[id], room)
+	if len(r.rooms[id]) == 0 {
+		delete(r.rooms, id)
+	}
+	r.mu.Unlock()
+	_, err := r.cli.Delete(ctx, r.roomKey(room, userId, connId))
+	return err
+}
+
+// RoomMembers 按前缀读取房间成员
+func (r *EtcdRegistry) RoomMembers(ctx context.Context, room string) ([]Session, error) {
+	if err := ValidateName(room); err != nil {
+		return nil, err
+	}
+	prefix := r.prefix + roomPrefix + room + "/"
+	resp, err := r.cli.Get(ctx, prefix, clientv3.WithPrefix())
+	if err != nil {
+		return nil, err
+	}
+	members := make([]Session, 0, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		userId, connId, ok := strings.Cut(strings.TrimPrefix(string(kv.Key), prefix), "/")
+		if !ok {
+			continue
+		}
+		session := Session{}
+		if err = json.Unmarshal(kv.Value, &session); err != nil {
+			continue
+		}
+		session.UserId, session.ConnId = userId, connId
+		members = append(members, session)
+	}
+	return members, nil
+}
+
+// RegisterNode 写入节点 key，已有租约时续期
+func (r *EtcdRegistry) RegisterNode(ctx context.Context, node string, ttl int64) error {
+	_, err := r.putWithLease(ctx, r.nodeLeases, node, r.prefix+nodePrefix+node, node, ttl)
+	return err
+}
+
+// UnregisterNode 撤销节点租约
+func (r *EtcdRegistry) UnregisterNode(ctx context.Context, node string) error {
+	return r.revoke(ctx, r.nodeLeases, node, r.prefix+nodePrefix+node)
+}
+
+// Nodes 按前缀读取所有节点
+func (r *EtcdRegistry) Nodes(ctx context.Context) ([]string, error) {
+	resp, err := r.cli.Get(ctx, r.prefix+nodePrefix, clientv3.WithPrefix())
+	if err != nil {
+		return nil, err
+	}
+	nodes := make([]string, 0, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		nodes = append(nodes, string(kv.Value))
+	}
+	return nodes, nil
+}
+
+// putWithLease leases 中已有租约时续期，否则申请新租约并写入 key，granted 表示申请了新租约
+func (r *EtcdRegistry) putWithLease(ctx context.Context, leases map[string]clientv3.LeaseID,
+	id, key, value string, ttl int64) (granted bool, err error) {
+	r.mu.Lock()
+	leaseId, ok := leases[id]
+	r.mu.Unlock()
+	if ok {
+		if _, err = r.cli.KeepAliveOnce(ctx, leaseId); err == nil {
+			return false, nil
+		}
+		// 租约已过期，重新申请
+	}
+
+	resp, err := r.cli.Grant(ctx, ttl)
+	if err != nil {
+		return false, err
+	}
+	if _, err = r.cli.Put(ctx, key, value, clientv3.WithLease(resp.ID)); err != nil {
+		return false, err
+	}
+	r.mu.Lock()
+	leases[id] = resp.ID
+	r.mu.Unlock()
+	return true, nil
+}
+
+// revoke 撤销租约，没有租约时直接删除 key
+func (r *EtcdRegistry) revoke(ctx context.Context, leases map[string]clientv3.LeaseID, id, key string) error {
+	r.mu.Lock()
+	leaseId, ok := leases[id]
+	delete(leases, id)
+	r.mu.Unlock()
+	if ok {
+		_, err := r.cli.Revoke(ctx, leaseId)
+		return err
+	}
+	_, err := r.cli.Delete(ctx, key)
+	return err
+}
+
+func (r *EtcdRegistry) userKey(userId, connId string) string {
+	return r.prefix + userPrefix + userId + "/" + connId
+}
+
+func (r *EtcdRegistry) roomKey(room, userId, connId string) string {
+	return r.prefix + roomPrefix + room + "/" + userId + "/" + connId
+}
+
+func parseSessions(prefix, userId string, kvs []*mvccpb.KeyValue) []Session {
+	sessions := make([]Session, 0, len(kvs))
+	for _, kv := range kvs {
+		session := Session{}
+		if err := json.Unmarshal(kv.Value, &session); err != nil {
+			continue
+		}
+		session.UserId = userId
+		session.ConnId = strings.TrimPrefix(string(kv.Key), prefix)
+		sessions = append(sessions, session)
+	}
+	return sessions
+}
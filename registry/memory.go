@@ -0,0 +1,279 @@
+package registry
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+// MemoryRegistry 进程内的 Registry，用于单机部署和测试
+type MemoryRegistry struct {
+	mu sync.Mutex
+	// sessions userId -> connId -> 连接
+	sessions map[string]map[string]*memoryEntry
+	watchers map[string]map[chan Event]struct{}
+	// rooms room -> 房间内的连接
+	rooms map[string]map[*memoryEntry]struct{}
+	// nodes 在线节点和过期 timer
+	nodes map[string]*time.Timer
+	// expired 过期但还没有注销的连接加入的房间，同一个连接重新注册时恢复
+	expired map[connKey]map[string]struct{}
+}
+
+type connKey struct {
+	userId string
+	connId string
+}
+
+type memoryEntry struct {
+	session Session
+	timer   *time.Timer
+	// rooms 连接加入的房间，注销时一起退出
+	rooms map[string]struct{}
+}
+
+// NewMemoryRegistry 创建进程内 Registry
+func NewMemoryRegistry() *MemoryRegistry {
+	return &MemoryRegistry{
+		sessions: make(map[string]map[string]*memoryEntry),
+		watchers: make(map[string]map[chan Event]struct{}),
+		rooms:    make(map[string]map[*memoryEntry]struct{}),
+		nodes:    make(map[string]*time.Timer),
+		expired:  make(map[connKey]map[string]struct{}),
+	}
+}
+
+// Register 注册或续期，ttl 到期后自动注销，过期后同一个连接重新注册时恢复之前加入的房间
+func (r *MemoryRegistry) Register(_ context.Context, session Session, ttl int64) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	entry, ok := r.sessions[session.UserId][session.ConnId]
+	if ok {
+		entry.timer.Stop()
+	} else {
+		entry = &memoryEntry{rooms: make(map[string]struct{})}
+		if r.sessions[session.UserId] == nil {
+			r.sessions[session.UserId] = make(map[string]*memoryEntry)
+		}
+		r.sessions[session.UserId][session.ConnId] = entry
+		key := connKey{session.UserId, session.ConnId}
+		for room := range r.expired[key] {
+			r.joinRoom(room, entry)
+		}
+		delete(r.expired, key)
+	}
+	changed := !ok || entry.session != session
+	entry.session = session
+
+	var timer *time.Timer
+	timer = time.AfterFunc(time.Duration(ttl)*time.Second, func() {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		// 续期之后旧的 timer 可能已经触发，只处理自己
+		if entry.timer == timer {
+			if len(entry.rooms) > 0 {
+				r.expired[connKey{entry.session.UserId, entry.session.ConnId}] = entry.rooms
+			}
+			r.remove(entry)
+		}
+	})
+	entry.timer = timer
+
+	if changed {
+		r.notify(Event{Type: EventPut, Session: session})
+	}
+	return nil
+}
+
+// Unregister 注销连接
+func (r *MemoryRegistry) Unregister(_ context.Context, userId, connId string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.expired, connKey{userId, connId})
+	if entry, ok := r.sessions[userId][connId]; ok {
+		r.remove(entry)
+	}
+	return nil
+}
+
+// Lookup 查找 userId 的所有在线连接
+func (r *MemoryRegistry) Lookup(_ context.Context, userId string) ([]Session, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.lookup(userId), nil
+}
+
+// BatchLookup 批量查找
+func (r *MemoryRegistry) BatchLookup(_ context.Context, userIds []string) (map[string][]Session, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	sessions := make(map[string][]Session, len(userIds))
+	for _, userId := range userIds {
+		if found := r.lookup(userId); len(found) > 0 {
+			sessions[userId] = found
+		}
+	}
+	return sessions, nil
+}
+
+// Watch 监听 userId 的在线状态变化，慢的监听者会丢事件
+func (r *MemoryRegistry) Watch(ctx context.Context, userId string) (<-chan Event, error) {
+	events := make(chan Event, 16)
+	r.mu.Lock()
+	if r.watchers[userId] == nil {
+		r.watchers[userId] = make(map[chan Event]struct{})
+	}
+	r.watchers[userId][events] = struct{}{}
+	r.mu.Unlock()
+
+	go func() {
+		<-ctx.Done()
+		r.mu.Lock()
+		delete(r.watchers[userId], events)
+		if len(r.watchers[userId]) == 0 {
+			delete(r.watchers, userId)
+		}
+		close(events)
+		r.mu.Unlock()
+	}()
+	return events, nil
+}
+
+// JoinRoom 连接加入房间
+func (r *MemoryRegistry) JoinRoom(_ context.Context, room, userId, connId string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	entry, ok := r.sessions[userId][connId]
+	if !ok {
+		return ErrNotRegistered
+	}
+	r.joinRoom(room, entry)
+	return nil
+}
+
+// LeaveRoom 连接退出房间
+func (r *MemoryRegistry) LeaveRoom(_ context.Context, room, userId, connId string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if entry, ok := r.sessions[userId][connId]; ok {
+		delete(entry.rooms, room)
+		r.leaveRoom(room, entry)
+	}
+	delete(r.expired[connKey{userId, connId}], room)
+	return nil
+}
+
+// RoomMembers 房间内的在线连接
+func (r *MemoryRegistry) RoomMembers(_ context.Context, room string) ([]Session, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	members := make([]Session, 0, len(r.rooms[room]))
+	for entry := range r.rooms[room] {
+		members = append(members, entry.session)
+	}
+	sortSessions(members)
+	return members, nil
+}
+
+// RegisterNode 注册或续期节点
+func (r *MemoryRegistry) RegisterNode(_ context.Context, node string, ttl int64) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if old, ok := r.nodes[node]; ok {
+		old.Stop()
+	}
+	var timer *time.Timer
+	timer = time.AfterFunc(time.Duration(ttl)*time.Second, func() {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		if r.nodes[node] == timer {
+			delete(r.nodes, node)
+		}
+	})
+	r.nodes[node] = timer
+	return nil
+}
+
+// UnregisterNode 注销节点
+func (r *MemoryRegistry) UnregisterNode(_ context.Context, node string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if timer, ok := r.nodes[node]; ok {
+		timer.Stop()
+		delete(r.nodes, node)
+	}
+	return nil
+}
+
+// Nodes 所有在线节点
+func (r *MemoryRegistry) Nodes(_ context.Context) ([]string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	nodes := make([]string, 0, len(r.nodes))
+	for node := range r.nodes {
+		nodes = append(nodes, node)
+	}
+	sort.Strings(nodes)
+	return nodes, nil
+}
+
+func (r *MemoryRegistry) lookup(userId string) []Session {
+	sessions := make([]Session, 0, len(r.sessions[userId]))
+	for _, entry := range r.sessions[userId] {
+		sessions = append(sessions, entry.session)
+	}
+	sortSessions(sessions)
+	return sessions
+}
+
+func (r *MemoryRegistry) remove(entry *memoryEntry) {
+	session := entry.session
+	entry.timer.Stop()
+	delete(r.sessions[session.UserId], session.ConnId)
+	if len(r.sessions[session.UserId]) == 0 {
+		delete(r.sessions, session.UserId)
+	}
+	for room := range entry.rooms {
+		r.leaveRoom(room, entry)
+	}
+	r.notify(Event{Type: EventDelete, Session: Session{UserId: session.UserId, ConnId: session.ConnId}})
+}
+
+func (r *MemoryRegistry) joinRoom(room string, entry *memoryEntry) {
+	entry.rooms[room] = struct{}{}
+	if r.rooms[room] == nil {
+		r.rooms[room] = make(map[*memoryEntry]struct{})
+	}
+	r.rooms[room][entry] = struct{}{}
+}
+
+func (r *MemoryRegistry) leaveRoom(room string, entry *memoryEntry) {
+	delete(r.rooms[room], entry)
+	if len(r.rooms[room]) == 0 {
+		delete(r.rooms, room)
+	}
+}
+
+func (r *MemoryRegistry) notify(event Event) {
+	for events := range r.watchers[event.Session.UserId] {
+		select {
+		case events <- event:
+		default:
+		}
+	}
+}
+
+// sortSessions 按用户和建立时间排序，保证结果稳定
+func sortSessions(sessions []Session) {
+	sort.Slice(sessions, func(i, j int) bool {
+		if sessions[i].UserId != sessions[j].UserId {
+			return sessions[i].UserId < sessions[j].UserId
+		}
+		if sessions[i].Since != sessions[j].Since {
+			return sessions[i].Since < sessions[j].Since
+		}
+		return sessions[i].ConnId < sessions[j].ConnId
+	})
+}
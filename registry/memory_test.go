@@ -0,0 +1,157 @@
+package registry
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemoryRegistry_RegisterLookup(t *testing.T) {
+	r := NewMemoryRegistry()
+	ctx := context.Background()
+
+	phone := Session{UserId: "u1", ConnId: "c1", Node: "node-a", Since: 1}
+	laptop := Session{UserId: "u1", ConnId: "c2", Node: "node-b", Since: 2}
+	other := Session{UserId: "u2", ConnId: "c3", Node: "node-b", Since: 3}
+	for _, session := range []Session{laptop, phone, other} {
+		assert.NoError(t, r.Register(ctx, session, 10))
+	}
+
+	sessions, err := r.Lookup(ctx, "u1")
+	assert.NoError(t, err)
+	assert.Equal(t, []Session{phone, laptop}, sessions)
+
+	batch, err := r.BatchLookup(ctx, []string{"u1", "u2", "u3"})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string][]Session{"u1": {phone, laptop}, "u2": {other}}, batch)
+
+	assert.NoError(t, r.Unregister(ctx, "u1", "c1"))
+	sessions, err = r.Lookup(ctx, "u1")
+	assert.NoError(t, err)
+	assert.Equal(t, []Session{laptop}, sessions)
+}
+
+func TestMemoryRegistry_Expire(t *testing.T) {
+	r := NewMemoryRegistry()
+	ctx := context.Background()
+
+	assert.NoError(t, r.Register(ctx, Session{UserId: "u1", ConnId: "c1", Node: "node-a"}, 0))
+	assert.Eventually(t, func() bool {
+		sessions, _ := r.Lookup(ctx, "u1")
+		return len(sessions) == 0
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestMemoryRegistry_Watch(t *testing.T) {
+	r := NewMemoryRegistry()
+	ctx, cancel := context.WithCancel(context.Background())
+
+	events, err := r.Watch(ctx, "u1")
+	assert.NoError(t, err)
+
+	session := Session{UserId: "u1", ConnId: "c1", Node: "node-a", Since: 1}
+	assert.NoError(t, r.Register(ctx, session, 10))
+	// 续期不产生事件
+	assert.NoError(t, r.Register(ctx, session, 10))
+	assert.NoError(t, r.Unregister(ctx, "u1", "c1"))
+
+	assert.Equal(t, Event{Type: EventPut, Session: session}, <-events)
+	assert.Equal(t, Event{Type: EventDelete, Session: Session{UserId: "u1", ConnId: "c1"}}, <-events)
+
+	cancel()
+	assert.Eventually(t, func() bool {
+		_, ok := <-events
+		return !ok
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestMemoryRegistry_Rooms(t *testing.T) {
+	r := NewMemoryRegistry()
+	ctx := context.Background()
+
+	assert.ErrorIs(t, r.JoinRoom(ctx, "room", "u1", "c1"), ErrNotRegistered)
+
+	s1 := Session{UserId: "u1", ConnId: "c1", Node: "node-a"}
+	s2 := Session{UserId: "u2", ConnId: "c2", Node: "node-b"}
+	assert.NoError(t, r.Register(ctx, s1, 10))
+	assert.NoError(t, r.Register(ctx, s2, 10))
+	assert.NoError(t, r.JoinRoom(ctx, "room", "u1", "c1"))
+	assert.NoError(t, r.JoinRoom(ctx, "room", "u2", "c2"))
+
+	members, err := r.RoomMembers(ctx, "room")
+	assert.NoError(t, err)
+	assert.Equal(t, []Session{s1, s2}, members)
+
+	assert.NoError(t, r.LeaveRoom(ctx, "room", "u2", "c2"))
+	// 下线自动退出房间
+	assert.NoError(t, r.Unregister(ctx, "u1", "c1"))
+	members, err = r.RoomMembers(ctx, "room")
+	assert.NoError(t, err)
+	assert.Empty(t, members)
+}
+
+func TestMemoryRegistry_RoomsSurviveExpire(t *testing.T) {
+	r := NewMemoryRegistry()
+	ctx := context.Background()
+
+	session := Session{UserId: "u1", ConnId: "c1", Node: "node-a"}
+	assert.NoError(t, r.Register(ctx, session, 0))
+	assert.NoError(t, r.JoinRoom(ctx, "room", "u1", "c1"))
+	assert.Eventually(t, func() bool {
+		members, _ := r.RoomMembers(ctx, "room")
+		return len(members) == 0
+	}, time.Second, 10*time.Millisecond)
+
+	// 过期后同一个连接续期，重新回到房间
+	assert.NoError(t, r.Register(ctx, session, 10))
+	members, err := r.RoomMembers(ctx, "room")
+	assert.NoError(t, err)
+	assert.Equal(t, []Session{session}, members)
+
+	// 注销之后不再恢复
+	assert.NoError(t, r.Unregister(ctx, "u1", "c1"))
+	assert.NoError(t, r.Register(ctx, session, 10))
+	members, err = r.RoomMembers(ctx, "room")
+	assert.NoError(t, err)
+	assert.Empty(t, members)
+}
+
+func TestMemoryRegistry_Nodes(t *testing.T) {
+	r := NewMemoryRegistry()
+	ctx := context.Background()
+
+	assert.NoError(t, r.RegisterNode(ctx, "node-b", 10))
+	assert.NoError(t, r.RegisterNode(ctx, "node-a", 10))
+	assert.NoError(t, r.RegisterNode(ctx, "node-c", 0))
+	assert.Eventually(t, func() bool {
+		nodes, _ := r.Nodes(ctx)
+		return len(nodes) == 2
+	}, time.Second, 10*time.Millisecond)
+
+	nodes, err := r.Nodes(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"node-a", "node-b"}, nodes)
+
+	assert.NoError(t, r.UnregisterNode(ctx, "node-a"))
+	nodes, err = r.Nodes(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"node-b"}, nodes)
+}
+
+func TestLatest(t *testing.T) {
+	_, ok := Latest(nil)
+	assert.False(t, ok)
+
+	latest, ok := Latest([]Session{{ConnId: "c1", Since: 2}, {ConnId: "c2", Since: 3}, {ConnId: "c3", Since: 1}})
+	assert.True(t, ok)
+	assert.Equal(t, "c2", latest.ConnId)
+}
+
+func TestValidateName(t *testing.T) {
+	assert.NoError(t, ValidateName("lobby"))
+	for _, name := range []string{"", "/", "r/u1", "u1/"} {
+		assert.ErrorIs(t, ValidateName(name), ErrInvalidName, name)
+	}
+}
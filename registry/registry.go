@@ -0,0 +1,90 @@
+package registry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+var (
+	// ErrNotRegistered 连接还没有注册在线状态
+	ErrNotRegistered = errors.New("registry: session not registered")
+	// ErrInvalidName 用户 id 或者房间名为空或者包含 "/"
+	ErrInvalidName = errors.New("registry: invalid name")
+)
+
+// ValidateName 检查用户 id 和房间名，"/" 是 etcd key 的分隔符，不能出现在名字中
+func ValidateName(name string) error {
+	if name == "" || strings.Contains(name, "/") {
+		return fmt.Errorf("%w: %q", ErrInvalidName, name)
+	}
+	return nil
+}
+
+// EventType 在线状态变化类型
+type EventType int
+
+const (
+	// EventPut 用户的一个连接上线
+	EventPut EventType = iota
+	// EventDelete 用户的一个连接下线或者租约过期
+	EventDelete
+)
+
+// Session 用户的一个连接（设备），同一个用户可以同时在多个节点上有多个连接
+type Session struct {
+	UserId string `json:"-"`
+	ConnId string `json:"-"`
+	Node   string `json:"node"`
+	// Since 连接建立时间，UnixNano
+	Since int64 `json:"since"`
+}
+
+// Event 用户在线状态变化，EventDelete 时只有 UserId 和 ConnId
+type Event struct {
+	Type    EventType
+	Session Session
+}
+
+// Registry 记录用户的每个连接在哪个节点（Host+WSPort）上在线
+type Registry interface {
+	// Register 注册连接在线，ttl 秒内不续期就过期，重复调用即续期
+	Register(ctx context.Context, session Session, ttl int64) error
+	// Unregister 注销连接
+	Unregister(ctx context.Context, userId, connId string) error
+	// Lookup 查找 userId 的所有在线连接，不在线时返回空
+	Lookup(ctx context.Context, userId string) ([]Session, error)
+	// BatchLookup 批量查找，返回 userId -> 在线连接，不在线的用户不会出现在结果中
+	BatchLookup(ctx context.Context, userIds []string) (map[string][]Session, error)
+	// Watch 监听 userId 所有连接的在线状态变化，ctx 结束时通道关闭
+	Watch(ctx context.Context, userId string) (<-chan Event, error)
+
+	// JoinRoom 在线连接加入房间 room，连接下线或过期时自动退出所有房间，过期后同一个连接重新注册时恢复
+	JoinRoom(ctx context.Context, room, userId, connId string) error
+	// LeaveRoom 连接退出房间 room
+	LeaveRoom(ctx context.Context, room, userId, connId string) error
+	// RoomMembers 房间内的在线连接
+	RoomMembers(ctx context.Context, room string) ([]Session, error)
+
+	// RegisterNode 注册节点在线，ttl 秒内不续期就过期，重复调用即续期
+	RegisterNode(ctx context.Context, node string, ttl int64) error
+	// UnregisterNode 注销节点
+	UnregisterNode(ctx context.Context, node string) error
+	// Nodes 所有在线节点
+	Nodes(ctx context.Context) ([]string, error)
+}
+
+// Latest 最近建立的连接，sessions 为空时返回 false
+func Latest(sessions []Session) (Session, bool) {
+	if len(sessions) == 0 {
+		return Session{}, false
+	}
+	latest := sessions[0]
+	for _, session := range sessions[1:] {
+		if session.Since > latest.Since {
+			latest = session
+		}
+	}
+	return latest, true
+}
@@ -0,0 +1,82 @@
+package sequence
+
+import (
+	"context"
+	"fmt"
+
+	clientv3 "go.etcd.io/etcd/client/v3"
+)
+
+const (
+	// etcd 中序号 key 的前缀，完整的 key 为 prefix+seqPrefix+stream，序号即 key 的 version
+	seqPrefix = "seq/"
+	// etcd 中历史消息 key 的前缀，完整的 key 为 prefix+historyPrefix+stream+"/"+补零的序号
+	historyPrefix = "history/"
+)
+
+// EtcdStore 基于 etcd 的 Store，集群中所有节点共享序号和历史消息
+type EtcdStore struct {
+	cli    *clientv3.Client
+	prefix string
+	size   int
+}
+
+// NewEtcdStore 创建 etcd Store，每个流最多保存 size 条历史消息
+func NewEtcdStore(cli *clientv3.Client, prefix string, size int) *EtcdStore {
+	return &EtcdStore{cli: cli, prefix: prefix, size: size}
+}
+
+// Next 每次 Put 都会让 key 的 version 加一，用它作为序号
+func (s *EtcdStore) Next(ctx context.Context, stream string) (uint64, error) {
+	resp, err := s.cli.Put(ctx, s.prefix+seqPrefix+stream, "", clientv3.WithPrevKV())
+	if err != nil {
+		return 0, err
+	}
+	if resp.PrevKv == nil {
+		return 1, nil
+	}
+	return uint64(resp.PrevKv.Version) + 1, nil
+}
+
+// Append 写入历史消息，同时删除 size 条之前的那一条
+func (s *EtcdStore) Append(ctx context.Context, stream string, seq uint64, body []byte) error {
+	ops := []clientv3.Op{clientv3.OpPut(s.historyKey(stream, seq), string(body))}
+	if seq > uint64(s.size) {
+		ops = append(ops, clientv3.OpDelete(s.historyKey(stream, seq-uint64(s.size))))
+	}
+	_, err := s.cli.Txn(ctx).Then(ops...).Commit()
+	return err
+}
+
+// Since 读取 after 之后的历史消息，最近 size 条之前的消息视为已经删除
+func (s *EtcdStore) Since(ctx context.Context, stream string, after uint64) ([][]byte, error) {
+	resp, err := s.cli.Get(ctx, s.prefix+seqPrefix+stream)
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.Kvs) == 0 {
+		return nil, nil
+	}
+	last := uint64(resp.Kvs[0].Version)
+	if after >= last {
+		return nil, nil
+	}
+	if last > uint64(s.size) && after < last-uint64(s.size) {
+		return nil, ErrGap
+	}
+	prefix := s.prefix + historyPrefix + stream + "/"
+	resp, err = s.cli.Get(ctx, s.historyKey(stream, after+1), clientv3.WithRange(clientv3.GetPrefixRangeEnd(prefix)))
+	if err != nil {
+		return nil, err
+	}
+	bodies := make([][]byte, 0, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		bodies = append(bodies, kv.Value)
+	}
+	return bodies, nil
+}
+
+// historyKey 序号补零到 20 位，保证按 key 排序就是按序号排序
+func (s *EtcdStore) historyKey(stream string, seq uint64) string {
+	return fmt.Sprintf("%s%s%s/%020d", s.prefix, historyPrefix, stream, seq)
+}
@@ -0,0 +1,89 @@
+package sequence
+
+import (
+	"context"
+	"sort"
+	"sync"
+)
+
+// MemoryStore 进程内的 Store，用于单机部署和测试
+type MemoryStore struct {
+	mu      sync.Mutex
+	size    int
+	streams map[string]*memoryStream
+}
+
+type memoryStream struct {
+	last uint64
+	// evicted 已经删除的最大序号，after 小于它时说明有消息丢失
+	evicted uint64
+	// records 按序号排序
+	records []record
+}
+
+type record struct {
+	seq  uint64
+	body []byte
+}
+
+// NewMemoryStore 创建进程内 Store，每个流最多保存 size 条历史消息
+func NewMemoryStore(size int) *MemoryStore {
+	return &MemoryStore{size: size, streams: make(map[string]*memoryStream)}
+}
+
+// Next 分配下一个序号
+func (s *MemoryStore) Next(_ context.Context, stream string) (uint64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st := s.stream(stream)
+	st.last++
+	return st.last, nil
+}
+
+// Append 按序号插入历史记录
+func (s *MemoryStore) Append(_ context.Context, stream string, seq uint64, body []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st := s.stream(stream)
+	if seq <= st.evicted {
+		return nil
+	}
+	// 分配序号和保存之间可能被其他消息插队，按序号插入
+	i := sort.Search(len(st.records), func(i int) bool { return st.records[i].seq >= seq })
+	st.records = append(st.records, record{})
+	copy(st.records[i+1:], st.records[i:])
+	st.records[i] = record{seq: seq, body: body}
+	if drop := len(st.records) - s.size; drop > 0 {
+		st.evicted = st.records[drop-1].seq
+		st.records = append(st.records[:0], st.records[drop:]...)
+	}
+	return nil
+}
+
+// Since 返回 after 之后的历史消息
+func (s *MemoryStore) Since(_ context.Context, stream string, after uint64) ([][]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st, ok := s.streams[stream]
+	if !ok {
+		return nil, nil
+	}
+	if after < st.evicted {
+		return nil, ErrGap
+	}
+	i := sort.Search(len(st.records), func(i int) bool { return st.records[i].seq > after })
+	bodies := make([][]byte, 0, len(st.records)-i)
+	for _, r := range st.records[i:] {
+		bodies = append(bodies, r.body)
+	}
+	return bodies, nil
+}
+
+func (s *MemoryStore) stream(stream string) *memoryStream {
+	st, ok := s.streams[stream]
+	if !ok {
+		st = &memoryStream{}
+		s.streams[stream] = st
+	}
+	return st
+}
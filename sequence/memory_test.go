@@ -0,0 +1,49 @@
+package sequence
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemoryStore(t *testing.T) {
+	s := NewMemoryStore(3)
+	ctx := context.Background()
+
+	messages, err := s.Since(ctx, "u1", 0)
+	assert.NoError(t, err)
+	assert.Empty(t, messages)
+
+	for i := 1; i <= 4; i++ {
+		seq, err := s.Next(ctx, "u1")
+		assert.NoError(t, err)
+		assert.Equal(t, uint64(i), seq)
+	}
+	// 其他流的序号互不影响
+	seq, err := s.Next(ctx, "u2")
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(1), seq)
+
+	// 乱序保存
+	for _, seq := range []uint64{2, 1, 4, 3} {
+		assert.NoError(t, s.Append(ctx, "u1", seq, []byte(fmt.Sprint(seq))))
+	}
+
+	messages, err = s.Since(ctx, "u1", 2)
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{[]byte("3"), []byte("4")}, messages)
+
+	messages, err = s.Since(ctx, "u1", 1)
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{[]byte("2"), []byte("3"), []byte("4")}, messages)
+
+	// 1 已经被删除
+	_, err = s.Since(ctx, "u1", 0)
+	assert.ErrorIs(t, err, ErrGap)
+
+	messages, err = s.Since(ctx, "u1", 4)
+	assert.NoError(t, err)
+	assert.Empty(t, messages)
+}
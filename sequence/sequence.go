@@ -0,0 +1,19 @@
+package sequence
+
+import (
+	"context"
+	"errors"
+)
+
+// ErrGap 请求的序号之后的消息已经不在历史记录中，客户端需要全量同步
+var ErrGap = errors.New("sequence: history does not cover the requested offset")
+
+// Store 为每个流（比如一个用户收到的所有消息）分配单调递增的序号，并保存最近的消息用于断线重连后补发
+type Store interface {
+	// Next 分配 stream 的下一个序号，从 1 开始
+	Next(ctx context.Context, stream string) (uint64, error)
+	// Append 保存序号为 seq 的消息，超过历史长度时删除最早的
+	Append(ctx context.Context, stream string, seq uint64, body []byte) error
+	// Since 按序号顺序返回 after 之后的消息，after 之后有消息已经被删除时返回 ErrGap
+	Since(ctx context.Context, stream string, after uint64) ([][]byte, error)
+}
@@ -2,25 +2,74 @@ package wsContext
 
 import (
 	"context"
+	"github.com/WangSiangCun/go-ws/broker"
 	"github.com/WangSiangCun/go-ws/config"
 	"github.com/WangSiangCun/go-ws/etcdService"
+	"github.com/WangSiangCun/go-ws/offline"
 	"github.com/WangSiangCun/go-ws/rabbitMQService"
-	"github.com/streadway/amqp"
+	"github.com/WangSiangCun/go-ws/registry"
+	"github.com/WangSiangCun/go-ws/sequence"
 	clientv3 "go.etcd.io/etcd/client/v3"
+	"log"
+	"time"
 )
 
 type WSContext struct {
-	Context            context.Context
-	EtcdClient         *clientv3.Client
-	RabbitMQConnection *amqp.Connection
+	Context    context.Context
+	EtcdClient *clientv3.Client
+	// Broker 节点间消息传输
+	Broker broker.Broker
+	// Registry 用户在线状态
+	Registry registry.Registry
+	// Offline 离线消息，为 nil 时不保存
+	Offline offline.Store
+	// Sequence 消息序号和历史，为 nil 时不分配序号
+	Sequence sequence.Store
 }
 
 func NewContext(c context.Context, config *config.Config) WSContext {
+	if config.IsStandalone() {
+		// 单机模式，不连接 etcd 和 RabbitMQ，在线状态只保存在本进程
+		ws := WSContext{
+			Registry: registry.NewMemoryRegistry(),
+			Offline:  mustNewOfflineStore(config.Offline),
+			Context:  c,
+		}
+		if config.Sequence.Enabled {
+			ws.Sequence = sequence.NewMemoryStore(config.Sequence.History)
+		}
+		return ws
+	}
 	etcdClient := etcdService.MustInitEtcd(config.Etcd.Hosts)
 	rabbitMQConnect := rabbitMQService.InitRabbitMQ(config.RabbitMQ.MQUrl)
-	return WSContext{
-		EtcdClient:         etcdClient,
-		RabbitMQConnection: rabbitMQConnect,
-		Context:            c,
+	ws := WSContext{
+		EtcdClient: etcdClient,
+		Broker:     broker.NewAMQPBroker(rabbitMQConnect),
+		Registry:   registry.NewEtcdRegistry(etcdClient, ""),
+		Offline:    mustNewOfflineStore(config.Offline),
+		Context:    c,
+	}
+	if config.Sequence.Enabled {
+		ws.Sequence = sequence.NewEtcdStore(etcdClient, "", config.Sequence.History)
+	}
+	return ws
+}
+
+func mustNewOfflineStore(c config.Offline) offline.Store {
+	options := offline.Options{
+		TTL:         time.Duration(c.TTL) * time.Second,
+		MaxMessages: c.MaxMessages,
+		MaxBytes:    c.MaxBytes,
+	}
+	switch c.Store {
+	case config.OfflineMemory:
+		return offline.NewMemoryStore(options)
+	case config.OfflineFile:
+		store, err := offline.NewFileStore(c.Dir, options)
+		if err != nil {
+			log.Fatal(err)
+		}
+		return store
 	}
+	return nil
 }